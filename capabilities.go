@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+)
+
+// Capabilities is a list of capabilities. Each element is a capability as it
+// appears on the wire, either "key" or "key=value" (e.g. "ofs-delta",
+// "agent=git/2.20.0", "symref=HEAD:refs/heads/master").
+//
+// In protocol v0/v1, the capabilities are sent as a space-separated list, and
+// a key can appear multiple times (e.g. "symref"). In protocol v2, each
+// capability is sent in its own line, and the value can be a space-separated
+// list of features (e.g. "fetch=shallow filter").
+type Capabilities []string
+
+// ParseCapabilities parses a space-separated capability list of protocol
+// v0/v1.
+func ParseCapabilities(s string) Capabilities {
+	if s == "" {
+		// This is to avoid strings.Split("", " ") => []string{""}.
+		return Capabilities{}
+	}
+	return Capabilities(strings.Split(s, " "))
+}
+
+// ParseCapability splits a capability into the key and the value. The value is
+// empty if the capability doesn't have "=".
+func ParseCapability(s string) (key, value string) {
+	ss := strings.SplitN(s, "=", 2)
+	if len(ss) == 1 {
+		return ss[0], ""
+	}
+	return ss[0], ss[1]
+}
+
+// String returns the capabilities as a space-separated list. This is the
+// inverse of ParseCapabilities.
+func (c Capabilities) String() string {
+	return strings.Join(c, " ")
+}
+
+// Has returns true if the capabilities have the key, with or without a value.
+func (c Capabilities) Has(key string) bool {
+	_, ok := c.Lookup(key)
+	return ok
+}
+
+// Lookup returns the value of the first capability with the key. The boolean
+// is false if there's no such capability.
+func (c Capabilities) Lookup(key string) (string, bool) {
+	for _, s := range c {
+		if k, v := ParseCapability(s); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Values returns the values of all capabilities with the key. The value of a
+// protocol v2 capability is split into the features, so that "fetch=shallow
+// filter" returns "shallow" and "filter". A capability without a value
+// contributes nothing.
+func (c Capabilities) Values(key string) []string {
+	var ret []string
+	for _, s := range c {
+		k, v := ParseCapability(s)
+		if k != key || v == "" {
+			continue
+		}
+		ret = append(ret, strings.Split(v, " ")...)
+	}
+	return ret
+}
+
+// HasValue returns true if any capability with the key has the value. For
+// example, HasValue("fetch", "filter") checks that the protocol v2 fetch
+// command supports the filter feature.
+func (c Capabilities) HasValue(key, value string) bool {
+	for _, v := range c.Values(key) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Symrefs returns the symbolic refs advertised with the "symref" capabilities
+// as a map from the symbolic ref to its target.
+func (c Capabilities) Symrefs() map[string]string {
+	ret := map[string]string{}
+	for _, v := range c.Values("symref") {
+		ss := strings.SplitN(v, ":", 2)
+		if len(ss) == 2 {
+			ret[ss[0]] = ss[1]
+		}
+	}
+	return ret
+}
+
+// SideBandPacketSize returns the maximum sideband packet size for the
+// capabilities that the client requested. It returns 0 if the client requested
+// neither "side-band-64k" nor "side-band", which means the response is not
+// sideband encoded.
+func (c Capabilities) SideBandPacketSize() int {
+	switch {
+	case c.Has("side-band-64k"):
+		return SideBand64kMaxPacketSize
+	case c.Has("side-band"):
+		return SideBandMaxPacketSize
+	}
+	return 0
+}
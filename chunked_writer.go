@@ -19,6 +19,8 @@ import (
 	"io"
 )
 
+// WriteFlushCloser is the interface that groups the Write, Flush, and Close
+// methods.
 type WriteFlushCloser interface {
 	io.WriteCloser
 	Flush() error
@@ -30,6 +32,10 @@ type chunkedWriter struct {
 	ch  chan<- []byte
 }
 
+// NewChunkedWriter returns a writer that splits the written bytes into the
+// chunks of sz bytes, and sends them to the channel.
+//
+// Deprecated: Use NewSideBandWriter to write the sideband packets.
 func NewChunkedWriter(sz int) (<-chan []byte, WriteFlushCloser) {
 	ch := make(chan []byte)
 	return ch, &chunkedWriter{sz: sz, ch: ch}
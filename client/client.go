@@ -0,0 +1,217 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client implements a Git smart HTTP client on top of gitprotocolio.
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	zeroObjectID = "0000000000000000000000000000000000000000"
+	agent        = "agent=gitprotocolio"
+)
+
+// Client is a Git smart HTTP client.
+type Client struct {
+	// HTTPClient is used to send the requests. If nil, http.DefaultClient
+	// is used.
+	HTTPClient *http.Client
+	// ProtocolVersion is the protocol version that the client requests (0,
+	// 1, or 2). The server may respond with an older version.
+	ProtocolVersion int
+}
+
+// Ref is a ref advertised by a server.
+type Ref struct {
+	Name     string
+	ObjectID string
+	// SymrefTarget is the name of the ref that this ref points to if this
+	// is a symbolic ref, like HEAD.
+	SymrefTarget string
+	// PeeledObjectID is the object that an annotated tag points to.
+	PeeledObjectID string
+}
+
+// advertisement is the result of the ref discovery.
+type advertisement struct {
+	version int
+	// capabilities are the v0/v1 capabilities, or the v2 capability
+	// lines.
+	capabilities gitprotocolio.Capabilities
+	// refs is empty for v2.
+	refs []*Ref
+}
+
+func (a *advertisement) hasCapability(c string) bool {
+	return a.capabilities.Has(c)
+}
+
+// LsRemote returns the refs of the repository at repoURL.
+func (c *Client) LsRemote(ctx context.Context, repoURL string) ([]*Ref, error) {
+	adv, err := c.discover(ctx, repoURL, "git-upload-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version != 2 {
+		return adv.refs, nil
+	}
+	return c.lsRefs(ctx, repoURL)
+}
+
+func (c *Client) lsRefs(ctx context.Context, repoURL string) ([]*Ref, error) {
+	var buf bytes.Buffer
+	for _, chunk := range []*gitprotocolio.ProtocolV2LsRefsRequestChunk{
+		{Command: "ls-refs"},
+		{Capability: agent},
+		{EndCapability: true},
+		{Symrefs: true},
+		{Peel: true},
+		{EndArgument: true},
+	} {
+		buf.Write(chunk.EncodeToPktLine())
+	}
+	resp, err := c.post(ctx, repoURL, "git-upload-pack", &buf)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var refs []*Ref
+	lsRefsResp := gitprotocolio.NewProtocolV2LsRefsResponse(resp.Body)
+	for lsRefsResp.Scan() {
+		chunk := lsRefsResp.Chunk()
+		if chunk.RefName == "" || chunk.Unborn {
+			continue
+		}
+		refs = append(refs, &Ref{
+			Name:           chunk.RefName,
+			ObjectID:       chunk.ObjectID,
+			SymrefTarget:   chunk.SymrefTarget,
+			PeeledObjectID: chunk.PeeledObjectID,
+		})
+	}
+	if err := lsRefsResp.Err(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// discover sends a GET request to /info/refs.
+func (c *Client) discover(ctx context.Context, repoURL, service string) (*advertisement, error) {
+	u, err := serviceURL(repoURL, "info/refs")
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"service": {service}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != fmt.Sprintf("application/x-%s-advertisement", service) {
+		return nil, fmt.Errorf("not a smart HTTP server: Content-Type %q", ct)
+	}
+
+	adv := &advertisement{}
+	var symrefs map[string]string
+	infoRefsResp := gitprotocolio.NewInfoRefsResponse(resp.Body)
+	for infoRefsResp.Scan() {
+		chunk := infoRefsResp.Chunk()
+		adv.capabilities = infoRefsResp.Capabilities()
+		if chunk.ProtocolVersion != 0 {
+			adv.version = int(chunk.ProtocolVersion)
+			continue
+		}
+		if adv.version == 2 {
+			continue
+		}
+		if chunk.Capabilities != nil {
+			symrefs = adv.capabilities.Symrefs()
+		}
+		switch {
+		case chunk.Ref == "" || chunk.Ref == "capabilities^{}":
+		case strings.HasSuffix(chunk.Ref, "^{}"):
+			if n := len(adv.refs); n != 0 && adv.refs[n-1].Name == strings.TrimSuffix(chunk.Ref, "^{}") {
+				adv.refs[n-1].PeeledObjectID = chunk.ObjectID
+			}
+		default:
+			adv.refs = append(adv.refs, &Ref{
+				Name:         chunk.Ref,
+				ObjectID:     chunk.ObjectID,
+				SymrefTarget: symrefs[chunk.Ref],
+			})
+		}
+	}
+	if err := infoRefsResp.Err(); err != nil {
+		return nil, err
+	}
+	return adv, nil
+}
+
+func (c *Client) post(ctx context.Context, repoURL, service string, body io.Reader) (*http.Response, error) {
+	u, err := serviceURL(repoURL, service)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf("application/x-%s-request", service))
+	req.Header.Set("Accept", fmt.Sprintf("application/x-%s-result", service))
+	return c.do(req)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.ProtocolVersion != 0 {
+		req.Header.Set("Git-Protocol", fmt.Sprintf("version=%d", c.ProtocolVersion))
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return resp, nil
+}
+
+func serviceURL(repoURL, p string) (*url.URL, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, p)
+	return u, nil
+}
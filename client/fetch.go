@@ -0,0 +1,333 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/google/gitprotocolio"
+)
+
+// FetchRequest specifies the objects to fetch.
+type FetchRequest struct {
+	// Wants are the objects to fetch.
+	Wants []string
+	// Haves are the objects that the client has. The server can omit the
+	// objects reachable from the common ones.
+	Haves []string
+	// Progress receives the human-readable progress messages from the
+	// server. If nil, the server is asked not to send them.
+	Progress io.Writer
+}
+
+// FetchResult is the result of a fetch.
+type FetchResult struct {
+	// CommonObjectIDs are the haves acknowledged by the server. For
+	// protocol v2, these are acknowledged in the negotiation rounds since
+	// the server doesn't send acknowledgments for the final request.
+	CommonObjectIDs []string
+	// Pack is the pack file stream. The caller must close it.
+	Pack io.ReadCloser
+}
+
+// haveBatchSize is the number of the new haves sent in a negotiation round.
+const haveBatchSize = 32
+
+// Fetch fetches a pack file from the repository at repoURL.
+//
+// The haves are sent in rounds of up to 32 until the server is ready to send
+// the pack file or the haves run out, and then the pack file is requested with
+// "done". The server is stateless, so each round sends the wants and the
+// haves acknowledged as common so far again. In protocol v0/v1, this needs the
+// "multi_ack_detailed" capability. Without it, all the haves are sent with
+// "done" in one request.
+func (c *Client) Fetch(ctx context.Context, repoURL string, req *FetchRequest) (*FetchResult, error) {
+	if len(req.Wants) == 0 {
+		return nil, errors.New("no want")
+	}
+	adv, err := c.discover(ctx, repoURL, "git-upload-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version == 2 {
+		return c.fetchV2(ctx, repoURL, req)
+	}
+	return c.fetchV1(ctx, repoURL, adv, req)
+}
+
+// nextHaves returns the haves of the next negotiation round, and the rest of
+// the pending haves.
+func nextHaves(common, pending []string) ([]string, []string) {
+	n := len(pending)
+	if n > haveBatchSize {
+		n = haveBatchSize
+	}
+	haves := append(append([]string{}, common...), pending[:n]...)
+	return haves, pending[n:]
+}
+
+func (c *Client) fetchV1(ctx context.Context, repoURL string, adv *advertisement, req *FetchRequest) (*FetchResult, error) {
+	var caps []string
+	switch {
+	case adv.hasCapability("side-band-64k"):
+		caps = append(caps, "side-band-64k")
+	case adv.hasCapability("side-band"):
+		caps = append(caps, "side-band")
+	default:
+		return nil, errors.New("the server doesn't support side-band")
+	}
+	multiAck := adv.hasCapability("multi_ack_detailed")
+	if multiAck {
+		caps = append(caps, "multi_ack_detailed")
+	}
+	if adv.hasCapability("ofs-delta") {
+		caps = append(caps, "ofs-delta")
+	}
+	if req.Progress == nil && adv.hasCapability("no-progress") {
+		caps = append(caps, "no-progress")
+	}
+	caps = append(caps, agent)
+
+	newRequest := func(haves []string, done bool) *bytes.Buffer {
+		var buf bytes.Buffer
+		for i, oid := range req.Wants {
+			chunk := &gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: oid}
+			if i == 0 {
+				chunk.Capabilities = caps
+			}
+			buf.Write(chunk.EncodeToPktLine())
+		}
+		buf.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true}).EncodeToPktLine())
+		for _, oid := range haves {
+			buf.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: oid}).EncodeToPktLine())
+		}
+		if done {
+			buf.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true}).EncodeToPktLine())
+		} else {
+			buf.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true}).EncodeToPktLine())
+		}
+		return &buf
+	}
+
+	result := &FetchResult{}
+	haves := req.Haves
+	if multiAck {
+		for pending, ready := req.Haves, false; len(pending) != 0 && !ready; {
+			var roundHaves []string
+			roundHaves, pending = nextHaves(result.CommonObjectIDs, pending)
+			resp, err := c.post(ctx, repoURL, "git-upload-pack", newRequest(roundHaves, false))
+			if err != nil {
+				return nil, err
+			}
+			// The response ends after NAK.
+			v1Resp := gitprotocolio.NewProtocolV1UploadPackResponse(resp.Body)
+			for v1Resp.Scan() {
+				chunk := v1Resp.Chunk()
+				if chunk.AckObjectID == "" {
+					continue
+				}
+				result.CommonObjectIDs = appendUnique(result.CommonObjectIDs, chunk.AckObjectID)
+				if chunk.AckDetail == "ready" {
+					ready = true
+				}
+			}
+			resp.Body.Close()
+			if err := v1Resp.Err(); err != nil {
+				return nil, err
+			}
+		}
+		haves = result.CommonObjectIDs
+	}
+
+	resp, err := c.post(ctx, repoURL, "git-upload-pack", newRequest(haves, true))
+	if err != nil {
+		return nil, err
+	}
+	v1Resp := gitprotocolio.NewProtocolV1UploadPackResponse(resp.Body)
+	var first []byte
+	for first == nil && v1Resp.Scan() {
+		chunk := v1Resp.Chunk()
+		switch {
+		case chunk.AckObjectID != "":
+			if chunk.AckDetail == "" || chunk.AckDetail == "common" {
+				result.CommonObjectIDs = appendUnique(result.CommonObjectIDs, chunk.AckObjectID)
+			}
+		case len(chunk.PackStream) != 0:
+			first = chunk.PackStream
+		}
+	}
+	if err := v1Resp.Err(); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if first == nil {
+		resp.Body.Close()
+		return nil, errors.New("no pack file in the response")
+	}
+
+	// PackStream is a sideband packet. Re-encode the chunks so that
+	// SideBandReader can demultiplex them.
+	packets := &chunkReader{next: func() ([]byte, error) {
+		if first != nil {
+			bs := gitprotocolio.BytesPacket(first).EncodeToPktLine()
+			first = nil
+			return bs, nil
+		}
+		if v1Resp.Scan() {
+			return v1Resp.Chunk().EncodeToPktLine(), nil
+		}
+		if err := v1Resp.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}}
+	result.Pack = &packReader{
+		Reader: gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(packets), gitprotocolio.Capabilities(caps).SideBandPacketSize(), progressFunc(req.Progress)),
+		body:   resp.Body,
+	}
+	return result, nil
+}
+
+func (c *Client) fetchV2(ctx context.Context, repoURL string, req *FetchRequest) (*FetchResult, error) {
+	newRequest := func(haves []string, done bool) *bytes.Buffer {
+		chunks := []*gitprotocolio.ProtocolV2FetchRequestChunk{
+			{Command: "fetch"},
+			{Capability: agent},
+			{EndCapability: true},
+			{OfsDelta: true},
+		}
+		if req.Progress == nil {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2FetchRequestChunk{NoProgress: true})
+		}
+		for _, oid := range req.Wants {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2FetchRequestChunk{WantObjectID: oid})
+		}
+		for _, oid := range haves {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2FetchRequestChunk{HaveObjectID: oid})
+		}
+		if done {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2FetchRequestChunk{NoMoreNegotiation: true})
+		}
+		chunks = append(chunks, &gitprotocolio.ProtocolV2FetchRequestChunk{EndArgument: true})
+		var buf bytes.Buffer
+		for _, chunk := range chunks {
+			buf.Write(chunk.EncodeToPktLine())
+		}
+		return &buf
+	}
+
+	result := &FetchResult{}
+	for pending := req.Haves; len(pending) != 0; {
+		var roundHaves []string
+		roundHaves, pending = nextHaves(result.CommonObjectIDs, pending)
+		resp, err := c.post(ctx, repoURL, "git-upload-pack", newRequest(roundHaves, false))
+		if err != nil {
+			return nil, err
+		}
+		// After "ready", the pack file follows in the same response.
+		// Otherwise, the response ends after the acknowledgments.
+		v2Resp := gitprotocolio.NewProtocolV2FetchResponse(resp.Body)
+		for v2Resp.Scan() {
+			chunk := v2Resp.Chunk()
+			if chunk.AckObjectID != "" {
+				result.CommonObjectIDs = appendUnique(result.CommonObjectIDs, chunk.AckObjectID)
+			}
+			if chunk.StartOfPackfile || chunk.EndResponse {
+				break
+			}
+		}
+		if err := v2Resp.Err(); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if v2Resp.Chunk() != nil && v2Resp.Chunk().StartOfPackfile {
+			result.Pack = newV2PackReader(resp.Body, v2Resp, req.Progress)
+			return result, nil
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := c.post(ctx, repoURL, "git-upload-pack", newRequest(result.CommonObjectIDs, true))
+	if err != nil {
+		return nil, err
+	}
+	v2Resp := gitprotocolio.NewProtocolV2FetchResponse(resp.Body)
+	for v2Resp.Scan() {
+		if v2Resp.Chunk().StartOfPackfile {
+			break
+		}
+	}
+	if err := v2Resp.Err(); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if v2Resp.Chunk() == nil || !v2Resp.Chunk().StartOfPackfile {
+		resp.Body.Close()
+		return nil, errors.New("no pack file in the response")
+	}
+	result.Pack = newV2PackReader(resp.Body, v2Resp, req.Progress)
+	return result, nil
+}
+
+// newV2PackReader returns a packReader that reads the packfile section of
+// v2Resp. The scanner must be at the section header.
+func newV2PackReader(body io.Closer, v2Resp *gitprotocolio.ProtocolV2FetchResponse, progress io.Writer) *packReader {
+	return &packReader{
+		body: body,
+		Reader: &chunkReader{next: func() ([]byte, error) {
+			for v2Resp.Scan() {
+				chunk := v2Resp.Chunk()
+				switch {
+				case len(chunk.PackStream) != 0:
+					return chunk.PackStream, nil
+				case len(chunk.ProgressMessage) != 0:
+					if progress != nil {
+						progress.Write(chunk.ProgressMessage)
+					}
+				case len(chunk.ErrorMessage) != 0:
+					return nil, gitprotocolio.ErrorPacket(chunk.ErrorMessage)
+				case chunk.EndResponse:
+					return nil, io.EOF
+				}
+			}
+			if err := v2Resp.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.ErrUnexpectedEOF
+		}},
+	}
+}
+
+// packReader reads the pack file from the response body.
+type packReader struct {
+	io.Reader
+	body io.Closer
+}
+
+func (p *packReader) Close() error {
+	return p.body.Close()
+}
+
+func appendUnique(ss []string, s string) []string {
+	for _, e := range ss {
+		if e == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
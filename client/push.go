@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/google/gitprotocolio"
+)
+
+// PushCommand is a ref update request.
+type PushCommand struct {
+	RefName string
+	// OldObjectID is the current value of the ref. Use
+	// "0000000000000000000000000000000000000000" to create a ref.
+	OldObjectID string
+	// NewObjectID is the new value of the ref. Use
+	// "0000000000000000000000000000000000000000" to delete a ref.
+	NewObjectID string
+}
+
+// PushRequest specifies the ref updates to push.
+type PushRequest struct {
+	Commands []*PushCommand
+	// Pack is the pack file that contains the objects needed by the new
+	// ref values. It's not sent if all the commands are deletions.
+	Pack io.Reader
+	// PushOptions are sent if non-empty. The server must support
+	// push-options.
+	PushOptions []string
+	// Progress receives the human-readable progress messages from the
+	// server.
+	Progress io.Writer
+}
+
+// PushResult is the result of a push.
+type PushResult struct {
+	// UnpackStatus is "ok" if the pack file is unpacked successfully.
+	// Otherwise, it's the error message.
+	UnpackStatus string
+	RefStatuses  []*RefStatus
+}
+
+// RefStatus is the result of a ref update.
+type RefStatus struct {
+	RefName string
+	OK      bool
+	// Message is the reason of the failure if not OK.
+	Message string
+}
+
+// Push pushes the ref updates to the repository at repoURL. Protocol v2
+// doesn't have a push command. Like git, this falls back to protocol v0 if
+// ProtocolVersion is 2.
+func (c *Client) Push(ctx context.Context, repoURL string, req *PushRequest) (*PushResult, error) {
+	if len(req.Commands) == 0 {
+		return nil, errors.New("no command")
+	}
+	if c.ProtocolVersion == 2 {
+		v0 := *c
+		v0.ProtocolVersion = 0
+		c = &v0
+	}
+	adv, err := c.discover(ctx, repoURL, "git-receive-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version == 2 {
+		return nil, errors.New("the server responded with protocol v2 for git-receive-pack")
+	}
+
+	caps := []string{"report-status"}
+	sideBand := adv.hasCapability("side-band-64k")
+	if sideBand {
+		caps = append(caps, "side-band-64k")
+	}
+	if len(req.PushOptions) != 0 {
+		if !adv.hasCapability("push-options") {
+			return nil, errors.New("the server doesn't support push-options")
+		}
+		caps = append(caps, "push-options")
+	}
+	caps = append(caps, agent)
+
+	onlyDeletes := true
+	var buf bytes.Buffer
+	for i, cmd := range req.Commands {
+		if cmd.NewObjectID == zeroObjectID {
+			if !adv.hasCapability("delete-refs") {
+				return nil, errors.New("the server doesn't support delete-refs")
+			}
+		} else {
+			onlyDeletes = false
+		}
+		chunk := &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID: cmd.OldObjectID,
+			NewObjectID: cmd.NewObjectID,
+			RefName:     cmd.RefName,
+		}
+		if i == 0 {
+			chunk.Capabilities = caps
+		}
+		buf.Write(chunk.EncodeToPktLine())
+	}
+	buf.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true}).EncodeToPktLine())
+	if len(req.PushOptions) != 0 {
+		for _, o := range req.PushOptions {
+			buf.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{PushOption: o}).EncodeToPktLine())
+		}
+		buf.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfPushOptions: true}).EncodeToPktLine())
+	}
+	var body io.Reader = &buf
+	if !onlyDeletes {
+		if req.Pack == nil {
+			return nil, errors.New("no pack file")
+		}
+		body = io.MultiReader(&buf, req.Pack)
+	}
+
+	resp, err := c.post(ctx, repoURL, "git-receive-pack", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rd io.Reader = resp.Body
+	if sideBand {
+		rd = gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(resp.Body), gitprotocolio.SideBand64kMaxPacketSize, progressFunc(req.Progress))
+	}
+	result := &PushResult{}
+	v1Resp := gitprotocolio.NewProtocolV1ReceivePackResponse(rd)
+	for v1Resp.Scan() {
+		chunk := v1Resp.Chunk()
+		switch {
+		case chunk.UnpackStatus != "":
+			result.UnpackStatus = chunk.UnpackStatus
+		case chunk.RefUpdateStatus != "":
+			result.RefStatuses = append(result.RefStatuses, &RefStatus{
+				RefName: chunk.RefName,
+				OK:      chunk.RefUpdateStatus == "ok",
+				Message: chunk.RefUpdateFailMessage,
+			})
+		}
+	}
+	if err := v1Resp.Err(); err != nil {
+		return nil, err
+	}
+	if result.UnpackStatus == "" {
+		return nil, errors.New("no report-status in the response")
+	}
+	return result, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+)
+
+// progressFunc returns a progress callback of SideBandReader that writes the
+// messages to w.
+func progressFunc(w io.Writer) func([]byte) {
+	if w == nil {
+		return nil
+	}
+	return func(bs []byte) {
+		w.Write(bs)
+	}
+}
+
+// chunkReader reads the byte chunks returned by next. next returns an error
+// at the end of the stream.
+type chunkReader struct {
+	next func() ([]byte, error)
+	buf  []byte
+	err  error
+}
+
+func (c *chunkReader) Read(bs []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.buf, c.err = c.next()
+	}
+	n := copy(bs, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
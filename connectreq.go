@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GitProtocolConnectRequest is the first packet that a client sends over the
+// Git transport (git://). It specifies the service and the repository, like
+// "git-upload-pack /repo\0host=example.com\0\0version=2\0".
+type GitProtocolConnectRequest struct {
+	Service  string
+	Pathname string
+	Host     string
+	// Port is empty if the host parameter doesn't have a port.
+	Port string
+	// ExtraParameters are the parameters after the host parameter, like
+	// "version=2". The server exports them as GIT_PROTOCOL, joined by ":".
+	ExtraParameters []string
+}
+
+// EncodeToPktLine serializes the request.
+func (r *GitProtocolConnectRequest) EncodeToPktLine() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\000", r.Service, r.Pathname)
+	if r.Host != "" {
+		host := r.Host
+		if strings.Contains(host, ":") {
+			// IPv6 address.
+			host = "[" + host + "]"
+		}
+		if r.Port != "" {
+			host += ":" + r.Port
+		}
+		fmt.Fprintf(&buf, "host=%s\000", host)
+	}
+	if len(r.ExtraParameters) != 0 {
+		buf.WriteByte(0)
+		for _, p := range r.ExtraParameters {
+			fmt.Fprintf(&buf, "%s\000", p)
+		}
+	}
+	return BytesPacket(buf.Bytes()).EncodeToPktLine()
+}
+
+// ReadGitProtocolConnectRequest reads a connect request from rd. It reads
+// exactly one packet so that the rest of the input can be read by other
+// scanners.
+func ReadGitProtocolConnectRequest(rd io.Reader) (*GitProtocolConnectRequest, error) {
+	var szBuf [4]byte
+	if _, err := io.ReadFull(rd, szBuf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, SyntaxError("early EOF")
+		}
+		return nil, err
+	}
+	sz, err := strconv.ParseUint(string(szBuf[:]), 16, 16)
+	if err != nil {
+		return nil, SyntaxError("cannot parse the packet size: " + string(szBuf[:]))
+	}
+	if sz < 5 {
+		return nil, SyntaxError(fmt.Sprintf("unexpected packet size: %d", sz))
+	}
+	bs := make([]byte, sz-4)
+	if _, err := io.ReadFull(rd, bs); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, SyntaxError("early EOF")
+		}
+		return nil, err
+	}
+	return ParseGitProtocolConnectRequest(bs)
+}
+
+// ParseGitProtocolConnectRequest parses the payload of a connect request
+// packet.
+func ParseGitProtocolConnectRequest(bs []byte) (*GitProtocolConnectRequest, error) {
+	// Old clients terminate the request with LF instead of NUL.
+	s := strings.TrimSuffix(string(bs), "\n")
+	ss := strings.SplitN(s, "\000", 2)
+	cmd := strings.SplitN(ss[0], " ", 2)
+	if len(cmd) != 2 || cmd[0] == "" || cmd[1] == "" {
+		return nil, SyntaxError("cannot parse the command: " + ss[0])
+	}
+	r := &GitProtocolConnectRequest{
+		Service:  cmd[0],
+		Pathname: cmd[1],
+	}
+	if len(ss) == 1 {
+		return r, nil
+	}
+
+	rest := ss[1]
+	if strings.HasPrefix(rest, "host=") {
+		i := strings.IndexByte(rest, 0)
+		if i == -1 {
+			return nil, SyntaxError("unterminated host parameter: " + rest)
+		}
+		host, port, err := parseGitProtocolHost(rest[len("host="):i])
+		if err != nil {
+			return nil, err
+		}
+		r.Host, r.Port = host, port
+		rest = rest[i+1:]
+	}
+	if rest == "" {
+		return r, nil
+	}
+	if rest[0] != 0 {
+		return nil, SyntaxError(fmt.Sprintf("unexpected parameter: %#q", rest))
+	}
+	rest = rest[1:]
+	for rest != "" {
+		i := strings.IndexByte(rest, 0)
+		if i == -1 {
+			return nil, SyntaxError("unterminated extra parameter: " + rest)
+		}
+		if i == 0 {
+			return nil, SyntaxError("empty extra parameter")
+		}
+		r.ExtraParameters = append(r.ExtraParameters, rest[:i])
+		rest = rest[i+1:]
+	}
+	return r, nil
+}
+
+func parseGitProtocolHost(s string) (string, string, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i == -1 {
+			return "", "", SyntaxError("cannot parse the host: " + s)
+		}
+		host = s[1:i]
+		if rest := s[i+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", "", SyntaxError("cannot parse the host: " + s)
+			}
+			port = rest[1:]
+		}
+	} else if i := strings.LastIndexByte(s, ':'); i != -1 {
+		host, port = s[:i], s[i+1:]
+	}
+	if host == "" {
+		return "", "", SyntaxError("empty host: " + s)
+	}
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", SyntaxError("cannot parse the port: " + port)
+		}
+	}
+	return host, port, nil
+}
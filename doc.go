@@ -1,2 +1,8 @@
 // Package gitprotocolio is a Git protocol parser written in Go.
+//
+// The scanners report the errors about the input as a *ParseError, which
+// records where the error happened. The underlying SyntaxError,
+// InvalidObjectIDError, InvalidRefNameError, or ObjectFormatError is retrieved
+// with errors.As. A type assertion like err.(SyntaxError) doesn't match the
+// errors of the scanners.
 package gitprotocolio
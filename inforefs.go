@@ -74,12 +74,17 @@ func (c *InfoRefsResponseChunk) EncodeToPktLine() []byte {
 }
 
 // InfoRefsResponse provides an interface for reading an /info/refs response.
-// The usage is same as bufio.Scanner.
+// Use NewBidiInfoRefsResponse to read the ref advertisement of the
+// bidi-transports. The usage is same as bufio.Scanner.
 type InfoRefsResponse struct {
 	scanner *PacketScanner
 	state   infoRefsResponseState
 	err     error
 	curr    *InfoRefsResponseChunk
+
+	capabilities Capabilities
+	objectFormat objectFormatValidator
+	strict       bool
 }
 
 // NewInfoRefsResponse returns a new InfoRefsResponse to read from rd.
@@ -87,6 +92,23 @@ func NewInfoRefsResponse(rd io.Reader) (r *InfoRefsResponse) {
 	return &InfoRefsResponse{scanner: NewPacketScanner(rd)}
 }
 
+// NewBidiInfoRefsResponse returns a new InfoRefsResponse to read the ref
+// advertisement of the bidi-transports (SSH and Git wire) from rd. Unlike the
+// /info/refs response, it doesn't have the service header.
+func NewBidiInfoRefsResponse(rd io.Reader) (r *InfoRefsResponse) {
+	return NewBidiInfoRefsResponseFromScanner(NewPacketScanner(rd))
+}
+
+// NewBidiInfoRefsResponseFromScanner is like NewBidiInfoRefsResponse, but reads
+// the packets from scanner. Since PacketScanner reads ahead, the scanner should
+// be passed to the scanner of the following response.
+func NewBidiInfoRefsResponseFromScanner(scanner *PacketScanner) (r *InfoRefsResponse) {
+	return &InfoRefsResponse{
+		scanner: scanner,
+		state:   infoRefsResponseStateScanOptionalProtocolVersion,
+	}
+}
+
 // Err returns the first non-EOF error that was encountered by the
 // InfoRefsResponse.
 func (r *InfoRefsResponse) Err() error {
@@ -98,11 +120,66 @@ func (r *InfoRefsResponse) Chunk() *InfoRefsResponseChunk {
 	return r.curr
 }
 
+// Capabilities returns the capabilities that the server advertised so far. In
+// protocol v0/v1, this is valid after the first ref is scanned. In protocol
+// v2, this accumulates the capability lines.
+func (r *InfoRefsResponse) Capabilities() Capabilities {
+	return r.capabilities
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names follow git-check-ref-format. A violation is reported as an
+// InvalidObjectIDError or an InvalidRefNameError. This must be called before
+// the first Scan.
+func (r *InfoRefsResponse) EnableStrictValidation() {
+	r.strict = true
+}
+
+// EnableObjectFormatValidation makes the scanner check the lengths of the
+// object IDs of the refs. The object format is negotiated with the "object-
+// format" capability of the first ref. A mismatch is reported as an
+// ObjectFormatError. This must be called before the first Scan.
+func (r *InfoRefsResponse) EnableObjectFormatValidation() {
+	r.objectFormat.enabled = true
+}
+
 // Scan advances the scanner to the next chunk. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After Scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *InfoRefsResponse) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "InfoRefsResponse", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "InfoRefsResponse", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *InfoRefsResponse) validateChunk(c *InfoRefsResponseChunk) error {
+	if r.strict {
+		if err := checkObjectIDs(c.ObjectID); err != nil {
+			return err
+		}
+		if refName := strings.TrimSuffix(c.Ref, "^{}"); c.Ref != "capabilities^{}" {
+			if err := checkRefNames(refName); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Ref != "" && c.Capabilities != nil {
+		if err := r.objectFormat.negotiate(r.capabilities); err != nil {
+			return err
+		}
+	}
+	return r.objectFormat.check(c.ObjectID)
+}
+
+func (r *InfoRefsResponse) scan() bool {
 	if r.err != nil || r.state == infoRefsResponseStateEnd {
 		return false
 	}
@@ -126,6 +203,7 @@ transition:
 		}
 		if !bytes.HasPrefix(bp, []byte("# service=")) {
 			r.err = SyntaxError(fmt.Sprintf("expect the service header, but got: %v", pkt))
+			return false
 		}
 		r.state = infoRefsResponseStateScanServiceHeaderFlush
 		r.curr = &InfoRefsResponseChunk{
@@ -157,7 +235,7 @@ transition:
 		if ver == 2 {
 			r.state = infoRefsResponseStateScanProtocolV2Capabilities
 		} else {
-			r.state = infoRefsResponseStateScanRefs
+			r.state = infoRefsResponseStateScanCapabilities
 		}
 		r.curr = &InfoRefsResponseChunk{
 			ProtocolVersion: ver,
@@ -177,17 +255,14 @@ transition:
 				r.err = SyntaxError("cannot split into two: " + string(p))
 				return false
 			}
-			caps := []string{}
-			if capStr := strings.TrimSuffix(string(zss[1]), "\n"); capStr != "" {
-				// This is to avoid strings.Split("", " ") => []string{""}.
-				caps = strings.Split(capStr, " ")
-			}
+			caps := ParseCapabilities(strings.TrimSuffix(string(zss[1]), "\n"))
 			ss := strings.SplitN(string(zss[0]), " ", 2)
 			if len(ss) != 2 {
 				r.err = SyntaxError("cannot split into two: " + string(zss[0]))
 				return false
 			}
 			r.state = infoRefsResponseStateScanRefs
+			r.capabilities = caps
 			r.curr = &InfoRefsResponseChunk{
 				Capabilities: caps,
 				ObjectID:     ss[0],
@@ -230,8 +305,10 @@ transition:
 			}
 			return true
 		case BytesPacket:
+			capability := strings.TrimSuffix(string(p), "\n")
+			r.capabilities = append(r.capabilities, capability)
 			r.curr = &InfoRefsResponseChunk{
-				Capabilities: []string{strings.TrimSuffix(string(p), "\n")},
+				Capabilities: []string{capability},
 			}
 			return true
 		default:
@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The contents of the objects are encoded by the types below, and can be
+// written with PackFileWriter. A blob has no structure, and its content is
+// written as is.
+
+// Tree entry modes.
+const (
+	TreeModeFile       = "100644"
+	TreeModeExecutable = "100755"
+	TreeModeSymlink    = "120000"
+	TreeModeTree       = "40000"
+	TreeModeGitlink    = "160000"
+)
+
+// TreeEntry is an entry of a tree object.
+type TreeEntry struct {
+	Mode     string
+	Name     string
+	ObjectID string
+}
+
+// TreeObject is the content of a tree object.
+type TreeObject struct {
+	Entries []*TreeEntry
+}
+
+// Encode returns the content of the tree object. The entries are sorted in the
+// git order, where a subtree is sorted as if its name ends with "/".
+func (t *TreeObject) Encode() ([]byte, error) {
+	entries := append([]*TreeEntry(nil), t.Entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return treeEntrySortKey(entries[i]) < treeEntrySortKey(entries[j])
+	})
+	var buf bytes.Buffer
+	for i, e := range entries {
+		if e.Mode == "" || e.Name == "" || strings.ContainsAny(e.Name, "/\x00") {
+			return nil, fmt.Errorf("invalid tree entry: %#v", e)
+		}
+		if i > 0 && entries[i-1].Name == e.Name {
+			return nil, fmt.Errorf("duplicate tree entry: %s", e.Name)
+		}
+		oid, err := hex.DecodeString(e.ObjectID)
+		if err != nil || (len(e.ObjectID) != ObjectIDLength(ObjectFormatSHA1) && len(e.ObjectID) != ObjectIDLength(ObjectFormatSHA256)) {
+			return nil, fmt.Errorf("invalid object ID of %s: %s", e.Name, e.ObjectID)
+		}
+		fmt.Fprintf(&buf, "%s %s\x00", e.Mode, e.Name)
+		buf.Write(oid)
+	}
+	return buf.Bytes(), nil
+}
+
+func treeEntrySortKey(e *TreeEntry) string {
+	if e.Mode == TreeModeTree {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// CommitObject is the content of a commit object. Author and Committer are
+// identities with timestamps, such as "A U Thor <author@example.com>
+// 1500000000 +0000".
+type CommitObject struct {
+	TreeObjectID    string
+	ParentObjectIDs []string
+	Author          string
+	Committer       string
+	Message         string
+}
+
+// Encode returns the content of the commit object.
+func (c *CommitObject) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", c.TreeObjectID)
+	for _, p := range c.ParentObjectIDs {
+		fmt.Fprintf(&buf, "parent %s\n", p)
+	}
+	fmt.Fprintf(&buf, "author %s\ncommitter %s\n\n%s", c.Author, c.Committer, c.Message)
+	return buf.Bytes()
+}
+
+// TagObject is the content of an annotated tag object. Tagger is an identity
+// with a timestamp like CommitObject.Author.
+type TagObject struct {
+	ObjectID   string
+	ObjectType ObjectType
+	Name       string
+	Tagger     string
+	Message    string
+}
+
+// Encode returns the content of the tag object.
+func (t *TagObject) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "object %s\ntype %s\ntag %s\n", t.ObjectID, t.ObjectType, t.Name)
+	if t.Tagger != "" {
+		fmt.Fprintf(&buf, "tagger %s\n", t.Tagger)
+	}
+	fmt.Fprintf(&buf, "\n%s", t.Message)
+	return buf.Bytes()
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+const (
+	// ObjectFormatSHA1 is the default object format. The object IDs are
+	// 40 hex characters.
+	ObjectFormatSHA1 = "sha1"
+	// ObjectFormatSHA256 is the object format of the SHA-256 repositories.
+	// The object IDs are 64 hex characters.
+	ObjectFormatSHA256 = "sha256"
+)
+
+// ObjectIDLength returns the length of the hex object IDs of the object
+// format. It returns 0 for an unknown format.
+func ObjectIDLength(objectFormat string) int {
+	switch objectFormat {
+	case ObjectFormatSHA1:
+		return 40
+	case ObjectFormatSHA256:
+		return 64
+	}
+	return 0
+}
+
+// newObjectFormatHash returns the hash function of the object format. It
+// returns nil for an unknown format.
+func newObjectFormatHash(objectFormat string) hash.Hash {
+	switch objectFormat {
+	case ObjectFormatSHA1:
+		return sha1.New()
+	case ObjectFormatSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// ObjectFormatError is an error returned in the object format validation mode
+// when the requested object format or the length of an object ID doesn't match
+// the object format.
+type ObjectFormatError struct {
+	// ObjectFormat is the expected object format. This is empty if the
+	// requested object format is unknown.
+	ObjectFormat string
+	// RequestedObjectFormat is the value of the "object-format" capability.
+	// This is empty if an object ID doesn't match.
+	RequestedObjectFormat string
+	// ObjectID is the object ID that doesn't match the object format.
+	ObjectID string
+}
+
+func (e *ObjectFormatError) Error() string {
+	switch {
+	case e.ObjectID != "":
+		return fmt.Sprintf("object ID length mismatch: %s needs %d characters, got %q", e.ObjectFormat, ObjectIDLength(e.ObjectFormat), e.ObjectID)
+	case e.ObjectFormat == "":
+		return "unknown object format: " + e.RequestedObjectFormat
+	}
+	return fmt.Sprintf("object format mismatch: %s is advertised, got %s", e.ObjectFormat, e.RequestedObjectFormat)
+}
+
+// objectFormatValidator checks the lengths of the object IDs against the
+// object format negotiated with the "object-format" capability.
+type objectFormatValidator struct {
+	enabled bool
+	// advertised is the object format that the server advertised. If
+	// empty, the object format that the client requests is used.
+	advertised string
+	// format is empty until the capabilities are negotiated.
+	format string
+	// pending are the object IDs that are scanned before the capabilities.
+	pending []string
+}
+
+// negotiate sets the object format from the capabilities. Without the
+// "object-format" capability, the object format is the advertised one, or
+// SHA-1.
+func (v *objectFormatValidator) negotiate(caps Capabilities) error {
+	if !v.enabled || v.format != "" {
+		return nil
+	}
+	format, ok := caps.Lookup("object-format")
+	switch {
+	case ok && v.advertised != "" && format != v.advertised:
+		return &ObjectFormatError{ObjectFormat: v.advertised, RequestedObjectFormat: format}
+	case !ok && v.advertised != "":
+		format = v.advertised
+	case !ok:
+		format = ObjectFormatSHA1
+	}
+	if ObjectIDLength(format) == 0 {
+		return &ObjectFormatError{RequestedObjectFormat: format}
+	}
+	v.format = format
+	pending := v.pending
+	v.pending = nil
+	return v.check(pending...)
+}
+
+// check checks the lengths of the object IDs. Empty strings are ignored. If
+// the object format is not negotiated yet, the object IDs are checked on the
+// negotiation.
+func (v *objectFormatValidator) check(oids ...string) error {
+	if !v.enabled {
+		return nil
+	}
+	for _, oid := range oids {
+		if oid == "" {
+			continue
+		}
+		if v.format == "" {
+			v.pending = append(v.pending, oid)
+			continue
+		}
+		if len(oid) != ObjectIDLength(v.format) {
+			return &ObjectFormatError{ObjectFormat: v.format, ObjectID: oid}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ObjectType is a type of an object in a pack file.
+type ObjectType int
+
+// Object types. ObjectOfsDelta and ObjectRefDelta appear only in pack files.
+const (
+	ObjectCommit   ObjectType = 1
+	ObjectTree     ObjectType = 2
+	ObjectBlob     ObjectType = 3
+	ObjectTag      ObjectType = 4
+	ObjectOfsDelta ObjectType = 6
+	ObjectRefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	case ObjectOfsDelta:
+		return "ofs-delta"
+	case ObjectRefDelta:
+		return "ref-delta"
+	}
+	return fmt.Sprintf("ObjectType(%d)", int(t))
+}
+
+// PackFileObject is an object entry in a pack file.
+type PackFileObject struct {
+	// Offset is the offset of the entry from the beginning of the pack
+	// file.
+	Offset int64
+	Type   ObjectType
+	// Size is the inflated size of the content. For delta entries, this is
+	// the size of the delta instruction, not the size of the resulting
+	// object.
+	Size uint64
+	// BaseOffset is the absolute offset of the base object of an
+	// ObjectOfsDelta entry.
+	BaseOffset int64
+	// BaseObjectID is the base object of an ObjectRefDelta entry.
+	BaseObjectID string
+	// Data is the inflated content to write with PackFileWriter.
+	// PackFileScanner does not set this. Read the content from
+	// PackFileScanner.Reader instead.
+	Data []byte
+}
+
+// PackFileScanner provides an interface for reading a pack file. The input is
+// the raw pack file, starting from "PACK". The concatenation of PackStream of
+// ProtocolV1ReceivePackRequestChunk or ProtocolV2FetchResponseChunk is such
+// input.
+//
+// The object content is not held in memory. It's streamed from Reader until the
+// next call to Scan. The trailing checksum is verified after the last object is
+// read. The object format decides the hash
+// function of the checksum and the length of the base object IDs.
+type PackFileScanner struct {
+	rd         *packFileReader
+	err        error
+	curr       *PackFileObject
+	version    uint32
+	numObjects uint32
+	scanned    uint32
+	verified   bool
+	zr         io.ReadCloser
+	data       *packFileObjectReader
+}
+
+// NewPackFileScanner returns a new PackFileScanner to read a pack file of the
+// object format from rd. If objectFormat is empty, it's ObjectFormatSHA1.
+func NewPackFileScanner(rd io.Reader, objectFormat string) *PackFileScanner {
+	if objectFormat == "" {
+		objectFormat = ObjectFormatSHA1
+	}
+	s := &PackFileScanner{}
+	h := newObjectFormatHash(objectFormat)
+	if h == nil {
+		s.err = SyntaxError("unknown object format: " + objectFormat)
+		return s
+	}
+	s.rd = &packFileReader{r: bufio.NewReader(rd), h: h}
+	return s
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// PackFileScanner.
+func (s *PackFileScanner) Err() error {
+	return s.err
+}
+
+// Object returns the most recent object generated by a call to Scan.
+func (s *PackFileScanner) Object() *PackFileObject {
+	return s.curr
+}
+
+// Reader returns a reader of the inflated content of the most recent object
+// generated by a call to Scan. The reader is valid until the next call to Scan,
+// which discards the unread content. A content that doesn't match the size in
+// the object header is an error of both the reader and the scanner.
+func (s *PackFileScanner) Reader() io.Reader {
+	if s.data == nil {
+		return nil
+	}
+	return s.data
+}
+
+// Version returns the pack file version. This is valid after the first call to
+// Scan.
+func (s *PackFileScanner) Version() uint32 {
+	return s.version
+}
+
+// NumObjects returns the number of the objects in the pack file. This is valid
+// after the first call to Scan.
+func (s *PackFileScanner) NumObjects() uint32 {
+	return s.numObjects
+}
+
+// Scan advances the scanner to the next object. It returns false when the scan
+// stops, either by reaching the end of the pack file or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning.
+func (s *PackFileScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.data != nil {
+		if _, s.err = io.Copy(io.Discard, s.data); s.err != nil {
+			return false
+		}
+		s.data = nil
+	}
+	if s.version == 0 {
+		if s.err = s.readHeader(); s.err != nil {
+			return false
+		}
+	}
+	if s.scanned == s.numObjects {
+		if !s.verified {
+			s.verified = true
+			s.err = s.verifyChecksum()
+		}
+		return false
+	}
+	s.curr, s.data, s.err = s.readObject()
+	if s.err != nil {
+		return false
+	}
+	s.scanned++
+	return true
+}
+
+func (s *PackFileScanner) readHeader() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(s.rd, hdr[:]); err != nil {
+		return packFileReadError(err)
+	}
+	if !bytes.Equal(hdr[:4], []byte("PACK")) {
+		return SyntaxError(fmt.Sprintf("not a pack file: %#q", string(hdr[:4])))
+	}
+	version := binary.BigEndian.Uint32(hdr[4:8])
+	if version != 2 && version != 3 {
+		return SyntaxError(fmt.Sprintf("unsupported pack file version: %d", version))
+	}
+	s.version = version
+	s.numObjects = binary.BigEndian.Uint32(hdr[8:12])
+	return nil
+}
+
+func (s *PackFileScanner) readObject() (*PackFileObject, *packFileObjectReader, error) {
+	obj := &PackFileObject{Offset: s.rd.n}
+	c, err := s.rd.ReadByte()
+	if err != nil {
+		return nil, nil, packFileReadError(err)
+	}
+	obj.Type = ObjectType((c >> 4) & 7)
+	obj.Size = uint64(c & 0x0F)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 64-7 {
+			return nil, nil, SyntaxError("object size overflow")
+		}
+		if c, err = s.rd.ReadByte(); err != nil {
+			return nil, nil, packFileReadError(err)
+		}
+		obj.Size |= uint64(c&0x7F) << shift
+	}
+
+	switch obj.Type {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case ObjectOfsDelta:
+		c, err := s.rd.ReadByte()
+		if err != nil {
+			return nil, nil, packFileReadError(err)
+		}
+		ofs := int64(c & 0x7F)
+		for c&0x80 != 0 {
+			if ofs > (1<<(63-7))-1 {
+				return nil, nil, SyntaxError("delta base offset overflow")
+			}
+			if c, err = s.rd.ReadByte(); err != nil {
+				return nil, nil, packFileReadError(err)
+			}
+			ofs = ((ofs + 1) << 7) | int64(c&0x7F)
+		}
+		if ofs <= 0 || ofs > obj.Offset {
+			return nil, nil, SyntaxError(fmt.Sprintf("delta base offset out of range: %d", ofs))
+		}
+		obj.BaseOffset = obj.Offset - ofs
+	case ObjectRefDelta:
+		oid := make([]byte, s.rd.h.Size())
+		if _, err := io.ReadFull(s.rd, oid); err != nil {
+			return nil, nil, packFileReadError(err)
+		}
+		obj.BaseObjectID = hex.EncodeToString(oid)
+	default:
+		return nil, nil, SyntaxError(fmt.Sprintf("unknown object type: %d", int(obj.Type)))
+	}
+
+	if s.zr == nil {
+		if s.zr, err = zlib.NewReader(s.rd); err != nil {
+			return nil, nil, packFileReadError(err)
+		}
+	} else if err := s.zr.(zlib.Resetter).Reset(s.rd, nil); err != nil {
+		return nil, nil, packFileReadError(err)
+	}
+	return obj, &packFileObjectReader{zr: s.zr, obj: obj, remaining: obj.Size}, nil
+}
+
+func (s *PackFileScanner) verifyChecksum() error {
+	want := s.rd.h.Sum(nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s.rd.r, got); err != nil {
+		return packFileReadError(err)
+	}
+	if !bytes.Equal(want, got) {
+		return SyntaxError(fmt.Sprintf("pack checksum mismatch: want %x, got %x", want, got))
+	}
+	return nil
+}
+
+func packFileReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return SyntaxError("early EOF")
+	}
+	return err
+}
+
+// packFileObjectReader reads the inflated content of an object. The size in the
+// object header is not trusted. The reader fails as soon as the content
+// exceeds it.
+type packFileObjectReader struct {
+	zr        io.Reader
+	obj       *PackFileObject
+	remaining uint64
+	err       error
+}
+
+func (r *packFileObjectReader) Read(bs []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining == 0 {
+		r.err = r.readEnd()
+		return 0, r.err
+	}
+	if uint64(len(bs)) > r.remaining {
+		bs = bs[:r.remaining]
+	}
+	n, err := r.zr.Read(bs)
+	r.remaining -= uint64(n)
+	if err == io.EOF && r.remaining != 0 {
+		r.err = SyntaxError(fmt.Sprintf("object size mismatch at offset %d: want %d, got %d", r.obj.Offset, r.obj.Size, r.obj.Size-r.remaining))
+		return n, r.err
+	}
+	if err != nil && err != io.EOF {
+		r.err = packFileReadError(err)
+		return n, r.err
+	}
+	return n, nil
+}
+
+// readEnd consumes the rest of the zlib stream including the checksum.
+func (r *packFileObjectReader) readEnd() error {
+	var b [1]byte
+	for {
+		n, err := r.zr.Read(b[:])
+		if n != 0 {
+			return SyntaxError(fmt.Sprintf("object size mismatch at offset %d: want %d, got more", r.obj.Offset, r.obj.Size))
+		}
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return packFileReadError(err)
+		}
+	}
+}
+
+// packFileReader counts and hashes the bytes read. It implements
+// io.ByteReader so that the zlib reader does not read ahead.
+type packFileReader struct {
+	r *bufio.Reader
+	h hash.Hash
+	n int64
+}
+
+func (p *packFileReader) Read(bs []byte) (int, error) {
+	n, err := p.r.Read(bs)
+	p.h.Write(bs[:n])
+	p.n += int64(n)
+	return n, err
+}
+
+func (p *packFileReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	p.h.Write([]byte{c})
+	p.n++
+	return c, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// HashObject returns the object ID of the object with the content in the object
+// format. If objectFormat is empty, it's ObjectFormatSHA1. It returns an empty
+// string for an unknown format.
+func HashObject(t ObjectType, data []byte, objectFormat string) string {
+	if objectFormat == "" {
+		objectFormat = ObjectFormatSHA1
+	}
+	h := newObjectFormatHash(objectFormat)
+	if h == nil {
+		return ""
+	}
+	fmt.Fprintf(h, "%s %d\x00", t, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PackFileWriter writes a version 2 pack file. The output can be used as
+// PackStream of ProtocolV1ReceivePackRequestChunk, or be split into
+// SideBandMainPackets.
+type PackFileWriter struct {
+	w          *packFileHashWriter
+	numObjects uint32
+	written    uint32
+	zw         *zlib.Writer
+	closed     bool
+}
+
+// NewPackFileWriter returns a new PackFileWriter that writes numObjects
+// objects of the object format to w. If objectFormat is empty, it's
+// ObjectFormatSHA1. The pack header is written immediately.
+func NewPackFileWriter(w io.Writer, numObjects uint32, objectFormat string) (*PackFileWriter, error) {
+	if objectFormat == "" {
+		objectFormat = ObjectFormatSHA1
+	}
+	h := newObjectFormatHash(objectFormat)
+	if h == nil {
+		return nil, fmt.Errorf("unknown object format: %s", objectFormat)
+	}
+	pw := &PackFileWriter{w: &packFileHashWriter{w: w, h: h}, numObjects: numObjects}
+	hdr := make([]byte, 12)
+	copy(hdr, "PACK")
+	binary.BigEndian.PutUint32(hdr[4:8], 2)
+	binary.BigEndian.PutUint32(hdr[8:12], numObjects)
+	if _, err := pw.w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WriteObject writes an object entry and returns its offset. The offset can be
+// used as BaseOffset of a subsequent ObjectOfsDelta entry. Offset and Size of
+// obj are ignored.
+func (pw *PackFileWriter) WriteObject(obj *PackFileObject) (int64, error) {
+	if pw.closed {
+		return 0, errors.New("already closed")
+	}
+	if pw.written == pw.numObjects {
+		return 0, fmt.Errorf("too many objects: %d", pw.numObjects)
+	}
+	offset := pw.w.n
+
+	sz := uint64(len(obj.Data))
+	hdr := []byte{byte(obj.Type)<<4 | byte(sz&0x0F)}
+	for sz >>= 4; sz != 0; sz >>= 7 {
+		hdr[len(hdr)-1] |= 0x80
+		hdr = append(hdr, byte(sz&0x7F))
+	}
+	switch obj.Type {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case ObjectOfsDelta:
+		if obj.BaseOffset < 0 || obj.BaseOffset >= offset {
+			return 0, fmt.Errorf("delta base offset out of range: %d", obj.BaseOffset)
+		}
+		ofs := offset - obj.BaseOffset
+		bs := []byte{byte(ofs & 0x7F)}
+		for ofs >>= 7; ofs != 0; ofs >>= 7 {
+			ofs--
+			bs = append([]byte{0x80 | byte(ofs&0x7F)}, bs...)
+		}
+		hdr = append(hdr, bs...)
+	case ObjectRefDelta:
+		oid, err := hex.DecodeString(obj.BaseObjectID)
+		if err != nil || len(oid) != pw.w.h.Size() {
+			return 0, fmt.Errorf("invalid base object ID: %s", obj.BaseObjectID)
+		}
+		hdr = append(hdr, oid...)
+	default:
+		return 0, fmt.Errorf("unknown object type: %d", int(obj.Type))
+	}
+	if _, err := pw.w.Write(hdr); err != nil {
+		return 0, err
+	}
+
+	if pw.zw == nil {
+		pw.zw = zlib.NewWriter(pw.w)
+	} else {
+		pw.zw.Reset(pw.w)
+	}
+	if _, err := pw.zw.Write(obj.Data); err != nil {
+		return 0, err
+	}
+	if err := pw.zw.Close(); err != nil {
+		return 0, err
+	}
+	pw.written++
+	return offset, nil
+}
+
+// Close writes the trailing checksum. It returns an error if the number of the
+// written objects doesn't match with the one in the header. It does not close
+// the underlying writer.
+func (pw *PackFileWriter) Close() error {
+	if pw.closed {
+		return errors.New("already closed")
+	}
+	pw.closed = true
+	if pw.written != pw.numObjects {
+		return fmt.Errorf("object count mismatch: want %d, got %d", pw.numObjects, pw.written)
+	}
+	_, err := pw.w.w.Write(pw.w.h.Sum(nil))
+	return err
+}
+
+// packFileHashWriter counts and hashes the bytes written.
+type packFileHashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (p *packFileHashWriter) Write(bs []byte) (int, error) {
+	n, err := p.w.Write(bs)
+	p.h.Write(bs[:n])
+	p.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// "Receiving objects:  45% (9/20), 1.00 MiB | 2.00 MiB/s, done."
+	// "Enumerating objects: 20, done."
+	// "Resolving deltas: 100% (3/3), completed with 2 local objects."
+	//
+	// The whole line must match so that a message like "error: 1 commit
+	// rejected" is not taken as a meter.
+	progressRegexp = regexp.MustCompile(`^([^:]+):\s+(?:(\d+)% \((\d+)/(\d+)\)|(\d+))(?:, ([\d.]+ [^ |,]+) \| ([\d.]+ [^ ,]+/s))?(, done\.|, completed with \d+ local objects?\.)?$`)
+	// "Total 20 (delta 3), reused 0 (delta 0), pack-reused 0"
+	// "Total 20 (delta 3), reused 5 (delta 1), pack-reused 12 (from 2)"
+	packSummaryRegexp = regexp.MustCompile(`^Total (\d+) \(delta (\d+)\)(?:, reused (\d+) \(delta (\d+)\))?(?:, pack-reused (\d+)(?: \(from (\d+)\))?)?$`)
+)
+
+// ProgressMessage is a line of the progress messages sent with
+// SideBandReportPacket.
+type ProgressMessage struct {
+	// Text is the line without the "remote: " prefix, the line terminator,
+	// and the trailing spaces.
+	Text string
+	// Remote is true if the line has the "remote: " prefix, which git adds
+	// to the messages relayed from a server.
+	Remote bool
+	// Transient is true if the line is terminated by "\r". The next line
+	// overwrites it.
+	Transient bool
+	// Progress is the parsed progress meter. It's nil if the line is not a
+	// progress meter, like a message from a hook.
+	Progress *Progress
+	// PackSummary is the parsed "Total" line. It's nil if the line is not
+	// the summary.
+	PackSummary *PackSummary
+}
+
+// Progress is a progress meter like "Counting objects:  45% (9/20)".
+type Progress struct {
+	// Phase is the title of the meter, like "Counting objects".
+	Phase string
+	// Percent and Total are zero if the total is unknown.
+	Percent int
+	Current uint64
+	Total   uint64
+	// Transferred and Rate are the throughput, like "1.00 MiB" and
+	// "2.00 MiB/s". They're empty if the meter doesn't show the
+	// throughput.
+	Transferred string
+	Rate        string
+	// Done is true if the phase is completed, which git shows with
+	// ", done." or ", completed with N local objects.".
+	Done bool
+}
+
+// PackSummary is the summary of the pack file sent, like "Total 20 (delta 3),
+// reused 0 (delta 0), pack-reused 0".
+type PackSummary struct {
+	Objects      uint64
+	Deltas       uint64
+	Reused       uint64
+	ReusedDeltas uint64
+	PackReused   uint64
+	// PackReusedFrom is the number of the packs that the objects are
+	// reused from. It's zero if git doesn't show it.
+	PackReusedFrom uint64
+}
+
+// ParseProgressMessage parses a line of the progress messages. The line can
+// have the "remote: " prefix and the line terminator.
+func ParseProgressMessage(line string) *ProgressMessage {
+	m := &ProgressMessage{}
+	switch {
+	case strings.HasSuffix(line, "\r"):
+		m.Transient = true
+		line = strings.TrimSuffix(line, "\r")
+	case strings.HasSuffix(line, "\n"):
+		line = strings.TrimSuffix(line, "\n")
+	}
+	if strings.HasPrefix(line, "remote: ") {
+		m.Remote = true
+		line = strings.TrimPrefix(line, "remote: ")
+	}
+	// Git pads a progress meter with spaces to clear the previous one.
+	m.Text = strings.TrimRight(line, " ")
+
+	if ss := progressRegexp.FindStringSubmatch(m.Text); ss != nil {
+		p := &Progress{
+			Phase:       ss[1],
+			Transferred: ss[6],
+			Rate:        ss[7],
+			Done:        ss[8] != "",
+		}
+		if ss[2] != "" {
+			p.Percent, _ = strconv.Atoi(ss[2])
+			p.Current = parseUint(ss[3])
+			p.Total = parseUint(ss[4])
+		} else {
+			p.Current = parseUint(ss[5])
+		}
+		m.Progress = p
+	} else if ss := packSummaryRegexp.FindStringSubmatch(m.Text); ss != nil {
+		m.PackSummary = &PackSummary{
+			Objects:        parseUint(ss[1]),
+			Deltas:         parseUint(ss[2]),
+			Reused:         parseUint(ss[3]),
+			ReusedDeltas:   parseUint(ss[4]),
+			PackReused:     parseUint(ss[5]),
+			PackReusedFrom: parseUint(ss[6]),
+		}
+	}
+	return m
+}
+
+// parseUint parses a number matched by the regexps. An empty string is zero.
+func parseUint(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+// ProgressParser splits the progress messages into lines and parses them. The
+// messages can be written in any size of chunks, like the payloads of the
+// sideband packets, and a line can span multiple chunks.
+type ProgressParser struct {
+	callback func(*ProgressMessage)
+	buf      []byte
+}
+
+// NewProgressParser returns a ProgressParser that calls the callback for each
+// line terminated by "\r" or "\n". Empty lines are skipped.
+func NewProgressParser(callback func(*ProgressMessage)) *ProgressParser {
+	return &ProgressParser{callback: callback}
+}
+
+// Write implements io.Writer. It never returns an error. A ProgressParser can
+// be used as the Progress writer of the client package.
+func (p *ProgressParser) Write(bs []byte) (int, error) {
+	p.buf = append(p.buf, bs...)
+	for {
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i == -1 {
+			break
+		}
+		p.emit(string(p.buf[:i+1]))
+		p.buf = p.buf[i+1:]
+	}
+	return len(bs), nil
+}
+
+// Flush parses the unterminated line written so far. Call it at the end of the
+// stream.
+func (p *ProgressParser) Flush() {
+	if len(p.buf) != 0 {
+		p.emit(string(p.buf))
+		p.buf = nil
+	}
+}
+
+func (p *ProgressParser) emit(line string) {
+	m := ParseProgressMessage(line)
+	if m.Text == "" {
+		return
+	}
+	p.callback(m)
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushcert
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+// GenerateNonce returns a nonce in the same way as git-receive-pack with
+// receive.certNonceSeed. The nonce is "<timestamp>-<HMAC>", where git keys the
+// HMAC of the seed with "<path>:<timestamp>". The path is the repository path
+// that git-receive-pack is invoked with, which is "." under git-http-backend.
+// objectFormat selects the hash function, and an empty string means SHA-1.
+func GenerateNonce(seed, path string, t time.Time, objectFormat string) string {
+	stamp := t.Unix()
+	return fmt.Sprintf("%d-%s", stamp, nonceHMAC(seed, path, stamp, objectFormat))
+}
+
+// CheckNonce checks that the nonce is generated by GenerateNonce with the seed
+// and the path, and returns its timestamp. The object format is inferred from
+// the length of the HMAC.
+func CheckNonce(seed, path, nonce string) (time.Time, error) {
+	i := strings.IndexByte(nonce, '-')
+	if i == -1 {
+		return time.Time{}, fmt.Errorf("malformed nonce: %q", nonce)
+	}
+	stamp, err := strconv.ParseInt(nonce[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed nonce: %q", nonce)
+	}
+	var objectFormat string
+	switch len(nonce) - i - 1 {
+	case gitprotocolio.ObjectIDLength(gitprotocolio.ObjectFormatSHA1):
+		objectFormat = gitprotocolio.ObjectFormatSHA1
+	case gitprotocolio.ObjectIDLength(gitprotocolio.ObjectFormatSHA256):
+		objectFormat = gitprotocolio.ObjectFormatSHA256
+	default:
+		return time.Time{}, fmt.Errorf("malformed nonce: %q", nonce)
+	}
+	if !hmac.Equal([]byte(nonce[i+1:]), []byte(nonceHMAC(seed, path, stamp, objectFormat))) {
+		return time.Time{}, errors.New("the nonce is not issued for this repository")
+	}
+	return time.Unix(stamp, 0), nil
+}
+
+func nonceHMAC(seed, path string, stamp int64, objectFormat string) string {
+	h := sha1.New
+	if objectFormat == gitprotocolio.ObjectFormatSHA256 {
+		h = sha256.New
+	}
+	mac := hmac.New(h, []byte(fmt.Sprintf("%s:%d", path, stamp)))
+	mac.Write([]byte(seed))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NonceStatus is the result of checking the nonce of a push certificate. The
+// string forms are the values of GIT_PUSH_CERT_NONCE_STATUS.
+type NonceStatus int
+
+const (
+	// NonceUnsolicited means that the client sent a nonce that was not
+	// asked for.
+	NonceUnsolicited NonceStatus = iota
+	// NonceMissing means that the certificate doesn't have a nonce.
+	NonceMissing
+	// NonceBad means that the nonce was not issued by the server.
+	NonceBad
+	// NonceOK means that the nonce was issued by the server, and is not
+	// stale.
+	NonceOK
+	// NonceSlop means that the nonce was issued by the server, but its
+	// timestamp is out of the slop window.
+	NonceSlop
+)
+
+func (s NonceStatus) String() string {
+	switch s {
+	case NonceUnsolicited:
+		return "UNSOLICITED"
+	case NonceMissing:
+		return "MISSING"
+	case NonceBad:
+		return "BAD"
+	case NonceOK:
+		return "OK"
+	case NonceSlop:
+		return "SLOP"
+	}
+	return fmt.Sprintf("NonceStatus(%d)", int(s))
+}
+
+// NonceIssuer issues and checks nonces without keeping a state, like
+// git-receive-pack in the stateless RPC mode. A nonce is issued with the ref
+// advertisement, and the push can be sent to another server that shares the
+// seed.
+type NonceIssuer struct {
+	// Seed is the HMAC seed like receive.certNonceSeed. If empty, no nonce
+	// is issued.
+	Seed string
+	// SlopLimit is the slop window like receive.certNonceSlop. A nonce
+	// issued within SlopLimit is NonceOK, and an older one is NonceSlop.
+	// If zero, only a nonce issued in the same second is NonceOK.
+	SlopLimit time.Duration
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+func (n *NonceIssuer) now() time.Time {
+	if n.Now != nil {
+		return n.Now()
+	}
+	return time.Now()
+}
+
+// Issue returns a nonce for the repository path. It returns an empty string
+// if the seed is not set.
+func (n *NonceIssuer) Issue(path string) string {
+	if n.Seed == "" {
+		return ""
+	}
+	return GenerateNonce(n.Seed, path, n.now(), "")
+}
+
+// Check checks the nonce of a push to the repository path. It also returns the
+// slop, how long ago the nonce was issued. The slop is negative if the nonce
+// was issued by a server whose clock is ahead.
+func (n *NonceIssuer) Check(path, nonce string) (NonceStatus, time.Duration) {
+	if nonce == "" {
+		return NonceMissing, 0
+	}
+	if n.Seed == "" {
+		return NonceUnsolicited, 0
+	}
+	stamp, err := CheckNonce(n.Seed, path, nonce)
+	if err != nil {
+		return NonceBad, 0
+	}
+	// Git compares the timestamps in seconds.
+	slop := time.Duration(n.now().Unix()-stamp.Unix()) * time.Second
+	if slop == 0 {
+		return NonceOK, 0
+	}
+	limit := n.SlopLimit.Truncate(time.Second)
+	if limit != 0 && -limit <= slop && slop <= limit {
+		return NonceOK, slop
+	}
+	return NonceSlop, slop
+}
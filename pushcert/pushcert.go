@@ -0,0 +1,227 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushcert verifies and generates the push certificates of signed
+// pushes.
+//
+// A signed push sends the ref updates in a push certificate instead of the
+// plain commands. ProtocolV1ReceivePackRequest splits the certificate into
+// chunks, and FromChunks reassembles them into a Certificate.
+//
+// The package doesn't implement OpenPGP. The signatures are made and checked by
+// a Signer and a Verifier, which can be backed by gpg or an OpenPGP library.
+package pushcert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+const certificateVersion = "certificate version 0.1"
+
+// Command is a ref update in a push certificate.
+type Command struct {
+	OldObjectID string
+	NewObjectID string
+	RefName     string
+}
+
+func (c *Command) String() string {
+	return fmt.Sprintf("%s %s %s", c.OldObjectID, c.NewObjectID, c.RefName)
+}
+
+// Signer makes the signatures of the push certificates.
+type Signer interface {
+	// SignDetached returns the ASCII-armored detached OpenPGP signature of
+	// payload.
+	SignDetached(payload []byte) ([]byte, error)
+}
+
+// Verifier checks the signatures of the push certificates.
+type Verifier interface {
+	// VerifyDetached checks the ASCII-armored detached OpenPGP signature
+	// of payload, and returns the identity of the signer.
+	VerifyDetached(payload, signature []byte) (string, error)
+}
+
+// Certificate is a push certificate.
+type Certificate struct {
+	// Pusher is the identity of the signer followed by the timestamp, like
+	// "A U Thor <author@example.com> 1500000000 +0000".
+	Pusher string
+	// Pushee is the URL that the client pushes to. This is optional.
+	Pushee      string
+	Nonce       string
+	PushOptions []string
+	Commands    []*Command
+	// Signature is the ASCII-armored detached OpenPGP signature of the
+	// payload.
+	Signature []byte
+}
+
+// FromChunks reassembles a push certificate from the chunks of a
+// ProtocolV1ReceivePackRequest. The chunks outside of the certificate are
+// ignored.
+func FromChunks(chunks []*gitprotocolio.ProtocolV1ReceivePackRequestChunk) (*Certificate, error) {
+	var c *Certificate
+	for _, chunk := range chunks {
+		if c == nil {
+			if chunk.StartOfPushCert {
+				c = &Certificate{}
+			}
+			continue
+		}
+		switch {
+		case chunk.PushCertHeader:
+		case chunk.Pusher != "":
+			c.Pusher = chunk.Pusher
+		case chunk.Pushee != "":
+			c.Pushee = chunk.Pushee
+		case chunk.Nonce != "":
+			c.Nonce = chunk.Nonce
+		case chunk.CertPushOption != "":
+			c.PushOptions = append(c.PushOptions, chunk.CertPushOption)
+		case chunk.EndOfCertPushOptions:
+		case chunk.OldObjectID != "" && chunk.NewObjectID != "" && chunk.RefName != "":
+			c.Commands = append(c.Commands, &Command{
+				OldObjectID: chunk.OldObjectID,
+				NewObjectID: chunk.NewObjectID,
+				RefName:     chunk.RefName,
+			})
+		case len(chunk.GPGSignaturePart) != 0:
+			c.Signature = append(c.Signature, chunk.GPGSignaturePart...)
+		case chunk.EndOfPushCert:
+			if c.Pusher == "" || c.Nonce == "" {
+				return nil, errors.New("the push certificate doesn't have the pusher or the nonce")
+			}
+			return c, nil
+		default:
+			return nil, fmt.Errorf("unexpected chunk in the push certificate: %#v", chunk)
+		}
+	}
+	if c == nil {
+		return nil, errors.New("no push certificate")
+	}
+	return nil, errors.New("unterminated push certificate")
+}
+
+// Payload returns the signed part of the certificate in the canonical form.
+func (c *Certificate) Payload() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(certificateVersion + "\n")
+	fmt.Fprintf(&buf, "pusher %s\n", c.Pusher)
+	if c.Pushee != "" {
+		fmt.Fprintf(&buf, "pushee %s\n", c.Pushee)
+	}
+	fmt.Fprintf(&buf, "nonce %s\n", c.Nonce)
+	for _, o := range c.PushOptions {
+		fmt.Fprintf(&buf, "push-option %s\n", o)
+	}
+	buf.WriteString("\n")
+	for _, cmd := range c.Commands {
+		buf.WriteString(cmd.String() + "\n")
+	}
+	return buf.Bytes()
+}
+
+// String returns the certificate text including the signature. This is what
+// git-receive-pack passes to the hooks as GIT_PUSH_CERT.
+func (c *Certificate) String() string {
+	return string(c.Payload()) + string(c.Signature)
+}
+
+// Verify checks the signature with the verifier, and returns the identity of
+// the signer.
+func (c *Certificate) Verify(v Verifier) (string, error) {
+	if len(c.Signature) == 0 {
+		return "", errors.New("the push certificate is not signed")
+	}
+	return v.VerifyDetached(c.Payload(), c.Signature)
+}
+
+// CheckCommands checks that the certificate signs exactly the commands. The
+// order doesn't matter.
+func (c *Certificate) CheckCommands(commands []*Command) error {
+	signed := map[string]int{}
+	for _, cmd := range c.Commands {
+		signed[cmd.String()]++
+	}
+	for _, cmd := range commands {
+		s := cmd.String()
+		if signed[s] == 0 {
+			return fmt.Errorf("the command is not in the push certificate: %s", s)
+		}
+		signed[s]--
+	}
+	for _, cmd := range c.Commands {
+		if signed[cmd.String()] != 0 {
+			return fmt.Errorf("the command in the push certificate is not requested: %s", cmd)
+		}
+	}
+	return nil
+}
+
+// Sign signs the certificate with the signer and sets the signature.
+func (c *Certificate) Sign(s Signer) error {
+	sig, err := s.SignDetached(c.Payload())
+	if err != nil {
+		return err
+	}
+	if len(sig) == 0 {
+		return errors.New("the signer returns an empty signature")
+	}
+	// The signature lines are sent as the packets, so that the last one
+	// needs LF too.
+	if sig[len(sig)-1] != '\n' {
+		sig = append(sig, '\n')
+	}
+	c.Signature = sig
+	return nil
+}
+
+// Chunks returns the chunks of a ProtocolV1ReceivePackRequest that send the
+// certificate with the capabilities. The request continues with the push
+// options or the pack file.
+func (c *Certificate) Chunks(capabilities []string) []*gitprotocolio.ProtocolV1ReceivePackRequestChunk {
+	chunks := []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{StartOfPushCert: true, Capabilities: capabilities},
+		{PushCertHeader: true},
+		{Pusher: c.Pusher},
+	}
+	if c.Pushee != "" {
+		chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{Pushee: c.Pushee})
+	}
+	chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{Nonce: c.Nonce})
+	for _, o := range c.PushOptions {
+		chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{CertPushOption: o})
+	}
+	chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCertPushOptions: true})
+	for _, cmd := range c.Commands {
+		chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID: cmd.OldObjectID,
+			NewObjectID: cmd.NewObjectID,
+			RefName:     cmd.RefName,
+		})
+	}
+	for _, line := range strings.SplitAfter(string(c.Signature), "\n") {
+		if line != "" {
+			chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{GPGSignaturePart: []byte(line)})
+		}
+	}
+	return append(chunks, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfPushCert: true})
+}
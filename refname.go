@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvalidObjectIDError is an error returned in the strict validation mode when
+// an object ID is not a lowercase hex string of a known object format.
+type InvalidObjectIDError struct {
+	ObjectID string
+}
+
+func (e *InvalidObjectIDError) Error() string {
+	return fmt.Sprintf("invalid object ID: %q", e.ObjectID)
+}
+
+// InvalidRefNameError is an error returned in the strict validation mode when
+// a ref name violates the rules of git-check-ref-format.
+type InvalidRefNameError struct {
+	RefName string
+	// Reason is the rule that the ref name violates.
+	Reason string
+}
+
+func (e *InvalidRefNameError) Error() string {
+	return fmt.Sprintf("invalid ref name %q: %s", e.RefName, e.Reason)
+}
+
+// CheckObjectID returns an InvalidObjectIDError if oid is not a lowercase hex
+// object ID of SHA-1 or SHA-256.
+func CheckObjectID(oid string) error {
+	if len(oid) != ObjectIDLength(ObjectFormatSHA1) && len(oid) != ObjectIDLength(ObjectFormatSHA256) {
+		return &InvalidObjectIDError{oid}
+	}
+	for i := 0; i < len(oid); i++ {
+		if c := oid[i]; !('0' <= c && c <= '9') && !('a' <= c && c <= 'f') {
+			return &InvalidObjectIDError{oid}
+		}
+	}
+	return nil
+}
+
+// CheckRefName returns an InvalidRefNameError if refName violates the rules of
+// git-check-ref-format. One-level ref names like "HEAD" are allowed, as they
+// appear in the ref advertisement.
+func CheckRefName(refName string) error {
+	if reason := refNameViolation(refName); reason != "" {
+		return &InvalidRefNameError{refName, reason}
+	}
+	return nil
+}
+
+func refNameViolation(refName string) string {
+	switch {
+	case refName == "":
+		return "empty"
+	case refName == "@":
+		return `cannot be "@"`
+	case strings.HasPrefix(refName, "/") || strings.HasSuffix(refName, "/"):
+		return `cannot begin or end with "/"`
+	case strings.HasSuffix(refName, "."):
+		return `cannot end with "."`
+	case strings.Contains(refName, "//"):
+		return `cannot contain "//"`
+	case strings.Contains(refName, ".."):
+		return `cannot contain ".."`
+	case strings.Contains(refName, "@{"):
+		return `cannot contain "@{"`
+	}
+	for i := 0; i < len(refName); i++ {
+		c := refName[i]
+		if c < 0x20 || c == 0x7f {
+			return "cannot contain a control character"
+		}
+		if strings.IndexByte(" ~^:?*[\\", c) != -1 {
+			return fmt.Sprintf("cannot contain %q", c)
+		}
+	}
+	for _, component := range strings.Split(refName, "/") {
+		if strings.HasPrefix(component, ".") {
+			return `a component cannot begin with "."`
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return `a component cannot end with ".lock"`
+		}
+	}
+	return ""
+}
+
+// checkObjectIDs returns the error of the first invalid object ID. Empty
+// strings are ignored.
+func checkObjectIDs(oids ...string) error {
+	for _, oid := range oids {
+		if oid == "" {
+			continue
+		}
+		if err := CheckObjectID(oid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRefNames returns the error of the first invalid ref name. Empty strings
+// are ignored.
+func checkRefNames(refNames ...string) error {
+	for _, refName := range refNames {
+		if refName == "" {
+			continue
+		}
+		if err := CheckRefName(refName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
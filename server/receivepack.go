@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/gitprotocolio"
+)
+
+func (s *httpServer) receivePackHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, "cannot ungzip", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var caps gitprotocolio.Capabilities
+	var updates []*RefUpdate
+	req := gitprotocolio.NewProtocolV1ReceivePackRequest(body)
+	req.EnableStrictValidation()
+	req.EnableObjectFormatValidation(gitprotocolio.ObjectFormatSHA1)
+	for req.Scan() {
+		c := req.Chunk()
+		if c.OldObjectID != "" && c.NewObjectID != "" && c.RefName != "" {
+			if len(updates) == 0 {
+				caps = c.Capabilities
+			}
+			updates = append(updates, &RefUpdate{
+				RefName:     c.RefName,
+				OldObjectID: c.OldObjectID,
+				NewObjectID: c.NewObjectID,
+			})
+		}
+		if c.EndOfCommands {
+			break
+		}
+	}
+	if err := req.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	unpackErr := s.unpackObjects(r, req, updates)
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	if unpackErr != nil {
+		log.Printf("cannot unpack the objects: %v", unpackErr)
+		chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{UnpackStatus: "unpacker error"})
+	} else {
+		chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{UnpackStatus: "ok"})
+	}
+	for _, u := range updates {
+		c := &gitprotocolio.ProtocolV1ReceivePackResponseChunk{RefName: u.RefName}
+		if unpackErr != nil {
+			c.RefUpdateStatus = "ng"
+			c.RefUpdateFailMessage = "unpacker error"
+		} else if err := s.repo.UpdateRef(r.Context(), u); err != nil {
+			c.RefUpdateStatus = "ng"
+			c.RefUpdateFailMessage = err.Error()
+		} else {
+			c.RefUpdateStatus = "ok"
+		}
+		chunks = append(chunks, c)
+	}
+	chunks = append(chunks, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{EndOfResponse: true})
+
+	if !caps.Has("report-status") {
+		return
+	}
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		writePacket(&buf, c)
+	}
+	if sz := caps.SideBandPacketSize(); sz != 0 {
+		sbw := gitprotocolio.NewSideBandWriter(w, sz)
+		sbw.Main().Write(buf.Bytes())
+		sbw.Close()
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// unpackObjects reads the rest of the request as a pack file, and passes it to
+// the repository. A push that only deletes refs has no pack file.
+func (s *httpServer) unpackObjects(r *http.Request, req *gitprotocolio.ProtocolV1ReceivePackRequest, updates []*RefUpdate) error {
+	onlyDeletes := true
+	for _, u := range updates {
+		if u.NewObjectID != zeroObjectID {
+			onlyDeletes = false
+		}
+	}
+	if onlyDeletes {
+		return nil
+	}
+	pack := &packStreamReader{req: req}
+	if err := s.repo.UnpackObjects(r.Context(), pack); err != nil {
+		return err
+	}
+	return req.Err()
+}
+
+// packStreamReader reads PackStream of ProtocolV1ReceivePackRequestChunk.
+type packStreamReader struct {
+	req *gitprotocolio.ProtocolV1ReceivePackRequest
+	buf []byte
+}
+
+func (p *packStreamReader) Read(bs []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if !p.req.Scan() {
+			if err := p.req.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		// Skip the push options.
+		p.buf = p.req.Chunk().PackStream
+	}
+	n := copy(bs, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server implements a Git smart HTTP server on top of gitprotocolio.
+// The repository storage is provided by the Repository interface.
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	zeroObjectID = "0000000000000000000000000000000000000000"
+	agent        = "agent=gitprotocolio"
+)
+
+// Ref is a ref in a repository.
+type Ref struct {
+	Name     string
+	ObjectID string
+	// SymrefTarget is the name of the ref that this ref points to if this
+	// is a symbolic ref, like HEAD.
+	SymrefTarget string
+	// PeeledObjectID is the object that an annotated tag points to.
+	PeeledObjectID string
+}
+
+// PackRequest specifies the objects to be sent to a client.
+type PackRequest struct {
+	// Wants are the objects that the client wants.
+	Wants []string
+	// Haves are the objects that both the client and the repository have.
+	// The objects reachable from them can be omitted.
+	Haves []string
+	// OfsDelta is true if the client accepts ObjectOfsDelta entries.
+	OfsDelta bool
+	// Progress is the writer for the human-readable progress messages. This
+	// is nil if the client doesn't want them.
+	Progress io.Writer
+}
+
+// RefUpdate is a ref update command of a push. OldObjectID is the zero ID when
+// the ref is created, and NewObjectID is the zero ID when the ref is deleted.
+type RefUpdate struct {
+	RefName     string
+	OldObjectID string
+	NewObjectID string
+}
+
+// Repository is a Git repository served by Handler. The object IDs are 40-hex
+// SHA-1 strings. Handler rejects the requests with other object IDs and
+// malformed ref names before they reach the Repository.
+type Repository interface {
+	// ListRefs returns the refs of the repository. HEAD should be the first
+	// if it exists.
+	ListRefs(ctx context.Context) ([]*Ref, error)
+
+	// HasObject returns true if the repository has the object.
+	HasObject(ctx context.Context, objectID string) (bool, error)
+
+	// WritePack writes a pack file that contains the objects specified by
+	// req.
+	WritePack(ctx context.Context, w io.Writer, req *PackRequest) error
+
+	// UnpackObjects stores the objects in the pack file. The pack can be a
+	// thin pack.
+	UnpackObjects(ctx context.Context, pack io.Reader) error
+
+	// UpdateRef applies a ref update. The returned error is sent to the
+	// client as the reason of the rejection.
+	UpdateRef(ctx context.Context, update *RefUpdate) error
+}
+
+// Handler returns an http.Handler that serves the repository with the Git
+// smart HTTP protocol.
+func Handler(repo Repository) http.Handler {
+	s := &httpServer{repo}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info/refs", s.infoRefsHandler)
+	mux.HandleFunc("/git-upload-pack", s.uploadPackHandler)
+	mux.HandleFunc("/git-receive-pack", s.receivePackHandler)
+	return mux
+}
+
+type httpServer struct {
+	repo Repository
+}
+
+func (s *httpServer) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		http.Error(w, "only the smart HTTP protocol is supported", http.StatusForbidden)
+		return
+	}
+	version := protocolVersion(r)
+	if service == "git-receive-pack" && version == 2 {
+		// git-receive-pack doesn't support protocol v2.
+		version = 0
+	}
+
+	var chunks []*gitprotocolio.InfoRefsResponseChunk
+	if version == 2 {
+		chunks = []*gitprotocolio.InfoRefsResponseChunk{
+			{ProtocolVersion: 2},
+			{Capabilities: []string{agent}},
+			{Capabilities: []string{"ls-refs"}},
+			{Capabilities: []string{"fetch"}},
+			{EndOfRequest: true},
+		}
+	} else {
+		refs, err := s.repo.ListRefs(r.Context())
+		if err != nil {
+			http.Error(w, "cannot list the refs", http.StatusInternalServerError)
+			log.Printf("cannot list the refs: %v", err)
+			return
+		}
+		if version == 1 {
+			chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{ProtocolVersion: 1})
+		}
+		chunks = append(chunks, refAdvertisement(refs, serviceCapabilities(service, refs))...)
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	writePacket(w, &gitprotocolio.InfoRefsResponseChunk{ServiceHeader: service})
+	writePacket(w, &gitprotocolio.InfoRefsResponseChunk{ServiceHeaderFlush: true})
+	for _, c := range chunks {
+		if err := writePacket(w, c); err != nil {
+			return
+		}
+	}
+}
+
+func serviceCapabilities(service string, refs []*Ref) []string {
+	var caps []string
+	if service == "git-upload-pack" {
+		caps = []string{"multi_ack_detailed", "side-band-64k", "side-band", "ofs-delta", "no-progress"}
+	} else {
+		caps = []string{"report-status", "delete-refs", "side-band-64k", "ofs-delta"}
+	}
+	for _, ref := range refs {
+		if ref.SymrefTarget != "" {
+			caps = append(caps, fmt.Sprintf("symref=%s:%s", ref.Name, ref.SymrefTarget))
+		}
+	}
+	return append(caps, agent)
+}
+
+// refAdvertisement returns the v0/v1 ref advertisement. The capabilities are
+// attached to the first ref.
+func refAdvertisement(refs []*Ref, caps []string) []*gitprotocolio.InfoRefsResponseChunk {
+	var chunks []*gitprotocolio.InfoRefsResponseChunk
+	for _, ref := range refs {
+		c := &gitprotocolio.InfoRefsResponseChunk{
+			ObjectID: ref.ObjectID,
+			Ref:      ref.Name,
+		}
+		if len(chunks) == 0 {
+			c.Capabilities = caps
+		}
+		chunks = append(chunks, c)
+		if ref.PeeledObjectID != "" {
+			chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{
+				ObjectID: ref.PeeledObjectID,
+				Ref:      ref.Name + "^{}",
+			})
+		}
+	}
+	if len(chunks) == 0 {
+		// An empty repository advertises the capabilities with a
+		// placeholder.
+		chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{
+			ObjectID:     zeroObjectID,
+			Ref:          "capabilities^{}",
+			Capabilities: caps,
+		})
+	}
+	return append(chunks, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
+}
+
+func protocolVersion(r *http.Request) int {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		switch param {
+		case "version=1":
+			return 1
+		case "version=2":
+			return 2
+		}
+	}
+	return 0
+}
+
+func requestBody(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+func writePacket(w io.Writer, p gitprotocolio.Packet) error {
+	_, err := w.Write(p.EncodeToPktLine())
+	return err
+}
+
+// writeError writes an error as an ErrorPacket. The error message of a
+// SyntaxError, an InvalidObjectIDError, an InvalidRefNameError, or an
+// ObjectFormatError, including the position that a ParseError adds, is sent
+// as-is since it is about the client's request.
+func writeError(w io.Writer, err error) {
+	var ep gitprotocolio.ErrorPacket
+	var se gitprotocolio.SyntaxError
+	var oidErr *gitprotocolio.InvalidObjectIDError
+	var refErr *gitprotocolio.InvalidRefNameError
+	var ofErr *gitprotocolio.ObjectFormatError
+	switch {
+	case errors.As(err, &ep):
+		writePacket(w, ep)
+	case errors.As(err, &se), errors.As(err, &oidErr), errors.As(err, &refErr), errors.As(err, &ofErr):
+		writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
+	default:
+		writePacket(w, gitprotocolio.ErrorPacket("internal error"))
+		log.Printf("internal error: %v", err)
+	}
+}
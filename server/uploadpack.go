@@ -0,0 +1,337 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+func (s *httpServer) uploadPackHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, "cannot ungzip", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if protocolVersion(r) == 2 {
+		s.serveProtocolV2(w, r, body)
+		return
+	}
+	s.uploadPackV1(w, r, body)
+}
+
+// uploadPackV1 serves a protocol v0/v1 upload-pack request. The server is
+// stateless, so the request has all the haves so far. The server never sends
+// "ready"; the client sends "done" when it runs out of haves. The common
+// objects are acknowledged only with multi_ack_detailed.
+func (s *httpServer) uploadPackV1(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	var caps gitprotocolio.Capabilities
+	var wants, haves []string
+	done := false
+	req := gitprotocolio.NewProtocolV1UploadPackRequest(body)
+	req.EnableStrictValidation()
+	req.EnableObjectFormatValidation(gitprotocolio.ObjectFormatSHA1)
+	for req.Scan() {
+		c := req.Chunk()
+		switch {
+		case c.WantObjectID != "":
+			if len(wants) == 0 {
+				caps = c.Capabilities
+			}
+			wants = append(wants, c.WantObjectID)
+		case c.HaveObjectID != "":
+			haves = append(haves, c.HaveObjectID)
+		case c.NoMoreNegotiation:
+			done = true
+		case c.ShallowObjectID != "", c.DeepenDepth != 0, c.DeepenSince != 0, c.DeepenNotRef != "":
+			writeError(w, gitprotocolio.ErrorPacket("shallow is not supported"))
+			return
+		case c.FilterSpec != "":
+			writeError(w, gitprotocolio.ErrorPacket("filter is not supported"))
+			return
+		}
+	}
+	if err := req.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(wants) == 0 {
+		return
+	}
+	if err := s.checkWants(r.Context(), wants); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	common, err := s.commonObjects(r.Context(), haves)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if caps.Has("multi_ack_detailed") {
+		for _, oid := range common {
+			writePacket(w, &gitprotocolio.ProtocolV1UploadPackResponseChunk{
+				AckObjectID: oid,
+				AckDetail:   "common",
+			})
+		}
+	}
+	if !done {
+		writePacket(w, &gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true})
+		return
+	}
+	if len(common) == 0 {
+		writePacket(w, &gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true})
+	} else {
+		writePacket(w, &gitprotocolio.ProtocolV1UploadPackResponseChunk{AckObjectID: common[len(common)-1]})
+	}
+
+	packReq := &PackRequest{
+		Wants:    wants,
+		Haves:    common,
+		OfsDelta: caps.Has("ofs-delta"),
+	}
+	sz := caps.SideBandPacketSize()
+	if sz == 0 {
+		if err := s.repo.WritePack(r.Context(), w, packReq); err != nil {
+			log.Printf("cannot write a pack: %v", err)
+		}
+		return
+	}
+	sbw := gitprotocolio.NewSideBandWriter(w, sz)
+	if !caps.Has("no-progress") {
+		packReq.Progress = sbw.Progress()
+	}
+	if err := s.repo.WritePack(r.Context(), sbw.Main(), packReq); err != nil {
+		fmt.Fprintf(sbw.Error(), "cannot write a pack\n")
+		log.Printf("cannot write a pack: %v", err)
+		return
+	}
+	sbw.Close()
+}
+
+func (s *httpServer) serveProtocolV2(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	// Read the request to see the command. Each command has its own
+	// scanner.
+	bs, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "cannot read the request", http.StatusBadRequest)
+		return
+	}
+	v2Req := gitprotocolio.NewProtocolV2Request(bytes.NewReader(bs))
+	if !v2Req.Scan() {
+		if err := v2Req.Err(); err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+	switch cmd := v2Req.Chunk().Command; cmd {
+	case "ls-refs":
+		s.lsRefs(w, r, bytes.NewReader(bs))
+	case "fetch":
+		s.fetch(w, r, bytes.NewReader(bs))
+	default:
+		writeError(w, gitprotocolio.ErrorPacket("unknown command: "+cmd))
+	}
+}
+
+func (s *httpServer) lsRefs(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	var prefixes []string
+	symrefs, peel := false, false
+	req := gitprotocolio.NewProtocolV2LsRefsRequest(body)
+	for req.Scan() {
+		c := req.Chunk()
+		switch {
+		case c.Symrefs:
+			symrefs = true
+		case c.Peel:
+			peel = true
+		case c.RefPrefix != "":
+			prefixes = append(prefixes, c.RefPrefix)
+		}
+	}
+	if err := req.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	refs, err := s.repo.ListRefs(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, ref := range refs {
+		if !hasAnyPrefix(ref.Name, prefixes) {
+			continue
+		}
+		c := &gitprotocolio.ProtocolV2LsRefsResponseChunk{
+			ObjectID: ref.ObjectID,
+			RefName:  ref.Name,
+		}
+		if symrefs {
+			c.SymrefTarget = ref.SymrefTarget
+		}
+		if peel {
+			c.PeeledObjectID = ref.PeeledObjectID
+		}
+		if err := writePacket(w, c); err != nil {
+			return
+		}
+	}
+	writePacket(w, &gitprotocolio.ProtocolV2LsRefsResponseChunk{EndResponse: true})
+}
+
+func (s *httpServer) fetch(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	var wants, haves []string
+	done, ofsDelta, noProgress := false, false, false
+	req := gitprotocolio.NewProtocolV2FetchRequest(body)
+	req.EnableStrictValidation()
+	req.EnableObjectFormatValidation(gitprotocolio.ObjectFormatSHA1)
+	for req.Scan() {
+		c := req.Chunk()
+		switch {
+		case c.WantObjectID != "":
+			wants = append(wants, c.WantObjectID)
+		case c.HaveObjectID != "":
+			haves = append(haves, c.HaveObjectID)
+		case c.NoMoreNegotiation:
+			done = true
+		case c.OfsDelta:
+			ofsDelta = true
+		case c.NoProgress:
+			noProgress = true
+		case c.ShallowObjectID != "", c.DeepenDepth != 0, c.DeepenRelative, c.DeepenSince != 0, c.DeepenNotRef != "":
+			writeError(w, gitprotocolio.ErrorPacket("shallow is not supported"))
+			return
+		case c.FilterSpec != "":
+			writeError(w, gitprotocolio.ErrorPacket("filter is not supported"))
+			return
+		case c.WantRef != "":
+			writeError(w, gitprotocolio.ErrorPacket("ref-in-want is not supported"))
+			return
+		case c.SidebandAll, c.WaitForDone, len(c.PackfileURIProtocols) != 0:
+			writeError(w, gitprotocolio.ErrorPacket("unsupported fetch argument"))
+			return
+		}
+	}
+	if err := req.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(wants) == 0 {
+		writeError(w, gitprotocolio.ErrorPacket("no want"))
+		return
+	}
+	if err := s.checkWants(r.Context(), wants); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	common, err := s.commonObjects(r.Context(), haves)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !done {
+		// Without "ready", the client continues the negotiation.
+		writePacket(w, &gitprotocolio.ProtocolV2FetchResponseChunk{StartOfAcknowledgments: true})
+		for _, oid := range common {
+			writePacket(w, &gitprotocolio.ProtocolV2FetchResponseChunk{AckObjectID: oid})
+		}
+		if len(common) == 0 {
+			writePacket(w, &gitprotocolio.ProtocolV2FetchResponseChunk{Nak: true})
+		}
+		writePacket(w, &gitprotocolio.ProtocolV2FetchResponseChunk{EndResponse: true})
+		return
+	}
+
+	writePacket(w, &gitprotocolio.ProtocolV2FetchResponseChunk{StartOfPackfile: true})
+	// The packfile section is always sideband encoded with the
+	// side-band-64k packet size. The flush written by Close ends the
+	// response.
+	sbw := gitprotocolio.NewSideBandWriter(w, gitprotocolio.SideBand64kMaxPacketSize)
+	packReq := &PackRequest{
+		Wants:    wants,
+		Haves:    common,
+		OfsDelta: ofsDelta,
+	}
+	if !noProgress {
+		packReq.Progress = sbw.Progress()
+	}
+	if err := s.repo.WritePack(r.Context(), sbw.Main(), packReq); err != nil {
+		fmt.Fprintf(sbw.Error(), "cannot write a pack\n")
+		log.Printf("cannot write a pack: %v", err)
+		return
+	}
+	sbw.Close()
+}
+
+// checkWants returns an error if a want is not a tip of the advertised refs.
+func (s *httpServer) checkWants(ctx context.Context, wants []string) error {
+	refs, err := s.repo.ListRefs(ctx)
+	if err != nil {
+		return err
+	}
+	tips := map[string]bool{}
+	for _, ref := range refs {
+		tips[ref.ObjectID] = true
+		if ref.PeeledObjectID != "" {
+			tips[ref.PeeledObjectID] = true
+		}
+	}
+	for _, oid := range wants {
+		if !tips[oid] {
+			return gitprotocolio.ErrorPacket("upload-pack: not our ref " + oid)
+		}
+	}
+	return nil
+}
+
+// commonObjects returns the haves that the repository has.
+func (s *httpServer) commonObjects(ctx context.Context, haves []string) ([]string, error) {
+	var common []string
+	for _, oid := range haves {
+		ok, err := s.repo.HasObject(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			common = append(common, oid)
+		}
+	}
+	return common, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
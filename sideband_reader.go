@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// SideBandMaxPacketSize is the maximum packet size, including the
+	// length header and the channel byte, with the "side-band" capability.
+	SideBandMaxPacketSize = 1000
+	// SideBand64kMaxPacketSize is the maximum packet size with the
+	// "side-band-64k" capability.
+	SideBand64kMaxPacketSize = 65520
+)
+
+// SideBandReader demultiplexes sideband packets. The main stream (0x01) is
+// read through Read, the progress messages (0x02) are passed to the callback,
+// and an error message (0x03) is returned as an ErrorPacket. The stream ends
+// at a flush packet.
+type SideBandReader struct {
+	scanner       *PacketScanner
+	maxPacketSize int
+	progress      func([]byte)
+	buf           []byte
+	err           error
+}
+
+// NewSideBandReader returns a SideBandReader that reads the packets from
+// scanner. A packet larger than maxPacketSize is a SyntaxError. Use
+// SideBandMaxPacketSize or SideBand64kMaxPacketSize depending on the
+// negotiated capability. progress is called with the payload of the progress
+// packets, which is valid only during the call. It can be nil.
+func NewSideBandReader(scanner *PacketScanner, maxPacketSize int, progress func([]byte)) *SideBandReader {
+	return &SideBandReader{scanner: scanner, maxPacketSize: maxPacketSize, progress: progress}
+}
+
+// Read implements io.Reader. It returns io.EOF after a flush packet, and
+// io.ErrUnexpectedEOF if the stream ends without a flush packet.
+func (r *SideBandReader) Read(bs []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.buf, r.err = r.next()
+	}
+	n := copy(bs, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next returns the payload of the next main stream packet.
+func (r *SideBandReader) next() ([]byte, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch p := r.scanner.Packet().(type) {
+	case FlushPacket:
+		return nil, io.EOF
+	case BytesPacket:
+		if len(p) == 0 {
+			return nil, SyntaxError("empty sideband packet")
+		}
+		if sz := len(p) + 4; sz > r.maxPacketSize {
+			return nil, SyntaxError(fmt.Sprintf("sideband packet too large: %d > %d", sz, r.maxPacketSize))
+		}
+		switch sp := ParseSideBandPacket(p).(type) {
+		case SideBandMainPacket:
+			return sp, nil
+		case SideBandReportPacket:
+			if r.progress != nil {
+				r.progress(sp)
+			}
+			return nil, nil
+		case SideBandErrorPacket:
+			return nil, ErrorPacket(sp)
+		}
+		return nil, SyntaxError(fmt.Sprintf("unknown sideband channel: %d", p[0]))
+	default:
+		return nil, SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+	}
+}
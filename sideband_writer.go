@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// SideBandWriter multiplexes the main stream, the progress messages, and the
+// error messages into sideband packets. Each write is framed into packets
+// immediately, so no goroutine is needed to consume the output. It's safe to
+// write to the channels concurrently, and the packets of a write are not
+// interleaved with other writes.
+type SideBandWriter struct {
+	w             io.Writer
+	maxPacketSize int
+	m             sync.Mutex
+	closed        bool
+	err           error
+}
+
+// NewSideBandWriter returns a SideBandWriter that writes the packets to w.
+// A packet, including the length header and the channel byte, is at most
+// maxPacketSize. Use SideBandMaxPacketSize or SideBand64kMaxPacketSize
+// depending on the negotiated capability.
+func NewSideBandWriter(w io.Writer, maxPacketSize int) *SideBandWriter {
+	if maxPacketSize <= 5 || maxPacketSize > SideBand64kMaxPacketSize {
+		panic("invalid sideband packet size")
+	}
+	return &SideBandWriter{w: w, maxPacketSize: maxPacketSize}
+}
+
+// Main returns a writer of the main stream (0x01).
+func (w *SideBandWriter) Main() io.Writer {
+	return sideBandChannelWriter{w, func(bs []byte) Packet { return SideBandMainPacket(bs) }}
+}
+
+// Progress returns a writer of the progress messages (0x02).
+func (w *SideBandWriter) Progress() io.Writer {
+	return sideBandChannelWriter{w, func(bs []byte) Packet { return SideBandReportPacket(bs) }}
+}
+
+// Error returns a writer of the error messages (0x03).
+func (w *SideBandWriter) Error() io.Writer {
+	return sideBandChannelWriter{w, func(bs []byte) Packet { return SideBandErrorPacket(bs) }}
+}
+
+// Close writes a flush packet that terminates the sideband stream. It does not
+// close the underlying writer. The channels cannot be written after Close.
+func (w *SideBandWriter) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return errors.New("already closed")
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	_, w.err = w.w.Write(FlushPacket{}.EncodeToPktLine())
+	return w.err
+}
+
+func (w *SideBandWriter) write(bs []byte, newPacket func([]byte) Packet) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return 0, errors.New("already closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for n < len(bs) {
+		sz := len(bs) - n
+		if sz > w.maxPacketSize-5 {
+			sz = w.maxPacketSize - 5
+		}
+		if _, w.err = w.w.Write(newPacket(bs[n : n+sz]).EncodeToPktLine()); w.err != nil {
+			return n, w.err
+		}
+		n += sz
+	}
+	return n, nil
+}
+
+type sideBandChannelWriter struct {
+	w         *SideBandWriter
+	newPacket func([]byte) Packet
+}
+
+func (c sideBandChannelWriter) Write(bs []byte) (int, error) {
+	return c.w.write(bs, c.newPacket)
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"io"
+	"log"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+// bidiValidation is the validations that a bidi transport server applies to
+// the client's requests. See HTTPProxyOptions for the details.
+type bidiValidation struct {
+	strict       bool
+	objectFormat bool
+}
+
+// proxyBidiService proxies a bidi transport (SSH and Git wire) session between
+// a client and git-upload-pack or git-receive-pack. serverIn is closed when
+// the client finishes the request.
+func proxyBidiService(client io.ReadWriter, serverIn io.WriteCloser, serverOut io.Reader, service string, isV2 bool, v bidiValidation) {
+	if service == "git-upload-pack" {
+		if !isV2 {
+			// Protocol v0/v1 interleaves the requests and the
+			// responses.
+			defer serverIn.Close()
+			copyUploadPackSession(client, serverIn, client, serverOut, v)
+			return
+		}
+		go func() {
+			defer serverIn.Close()
+			copyUploadPackV2Request(serverIn, client, v)
+		}()
+		copyUploadPackV2Response(client, serverOut)
+		return
+	}
+	// git-receive-pack doesn't support protocol v2, and falls back to v0.
+	capsCh := make(chan []string, 1)
+	go func() {
+		defer serverIn.Close()
+		copyReceivePackRequest(serverIn, client, capsCh, v)
+	}()
+	copyReceivePackResponse(client, serverOut, capsCh)
+}
+
+// isProtocolV2 returns true if the GIT_PROTOCOL value requests protocol v2.
+func isProtocolV2(gitProtocol string) bool {
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUploadPackSession proxies a protocol v0/v1 git-upload-pack session. The
+// requests are written to serverW and the responses are written to clientW.
+func copyUploadPackSession(clientW, serverW io.Writer, clientR, serverR io.Reader, v bidiValidation) {
+	session := gitprotocolio.NewProtocolV1UploadPackSession(clientR, serverR)
+	if v.objectFormat {
+		session.EnableObjectFormatValidation()
+	}
+	if v.strict {
+		session.EnableStrictValidation()
+	}
+	for session.Scan() {
+		chunk := session.Chunk()
+		w := clientW
+		if chunk.Request != nil {
+			w = serverW
+		}
+		if err := writePacket(w, chunk); err != nil {
+			return
+		}
+	}
+	writeParseError(clientW, session.Err(), session)
+}
+
+func copyUploadPackV2Request(w io.Writer, r io.Reader, v bidiValidation) {
+	v2Req := gitprotocolio.NewProtocolV2Request(r)
+	if v.objectFormat {
+		// Git sends the "object-format" capability with the commands
+		// if the server advertises it.
+		v2Req.EnableObjectFormatValidation("")
+	}
+	if v.strict {
+		v2Req.EnableStrictValidation()
+	}
+	for v2Req.Scan() {
+		if err := writePacket(w, v2Req.Chunk()); err != nil {
+			return
+		}
+	}
+	writeParseError(w, v2Req.Err(), v2Req)
+}
+
+func copyUploadPackV2Response(w io.Writer, r io.Reader) {
+	// PacketScanner reads ahead, so the ref advertisement and the
+	// responses are read by the same scanner.
+	scanner := gitprotocolio.NewPacketScanner(r)
+	if !copyRefAdvertisement(w, scanner) {
+		return
+	}
+	v2Resp := gitprotocolio.NewProtocolV2ResponseFromScanner(scanner)
+	for v2Resp.Scan() {
+		if err := writePacket(w, v2Resp.Chunk()); err != nil {
+			return
+		}
+	}
+	writeParseError(w, v2Resp.Err(), v2Resp)
+}
+
+func copyReceivePackRequest(w io.Writer, r io.Reader, capsCh chan<- []string, v bidiValidation) {
+	defer close(capsCh)
+	sentCaps := false
+	v1Req := gitprotocolio.NewBidiProtocolV1ReceivePackRequest(r)
+	if v.objectFormat {
+		// Git sends the "object-format" capability with the commands.
+		v1Req.EnableObjectFormatValidation("")
+	}
+	if v.strict {
+		v1Req.EnableStrictValidation()
+	}
+	for v1Req.Scan() {
+		chunk := v1Req.Chunk()
+		if len(chunk.Capabilities) != 0 && !sentCaps {
+			capsCh <- chunk.Capabilities
+			sentCaps = true
+		}
+		if err := writePacket(w, chunk); err != nil {
+			return
+		}
+	}
+	writeParseError(w, v1Req.Err(), v1Req)
+}
+
+func copyReceivePackResponse(w io.Writer, r io.Reader, capsCh <-chan []string) {
+	scanner := gitprotocolio.NewPacketScanner(r)
+	if !copyRefAdvertisement(w, scanner) {
+		return
+	}
+	// The response format depends on the capabilities the client
+	// requested. If the channel is closed without capabilities, the client
+	// has nothing to push.
+	copyReceivePackV1Response(w, scanner, NopInterceptor{}, <-capsCh)
+}
+
+// copyRefAdvertisement copies the ref advertisement. Returns true if the
+// advertisement is successfully copied.
+func copyRefAdvertisement(w io.Writer, scanner *gitprotocolio.PacketScanner) bool {
+	infoRefsResp := gitprotocolio.NewBidiInfoRefsResponseFromScanner(scanner)
+	for infoRefsResp.Scan() {
+		if err := writePacket(w, infoRefsResp.Chunk()); err != nil {
+			return false
+		}
+	}
+	if err := infoRefsResp.Err(); err != nil {
+		writeParseError(w, err, infoRefsResp)
+		return false
+	}
+	return infoRefsResp.Chunk() != nil && infoRefsResp.Chunk().EndOfRequest
+}
+
+func writeParseError(w io.Writer, err error, parser interface{}) {
+	if err == nil {
+		return
+	}
+	if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+		writePacket(w, ep)
+	} else if isInvalidInput(err) {
+		writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
+	} else {
+		writePacket(w, gitprotocolio.ErrorPacket("internal error"))
+		log.Printf("Parsing error: %#v, parser: %#v", err, parser)
+	}
+}
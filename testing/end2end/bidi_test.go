@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestBidi_clone(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, p := range bidiParams() {
+		r = createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(p.args, "clone", p.url, "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("-C", "cloned", "rev-parse", "origin/master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBidi_fetch(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, p := range bidiParams() {
+		r = createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(p.args, "fetch", p.url)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBidi_push(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range bidiParams() {
+		refreshRemote()
+		if _, err := r.run(append(p.args, "push", p.url, "master:master")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("ls-remote", httpServerURL, "refs/heads/master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != strings.TrimSuffix(want, "\n")+"\trefs/heads/master\n" {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBidi_multiRoundNegotiation(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	base, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=remote"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range bidiParams() {
+		if _, err := r.run("push", "--force", httpServerURL, strings.TrimSuffix(base, "\n")+":refs/heads/master"); err != nil {
+			t.Fatalf("%v", err)
+		}
+		local := createLocalGitRepo()
+		defer local.close()
+		if _, err := local.run("pull", httpServerURL, "master"); err != nil {
+			t.Fatal(err)
+		}
+		// Create local-only commits so that the client sends haves over
+		// multiple rounds.
+		for i := 0; i < 50; i++ {
+			if _, err := local.run("commit", "--allow-empty", fmt.Sprintf("--message=local %d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if _, err := local.run(append(p.args, "fetch", p.url, "master")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := local.run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBidi_shallowFetch(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, p := range bidiParams() {
+		r = createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(p.args, "fetch", "--depth=1", p.url)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := r.run(append(p.args, "fetch", "--deepen=1", p.url)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBidi_pushUpToDate(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	// The client sends only a flush packet when it has nothing to push.
+	for name, p := range bidiParams() {
+		if _, err := r.run(append(p.args, "push", p.url, "master:master")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestBidi_emptyRequest(t *testing.T) {
+	flush := gitprotocolio.FlushPacket{}
+	// Only the bidi-transports allow a request of a single flush packet.
+	uploadPack := gitprotocolio.NewProtocolV1UploadPackRequest(encodePackets(flush))
+	for uploadPack.Scan() {
+	}
+	receivePack := gitprotocolio.NewProtocolV1ReceivePackRequest(encodePackets(flush))
+	for receivePack.Scan() {
+	}
+	var se gitprotocolio.SyntaxError
+	if !errors.As(uploadPack.Err(), &se) {
+		t.Errorf("upload-pack: want a SyntaxError, got %v", uploadPack.Err())
+	}
+	if !errors.As(receivePack.Err(), &se) {
+		t.Errorf("receive-pack: want a SyntaxError, got %v", receivePack.Err())
+	}
+
+	bidiReceivePack := gitprotocolio.NewBidiProtocolV1ReceivePackRequest(encodePackets(flush))
+	if !bidiReceivePack.Scan() || !bidiReceivePack.Chunk().EndOfCommands {
+		t.Errorf("bidi receive-pack: want the end of the commands, got %v", bidiReceivePack.Err())
+	}
+	if bidiReceivePack.Scan() || bidiReceivePack.Err() != nil {
+		t.Errorf("bidi receive-pack: want the end of the request, got %v", bidiReceivePack.Err())
+	}
+
+	// The upload-pack response is never empty.
+	resp := gitprotocolio.NewProtocolV1UploadPackResponse(encodePackets())
+	for resp.Scan() {
+	}
+	if !errors.As(resp.Err(), &se) {
+		t.Errorf("upload-pack response: want a SyntaxError, got %v", resp.Err())
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// getInfoRefs returns the /info/refs response of git-upload-pack.
+func getInfoRefs(t *testing.T, gitProtocol string) []byte {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(httpServerURL, "/")+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gitProtocol != "" {
+		req.Header.Set("Git-Protocol", gitProtocol)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestCapabilities_protocolV0(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	bs := getInfoRefs(t, "")
+	sc := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	var out bytes.Buffer
+	for sc.Scan() {
+		c := sc.Chunk()
+		if c.Ref == "HEAD" && !reflect.DeepEqual(sc.Capabilities(), gitprotocolio.Capabilities(c.Capabilities)) {
+			t.Errorf("want %v, got %v", c.Capabilities, sc.Capabilities())
+		}
+		out.Write(c.EncodeToPktLine())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), bs) {
+		t.Errorf("want %q, got %q", bs, out.Bytes())
+	}
+
+	caps := sc.Capabilities()
+	if agent, ok := caps.Lookup("agent"); !ok || !strings.HasPrefix(agent, "git/") {
+		t.Errorf("want a git agent, got %q", agent)
+	}
+	if !caps.Has("ofs-delta") {
+		t.Errorf("want ofs-delta in %v", caps)
+	}
+	if caps.Has("no-such-capability") {
+		t.Errorf("want no no-such-capability in %v", caps)
+	}
+	if got, want := caps.Symrefs(), map[string]string{"HEAD": "refs/heads/master"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got, want := caps.Values("symref"), []string{"HEAD:refs/heads/master"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := gitprotocolio.ParseCapabilities(caps.String()); !reflect.DeepEqual(got, caps) {
+		t.Errorf("want %v, got %v", caps, got)
+	}
+}
+
+func TestCapabilities_protocolV1(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The first ref after "version 1" has the capabilities like protocol
+	// v0.
+	bs := getInfoRefs(t, "version=1")
+	sc := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	var version uint64
+	var out bytes.Buffer
+	for sc.Scan() {
+		c := sc.Chunk()
+		if c.ProtocolVersion != 0 {
+			version = c.ProtocolVersion
+		}
+		if c.Ref == "HEAD" && len(c.Capabilities) == 0 {
+			t.Error("want the capabilities with HEAD")
+		}
+		out.Write(c.EncodeToPktLine())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("want version 1, got %d", version)
+	}
+	if !bytes.Equal(out.Bytes(), bs) {
+		t.Errorf("want %q, got %q", bs, out.Bytes())
+	}
+	if !sc.Capabilities().Has("ofs-delta") {
+		t.Errorf("want ofs-delta in %v", sc.Capabilities())
+	}
+}
+
+func TestCapabilities_protocolV2(t *testing.T) {
+	refreshRemote()
+
+	sc := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(getInfoRefs(t, "version=2")))
+	for sc.Scan() {
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := sc.Capabilities()
+	if agent, ok := caps.Lookup("agent"); !ok || !strings.HasPrefix(agent, "git/") {
+		t.Errorf("want a git agent, got %q", agent)
+	}
+	if !caps.Has("ls-refs") || !caps.Has("fetch") {
+		t.Errorf("want ls-refs and fetch in %v", caps)
+	}
+	if !caps.HasValue("fetch", "shallow") {
+		t.Errorf("want fetch=shallow in %v", caps)
+	}
+	if v, ok := caps.Lookup("fetch"); !ok || !reflect.DeepEqual(caps.Values("fetch"), strings.Split(v, " ")) {
+		t.Errorf("want the features of %q, got %v", v, caps.Values("fetch"))
+	}
+}
+
+func TestCapabilities_request(t *testing.T) {
+	var buf bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV2FetchRequestChunk{
+		{Command: "fetch"},
+		{Capability: "agent=git/2.39.5"},
+		{Capability: "object-format=sha1"},
+		{EndCapability: true},
+		{NoMoreNegotiation: true},
+		{EndArgument: true},
+	} {
+		buf.Write(c.EncodeToPktLine())
+	}
+	sc := gitprotocolio.NewProtocolV2FetchRequest(&buf)
+	for sc.Scan() {
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := sc.Capabilities().Lookup("object-format"); v != "sha1" {
+		t.Errorf("want sha1, got %q", v)
+	}
+
+	buf.Reset()
+	for _, c := range []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{
+			OldObjectID:  zeroObjectID,
+			NewObjectID:  zeroObjectID,
+			RefName:      "refs/heads/master",
+			Capabilities: []string{"report-status", "push-cert=1234-abcd"},
+		},
+		{EndOfCommands: true},
+	} {
+		buf.Write(c.EncodeToPktLine())
+	}
+	rsc := gitprotocolio.NewProtocolV1ReceivePackRequest(&buf)
+	for rsc.Scan() {
+	}
+	if err := rsc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := rsc.Capabilities().Lookup("push-cert"); v != "1234-abcd" {
+		t.Errorf("want 1234-abcd, got %q", v)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio/client"
+)
+
+const zeroObjectID = "0000000000000000000000000000000000000000"
+
+func clientServerURLs() map[string]string {
+	return map[string]string{
+		"HTTP proxy": httpProxyURL,
+		"Go server":  goServerURL,
+	}
+}
+
+func TestClient_lsRemote(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("tag", "--annotate", "--message=tag", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", "v1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want, err := r.run("ls-remote", httpServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for server, u := range clientServerURLs() {
+		for name, version := range clientParams() {
+			c := &client.Client{ProtocolVersion: version}
+			refs, err := c.LsRemote(context.Background(), u)
+			if err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+				continue
+			}
+			var sb strings.Builder
+			for _, ref := range refs {
+				fmt.Fprintf(&sb, "%s\t%s\n", ref.ObjectID, ref.Name)
+				if ref.PeeledObjectID != "" {
+					fmt.Fprintf(&sb, "%s\t%s^{}\n", ref.PeeledObjectID, ref.Name)
+				}
+			}
+			if got := sb.String(); got != want {
+				t.Errorf("%s %s: want %s, got %s", server, name, want, got)
+			}
+			if refs[0].Name != "HEAD" || refs[0].SymrefTarget != "refs/heads/master" {
+				t.Errorf("%s %s: want HEAD -> refs/heads/master, got %#v", server, name, refs[0])
+			}
+		}
+	}
+}
+
+func TestClient_fetch(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have = strings.TrimSuffix(have, "\n")
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = strings.TrimSuffix(want, "\n")
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The objects that the server doesn't have take more than one
+	// negotiation round before the common one.
+	var haves []string
+	for i := 0; i < 40; i++ {
+		haves = append(haves, fmt.Sprintf("%040x", i+1))
+	}
+	haves = append(haves, have)
+
+	for server, u := range clientServerURLs() {
+		for name, version := range clientParams() {
+			local := createLocalGitRepo()
+			defer local.close()
+			if _, err := local.run("fetch", string(r), have); err != nil {
+				t.Fatal(err)
+			}
+
+			c := &client.Client{ProtocolVersion: version}
+			result, err := c.Fetch(context.Background(), u, &client.FetchRequest{
+				Wants: []string{want},
+				Haves: haves,
+			})
+			if err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+				continue
+			}
+			_, err = local.runWithStdin(result.Pack, "index-pack", "--stdin", "--fix-thin")
+			result.Pack.Close()
+			if err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+				continue
+			}
+			if got, err := local.run("cat-file", "-t", want); err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+			} else if got != "commit\n" {
+				t.Errorf("%s %s: want a commit, got %s", server, name, got)
+			}
+			if len(result.CommonObjectIDs) != 1 || result.CommonObjectIDs[0] != have {
+				t.Errorf("%s %s: want %s as common, got %v", server, name, have, result.CommonObjectIDs)
+			}
+		}
+	}
+}
+
+func TestClient_push(t *testing.T) {
+	for server, u := range clientServerURLs() {
+		for name, version := range clientParams() {
+			refreshRemote()
+			r := createLocalGitRepo()
+			defer r.close()
+
+			if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+				t.Fatal(err)
+			}
+			oid, err := r.run("rev-parse", "master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pack, err := r.runWithStdin(strings.NewReader(oid), "pack-objects", "--stdout", "--revs", "-q")
+			if err != nil {
+				t.Fatal(err)
+			}
+			oid = strings.TrimSuffix(oid, "\n")
+
+			c := &client.Client{ProtocolVersion: version}
+			result, err := c.Push(context.Background(), u, &client.PushRequest{
+				Commands: []*client.PushCommand{
+					{RefName: "refs/heads/feature", OldObjectID: zeroObjectID, NewObjectID: oid},
+				},
+				Pack: strings.NewReader(pack),
+			})
+			if err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+				continue
+			}
+			if result.UnpackStatus != "ok" || len(result.RefStatuses) != 1 || !result.RefStatuses[0].OK {
+				t.Errorf("%s %s: unexpected result: %#v", server, name, result)
+				continue
+			}
+			if got, err := r.run("ls-remote", httpServerURL, "refs/heads/feature"); err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+			} else if want := oid + "\trefs/heads/feature\n"; got != want {
+				t.Errorf("%s %s: want %s, got %s", server, name, want, got)
+			}
+
+			result, err = c.Push(context.Background(), u, &client.PushRequest{
+				Commands: []*client.PushCommand{
+					{RefName: "refs/heads/feature", OldObjectID: oid, NewObjectID: zeroObjectID},
+				},
+			})
+			if err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+				continue
+			}
+			if result.UnpackStatus != "ok" || len(result.RefStatuses) != 1 || !result.RefStatuses[0].OK {
+				t.Errorf("%s %s: unexpected result: %#v", server, name, result)
+				continue
+			}
+			if got, err := r.run("ls-remote", httpServerURL, "refs/heads/feature"); err != nil {
+				t.Errorf("%s %s: %v", server, name, err)
+			} else if got != "" {
+				t.Errorf("%s %s: want no ref, got %s", server, name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// captureConnectRequest runs the git command against a listener, and returns
+// the connect request that git sends first.
+func captureConnectRequest(t *testing.T, arg ...string) []byte {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		defer conn.Close()
+		var szBuf [4]byte
+		if _, err := io.ReadFull(conn, szBuf[:]); err != nil {
+			ch <- nil
+			return
+		}
+		var sz int
+		fmt.Sscanf(string(szBuf[:]), "%04x", &sz)
+		bs := make([]byte, sz)
+		copy(bs, szBuf[:])
+		if _, err := io.ReadFull(conn, bs[4:]); err != nil {
+			ch <- nil
+			return
+		}
+		ch <- bs
+	}()
+
+	r := createLocalGitRepo()
+	defer r.close()
+	url := fmt.Sprintf("git://%s/repo", l.Addr().String())
+	// The command fails since the listener closes the connection.
+	r.run(append(arg, url)...)
+	bs := <-ch
+	if bs == nil {
+		t.Fatal("cannot read the connect request")
+	}
+	return bs
+}
+
+func TestGitProtocolConnectRequest_capturedTraffic(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		arg  []string
+		want []string
+	}{
+		{"Protocol V0", []string{"-c", "protocol.version=0", "ls-remote"}, nil},
+		{"Protocol V2", []string{"-c", "protocol.version=2", "ls-remote"}, []string{"version=2"}},
+	} {
+		bs := captureConnectRequest(t, tc.arg...)
+		req, err := gitprotocolio.ReadGitProtocolConnectRequest(bytes.NewReader(bs))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if req.Service != "git-upload-pack" || req.Pathname != "/repo" || req.Host != "127.0.0.1" || req.Port == "" {
+			t.Errorf("%s: unexpected request: %#v", tc.name, req)
+		}
+		if !reflect.DeepEqual(req.ExtraParameters, tc.want) {
+			t.Errorf("%s: want extra parameters %v, got %v", tc.name, tc.want, req.ExtraParameters)
+		}
+		if got := req.EncodeToPktLine(); !bytes.Equal(got, bs) {
+			t.Errorf("%s: the request is not re-encoded byte-for-byte:\nwant %q\ngot  %q", tc.name, bs, got)
+		}
+	}
+}
+
+func TestGitProtocolConnectRequest_malformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+	}{
+		{"no pathname", "git-upload-pack\x00"},
+		{"empty host", "git-upload-pack /repo\x00host=\x00"},
+		{"bad port", "git-upload-pack /repo\x00host=example.com:http\x00"},
+		{"unterminated host", "git-upload-pack /repo\x00host=example.com"},
+		{"unknown parameter", "git-upload-pack /repo\x00user=git\x00"},
+		{"empty extra parameter", "git-upload-pack /repo\x00host=example.com\x00\x00\x00"},
+		{"unterminated extra parameter", "git-upload-pack /repo\x00host=example.com\x00\x00version=2"},
+	} {
+		_, err := gitprotocolio.ReadGitProtocolConnectRequest(bytes.NewReader(gitprotocolio.BytesPacket(tc.input).EncodeToPktLine()))
+		var se gitprotocolio.SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, err)
+		}
+	}
+	for _, input := range []string{"", "00", "0004", "zzzzgit-upload-pack /repo", "0020git-upload-pack"} {
+		_, err := gitprotocolio.ReadGitProtocolConnectRequest(strings.NewReader(input))
+		var se gitprotocolio.SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%q: want a SyntaxError, got %v", input, err)
+		}
+	}
+}
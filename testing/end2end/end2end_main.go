@@ -17,6 +17,7 @@ package end2end
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -25,6 +26,7 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/google/gitprotocolio/server"
 	"github.com/google/gitprotocolio/testing"
 )
 
@@ -35,6 +37,10 @@ var (
 
 	httpServerURL string
 	httpProxyURL  string
+	sshServerURL  string
+
+	gitDaemonProxyURL string
+	goServerURL       string
 )
 
 func init() {
@@ -71,7 +77,10 @@ func init() {
 			log.Fatal(err)
 		}
 		httpProxy := &http.Server{
-			Handler: testing.HTTPProxyHandler(httpServerURL),
+			Handler: testing.HTTPProxyHandlerWithOptions(httpServerURL, testing.HTTPProxyOptions{
+				StrictValidation:       true,
+				ObjectFormatValidation: true,
+			}),
 		}
 		go func() {
 			log.Fatal(httpProxy.Serve(l))
@@ -79,6 +88,52 @@ func init() {
 		httpProxyURL = fmt.Sprintf("http://%s/", l.Addr().String())
 	}
 
+	{
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		goServer := &http.Server{
+			Handler: server.Handler(testing.NewGitRepository(gitBinary, string(remoteGitRepo))),
+		}
+		go func() {
+			log.Fatal(goServer.Serve(l))
+		}()
+		goServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
+	}
+
+	{
+		// Use IPv4 loopback since ssh doesn't accept "[::]" as a host.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		sshServer, err := testing.NewSSHServer(gitBinary, string(remoteGitRepo))
+		if err != nil {
+			log.Fatal(err)
+		}
+		sshServer.StrictValidation = true
+		sshServer.ObjectFormatValidation = true
+		go func() {
+			log.Fatal(sshServer.Serve(l))
+		}()
+		sshServerURL = fmt.Sprintf("ssh://git@%s/", l.Addr().String())
+	}
+
+	{
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		gitDaemonProxy := testing.NewGitDaemonProxy(gitBinary, string(remoteGitRepo))
+		gitDaemonProxy.StrictValidation = true
+		gitDaemonProxy.ObjectFormatValidation = true
+		go func() {
+			log.Fatal(gitDaemonProxy.Serve(l))
+		}()
+		gitDaemonProxyURL = fmt.Sprintf("git://%s/", l.Addr().String())
+	}
+
 	gnuPGHome, err = ioutil.TempDir("", "gitprotocolio_remote")
 	if err != nil {
 		log.Fatal("cannot create a GNUPGHOME: ", err)
@@ -109,11 +164,15 @@ func init() {
 }
 
 func refreshRemote() {
+	refreshRemoteWithObjectFormat("sha1")
+}
+
+func refreshRemoteWithObjectFormat(objectFormat string) {
 	remoteGitRepo.close()
 	if err := os.Mkdir(string(remoteGitRepo), 0755); err != nil {
 		log.Fatal(err)
 	}
-	remoteGitRepo.run("init", "--bare")
+	remoteGitRepo.run("init", "--bare", "--object-format="+objectFormat)
 	remoteGitRepo.run("config", "http.receivepack", "1")
 	remoteGitRepo.run("config", "uploadpack.allowfilter", "1")
 	remoteGitRepo.run("config", "receive.advertisepushoptions", "1")
@@ -121,12 +180,16 @@ func refreshRemote() {
 }
 
 func createLocalGitRepo() gitRepo {
+	return createLocalGitRepoWithObjectFormat("sha1")
+}
+
+func createLocalGitRepoWithObjectFormat(objectFormat string) gitRepo {
 	dir, err := ioutil.TempDir("", "gitprotocolio_local")
 	if err != nil {
 		log.Fatal(err)
 	}
 	r := gitRepo(dir)
-	r.run("init")
+	r.run("init", "--object-format="+objectFormat)
 	r.run("config", "user.email", "local-root@example.com")
 	r.run("config", "user.name", "local root")
 	return r
@@ -135,9 +198,18 @@ func createLocalGitRepo() gitRepo {
 type gitRepo string
 
 func (r gitRepo) run(arg ...string) (string, error) {
+	return r.runWithStdin(nil, arg...)
+}
+
+func (r gitRepo) runWithStdin(stdin io.Reader, arg ...string) (string, error) {
 	cmd := exec.Command(gitBinary, arg...)
+	cmd.Stdin = stdin
 	cmd.Dir = string(r)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GNUPGHOME=%s", gnuPGHome))
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GNUPGHOME=%s", gnuPGHome),
+		// The SSH server's host key is generated for each run.
+		"GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR",
+	)
 	bs, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", &commandError{err, cmd.Args, strings.TrimRight(string(bs), "\n")}
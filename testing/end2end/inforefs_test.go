@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestInfoRefsResponse_serviceHeader(t *testing.T) {
+	// A ref advertisement of the bidi-transports.
+	bidi := encodePackets(
+		gitprotocolio.BytesPacket(zeroObjectID+" refs/heads/master\x00ofs-delta\n"),
+		gitprotocolio.FlushPacket{},
+	).Bytes()
+	for _, tc := range []struct {
+		name    string
+		newResp func(io.Reader) *gitprotocolio.InfoRefsResponse
+		wantErr bool
+	}{
+		{"smart HTTP", gitprotocolio.NewInfoRefsResponse, true},
+		{"bidi", gitprotocolio.NewBidiInfoRefsResponse, false},
+	} {
+		sc := tc.newResp(bytes.NewReader(bidi))
+		var refs []string
+		for sc.Scan() {
+			if sc.Chunk().Ref != "" {
+				refs = append(refs, sc.Chunk().Ref)
+			}
+		}
+		if !tc.wantErr {
+			if sc.Err() != nil {
+				t.Errorf("%s: %v", tc.name, sc.Err())
+			}
+			if len(refs) != 1 || refs[0] != "refs/heads/master" {
+				t.Errorf("%s: want refs/heads/master, got %v", tc.name, refs)
+			}
+			continue
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) || !strings.Contains(sc.Err().Error(), "expect the service header") {
+			t.Errorf("%s: want a missing service header error, got %v", tc.name, sc.Err())
+		}
+		if len(refs) != 0 {
+			t.Errorf("%s: want no ref, got %v", tc.name, refs)
+		}
+	}
+}
+
+func TestInfoRefsResponse_sharedScanner(t *testing.T) {
+	// A protocol v2 session on the bidi-transports. The scanner of the
+	// advertisement reads ahead the ls-refs response.
+	scanner := gitprotocolio.NewPacketScanner(encodePackets(
+		gitprotocolio.BytesPacket("version 2\n"),
+		gitprotocolio.BytesPacket("ls-refs\n"),
+		gitprotocolio.FlushPacket{},
+		gitprotocolio.BytesPacket(zeroObjectID+" refs/heads/master\n"),
+		gitprotocolio.FlushPacket{},
+	))
+	adv := gitprotocolio.NewBidiInfoRefsResponseFromScanner(scanner)
+	for adv.Scan() {
+	}
+	if err := adv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	resp := gitprotocolio.NewProtocolV2ResponseFromScanner(scanner)
+	for resp.Scan() {
+		if c := resp.Chunk(); len(c.Response) != 0 {
+			lines = append(lines, string(c.Response))
+		}
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := zeroObjectID + " refs/heads/master\n"; len(lines) != 1 || lines[0] != want {
+		t.Errorf("want %q, got %q", want, lines)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+// hideRefInterceptor drops a ref from the ref advertisement and the ls-refs
+// response.
+type hideRefInterceptor struct {
+	gptesting.NopInterceptor
+	ref string
+}
+
+func (h hideRefInterceptor) InfoRefsResponse(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	if c.Ref == h.ref {
+		return nil, nil
+	}
+	return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+}
+
+func (h hideRefInterceptor) ProtocolV2Response(c *gitprotocolio.ProtocolV2ResponseChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	if bytes.HasSuffix(bytes.TrimSuffix(c.Response, []byte("\n")), []byte(" "+h.ref)) {
+		return nil, nil
+	}
+	return []*gitprotocolio.ProtocolV2ResponseChunk{c}, nil
+}
+
+// rejectWantInterceptor rejects all want requests.
+type rejectWantInterceptor struct {
+	gptesting.NopInterceptor
+}
+
+func (rejectWantInterceptor) ProtocolV1UploadPackRequest(c *gitprotocolio.ProtocolV1UploadPackRequestChunk) ([]*gitprotocolio.ProtocolV1UploadPackRequestChunk, error) {
+	if c.WantObjectID != "" {
+		return nil, errors.New("want rejected")
+	}
+	return []*gitprotocolio.ProtocolV1UploadPackRequestChunk{c}, nil
+}
+
+func (rejectWantInterceptor) ProtocolV2Request(c *gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	if bytes.HasPrefix(c.Argument, []byte("want ")) {
+		return nil, errors.New("want rejected")
+	}
+	return []*gitprotocolio.ProtocolV2RequestChunk{c}, nil
+}
+
+func TestInterceptor_hideRef(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", "master:secret"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want, err := r.run("ls-remote", httpServerURL, "HEAD", "refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+		Interceptors: []gptesting.InterceptorFactory{func(*http.Request) gptesting.Interceptor {
+			return hideRefInterceptor{ref: "refs/heads/secret"}
+		}},
+	}))
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		if got, err := r.run(append(args, "ls-remote", s.URL)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestInterceptor_rejectWant(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+		Interceptors: []gptesting.InterceptorFactory{func(*http.Request) gptesting.Interceptor {
+			return rejectWantInterceptor{}
+		}},
+	}))
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		_, err := r.run(append(args, "clone", s.URL, "cloned")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+		} else if !strings.Contains(err.Error(), "want rejected") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+func TestObjectFormat_pushAndFetch(t *testing.T) {
+	for transport, url := range map[string]string{
+		"HTTP": httpProxyURL,
+		"SSH":  sshServerURL,
+		"Git":  gitDaemonProxyURL,
+	} {
+		for name, p := range objectFormatParams() {
+			name = transport + " " + name
+			refreshRemoteWithObjectFormat(p.objectFormat)
+			r := createLocalGitRepoWithObjectFormat(p.objectFormat)
+			defer r.close()
+
+			if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+				t.Fatal(err)
+			}
+			want, err := r.run("rev-parse", "master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(strings.TrimSuffix(want, "\n")); n != gitprotocolio.ObjectIDLength(p.objectFormat) {
+				t.Fatalf("%s: want a %s object ID, got %s", name, p.objectFormat, want)
+			}
+			if _, err := r.run(append(p.args, "push", url, "master:master")...); err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+
+			fr := createLocalGitRepoWithObjectFormat(p.objectFormat)
+			defer fr.close()
+			if _, err := fr.run(append(p.args, "fetch", url, "master")...); err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if got, err := fr.run("rev-parse", "FETCH_HEAD"); err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if got != want {
+				t.Errorf("%s: want %s, got %s", name, want, got)
+			}
+		}
+	}
+}
+
+func TestObjectFormat_mismatch(t *testing.T) {
+	sha1OID := strings.Repeat("1", 40)
+	sha256OID := strings.Repeat("2", 64)
+	for _, tc := range []struct {
+		name       string
+		advertised string
+		caps       []string
+		oid        string
+		wantErr    bool
+	}{
+		{"SHA-1 by default", "", []string{"ofs-delta"}, sha1OID, false},
+		{"SHA-256 not negotiated", "", []string{"ofs-delta"}, sha256OID, true},
+		{"SHA-256 requested", "", []string{"object-format=sha256"}, sha256OID, false},
+		{"SHA-256 advertised", "sha256", []string{"ofs-delta"}, sha256OID, false},
+		{"SHA-1 in SHA-256", "sha256", []string{"ofs-delta"}, sha1OID, true},
+		{"format mismatch", "sha256", []string{"object-format=sha1"}, sha1OID, true},
+		{"unknown format", "", []string{"object-format=md5"}, sha1OID, true},
+	} {
+		var buf bytes.Buffer
+		for _, c := range []*gitprotocolio.ProtocolV1UploadPackRequestChunk{
+			{WantObjectID: tc.oid, Capabilities: tc.caps},
+			{EndOneRound: true},
+			{HaveObjectID: tc.oid},
+			{NoMoreNegotiation: true},
+		} {
+			buf.Write(c.EncodeToPktLine())
+		}
+		sc := gitprotocolio.NewProtocolV1UploadPackRequest(&buf)
+		sc.EnableObjectFormatValidation(tc.advertised)
+		for sc.Scan() {
+		}
+		var fe *gitprotocolio.ObjectFormatError
+		if err := sc.Err(); tc.wantErr && !errors.As(err, &fe) {
+			t.Errorf("%s: want an ObjectFormatError, got %v", tc.name, err)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestObjectFormat_proxy(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{ObjectFormatValidation: true}))
+	defer s.Close()
+	// The protocol v0/v1 upload-pack requests are checked against the ref
+	// advertisement.
+	resp, err := http.Get(s.URL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha256OID := strings.Repeat("2", 64)
+	for _, tc := range []struct {
+		name        string
+		service     string
+		gitProtocol string
+		chunks      []gitprotocolio.Packet
+	}{
+		{
+			name:    "upload-pack",
+			service: "git-upload-pack",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{
+					WantObjectID: sha256OID,
+					Capabilities: []string{"ofs-delta"},
+				},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+			},
+		},
+		{
+			name:        "protocol v2 fetch",
+			service:     "git-upload-pack",
+			gitProtocol: "version=2",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV2FetchRequestChunk{Command: "fetch"},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{Capability: "object-format=sha1"},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{EndCapability: true},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{WantObjectID: sha256OID},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{NoMoreNegotiation: true},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{EndArgument: true},
+			},
+		},
+		{
+			name:    "receive-pack",
+			service: "git-receive-pack",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+					OldObjectID:  zeroObjectID,
+					NewObjectID:  sha256OID,
+					RefName:      "refs/heads/master",
+					Capabilities: []string{"report-status", "object-format=sha1"},
+				},
+				&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true},
+			},
+		},
+	} {
+		req, err := http.NewRequest(http.MethodPost, s.URL+"/"+tc.service, encodePackets(tc.chunks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-"+tc.service+"-request")
+		if tc.gitProtocol != "" {
+			req.Header.Set("Git-Protocol", tc.gitProtocol)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "error: object ID length mismatch"
+		sc := gitprotocolio.NewPacketScanner(resp.Body)
+		if sc.Scan() {
+			t.Errorf("%s: want an error, got %#v", tc.name, sc.Packet())
+		} else if sc.Err() == nil || !strings.HasPrefix(sc.Err().Error(), want) {
+			t.Errorf("%s: want %q, got %v", tc.name, want, sc.Err())
+		}
+		resp.Body.Close()
+	}
+}
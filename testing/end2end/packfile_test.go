@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// createDeltaRepo creates a repository with two versions of a file, so that
+// git-pack-objects stores one of them as a delta.
+func createDeltaRepo(t *testing.T, objectFormat string) gitRepo {
+	r := createLocalGitRepoWithObjectFormat(objectFormat)
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	for _, last := range []string{"first", "second"} {
+		content := strings.Join(append(lines, last), "\n") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(string(r), "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("add", "file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("commit", "-m", last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func packObjects(t *testing.T, r gitRepo, arg ...string) []byte {
+	out, err := r.runWithStdin(strings.NewReader("HEAD\n"), append([]string{"pack-objects", "--stdout", "--revs", "-q"}, arg...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(out)
+}
+
+func scanPackFile(bs []byte, objectFormat string) ([]*gitprotocolio.PackFileObject, error) {
+	s := gitprotocolio.NewPackFileScanner(bytes.NewReader(bs), objectFormat)
+	var objs []*gitprotocolio.PackFileObject
+	for s.Scan() {
+		obj := s.Object()
+		data, err := ioutil.ReadAll(s.Reader())
+		if err != nil {
+			return objs, err
+		}
+		obj.Data = data
+		objs = append(objs, obj)
+	}
+	if err := s.Err(); err != nil {
+		return objs, err
+	}
+	if len(objs) != int(s.NumObjects()) {
+		return objs, fmt.Errorf("want %d objects, got %d", s.NumObjects(), len(objs))
+	}
+	return objs, nil
+}
+
+func TestPackFileScanner(t *testing.T) {
+	for name, objectFormat := range map[string]string{"SHA-1": "sha1", "SHA-256": "sha256"} {
+		t.Run(name, func(t *testing.T) {
+			r := createDeltaRepo(t, objectFormat)
+			defer r.close()
+			out, err := r.run("rev-list", "--objects", "--all")
+			if err != nil {
+				t.Fatal(err)
+			}
+			oids := map[string]bool{}
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				oids[strings.Fields(line)[0]] = true
+			}
+
+			objs, err := scanPackFile(packObjects(t, r, "--delta-base-offset"), objectFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets := map[int64]bool{}
+			ofsDelta := false
+			for _, obj := range objs {
+				if obj.Type == gitprotocolio.ObjectOfsDelta {
+					ofsDelta = true
+					if !offsets[obj.BaseOffset] {
+						t.Errorf("ofs-delta at %d: no object at the base offset %d", obj.Offset, obj.BaseOffset)
+					}
+				}
+				offsets[obj.Offset] = true
+			}
+			if !ofsDelta {
+				t.Error("want an ofs-delta object")
+			}
+
+			objs, err = scanPackFile(packObjects(t, r), objectFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refDelta := false
+			for _, obj := range objs {
+				if obj.Type == gitprotocolio.ObjectRefDelta {
+					refDelta = true
+					if !oids[obj.BaseObjectID] {
+						t.Errorf("ref-delta at %d: unknown base object %q", obj.Offset, obj.BaseObjectID)
+					}
+				}
+			}
+			if !refDelta {
+				t.Error("want a ref-delta object")
+			}
+		})
+	}
+}
+
+func TestPackFileScanner_badTrailer(t *testing.T) {
+	r := createDeltaRepo(t, "sha1")
+	defer r.close()
+	pack := packObjects(t, r)
+
+	corrupted := append([]byte(nil), pack...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	var se gitprotocolio.SyntaxError
+	if _, err := scanPackFile(corrupted, "sha1"); !errors.As(err, &se) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("corrupted trailer: want a checksum mismatch, got %v", err)
+	}
+	if _, err := scanPackFile(pack[:len(pack)-1], "sha1"); !errors.As(err, &se) {
+		t.Errorf("truncated trailer: want a SyntaxError, got %v", err)
+	}
+	// The ref-delta base object IDs are read with the SHA-256 length.
+	if _, err := scanPackFile(pack, "sha256"); err == nil {
+		t.Error("object format mismatch: want an error")
+	}
+}
+
+// rawPackFile returns a pack file of one blob entry with the size in the header
+// and the content.
+func rawPackFile(size byte, content []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+	buf.WriteByte(byte(gitprotocolio.ObjectBlob)<<4 | size)
+	zw := zlib.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func TestPackFileScanner_sizeMismatch(t *testing.T) {
+	// A zlib bomb: the content is much larger than the size in the header.
+	bomb := rawPackFile(1, make([]byte, 64<<20))
+	for _, tc := range []struct {
+		name string
+		pack []byte
+	}{
+		{"larger content", bomb},
+		{"smaller content", rawPackFile(10, []byte("x"))},
+	} {
+		// The scanner fails whether the content is read or not.
+		if _, err := scanPackFile(tc.pack, "sha1"); err == nil || !strings.Contains(err.Error(), "size mismatch") {
+			t.Errorf("%s: want a size mismatch, got %v", tc.name, err)
+		}
+		s := gitprotocolio.NewPackFileScanner(bytes.NewReader(tc.pack), "sha1")
+		for s.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(s.Err(), &se) || !strings.Contains(se.Error(), "size mismatch") {
+			t.Errorf("%s: want a size mismatch, got %v", tc.name, s.Err())
+		}
+	}
+
+	if _, err := scanPackFile(rawPackFile(1, []byte("x")), "sha1"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestPackFileWriter(t *testing.T) {
+	for name, objectFormat := range map[string]string{"SHA-1": "sha1", "SHA-256": "sha256"} {
+		t.Run(name, func(t *testing.T) {
+			testPackFileWriter(t, objectFormat)
+		})
+	}
+}
+
+func testPackFileWriter(t *testing.T, objectFormat string) {
+	r := createLocalGitRepoWithObjectFormat(objectFormat)
+	defer r.close()
+	hashObject := func(typ gitprotocolio.ObjectType, data []byte) string {
+		return gitprotocolio.HashObject(typ, data, objectFormat)
+	}
+
+	// A git-bomb style pack: a huge blob that compresses well, and trees
+	// that refer to the same objects many times.
+	base := []byte("hello\n")
+	baseOID := hashObject(gitprotocolio.ObjectBlob, base)
+	huge := make([]byte, 16<<20)
+	hugeOID := hashObject(gitprotocolio.ObjectBlob, huge)
+	tree1 := &gitprotocolio.TreeObject{}
+	for i := 0; i < 1000; i++ {
+		tree1.Entries = append(tree1.Entries, &gitprotocolio.TreeEntry{Mode: gitprotocolio.TreeModeFile, Name: fmt.Sprintf("f%04d", i), ObjectID: baseOID})
+	}
+	tree1.Entries = append(tree1.Entries, &gitprotocolio.TreeEntry{Mode: gitprotocolio.TreeModeFile, Name: "huge", ObjectID: hugeOID})
+	tree1Data, err := tree1.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree1OID := hashObject(gitprotocolio.ObjectTree, tree1Data)
+	tree2 := &gitprotocolio.TreeObject{}
+	for i := 0; i < 100; i++ {
+		tree2.Entries = append(tree2.Entries, &gitprotocolio.TreeEntry{Mode: gitprotocolio.TreeModeTree, Name: fmt.Sprintf("d%03d", i), ObjectID: tree1OID})
+	}
+	tree2Data, err := tree2.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree2OID := hashObject(gitprotocolio.ObjectTree, tree2Data)
+	commit := (&gitprotocolio.CommitObject{
+		TreeObjectID: tree2OID,
+		Author:       "A <a@example.com> 0 +0000",
+		Committer:    "A <a@example.com> 0 +0000",
+		Message:      "bomb\n",
+	}).Encode()
+	commitOID := hashObject(gitprotocolio.ObjectCommit, commit)
+	tag := (&gitprotocolio.TagObject{
+		ObjectID:   commitOID,
+		ObjectType: gitprotocolio.ObjectCommit,
+		Name:       "v1",
+		Tagger:     "A <a@example.com> 0 +0000",
+		Message:    "v1\n",
+	}).Encode()
+
+	// "hello\n" + "world\n": copy 6 bytes from offset 0, and insert
+	// "world\n".
+	ofsDelta := append([]byte{6, 12, 0x90, 6, 6}, "world\n"...)
+	// "hello\n" + "there\n".
+	refDelta := append([]byte{6, 12, 0x90, 6, 6}, "there\n"...)
+
+	want := []string{
+		baseOID,
+		hashObject(gitprotocolio.ObjectBlob, []byte("hello\nworld\n")),
+		hashObject(gitprotocolio.ObjectBlob, []byte("hello\nthere\n")),
+		hugeOID,
+		tree1OID,
+		tree2OID,
+		commitOID,
+		hashObject(gitprotocolio.ObjectTag, tag),
+	}
+	sort.Strings(want)
+
+	var buf bytes.Buffer
+	pw, err := gitprotocolio.NewPackFileWriter(&buf, uint32(len(want)), objectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseOffset, err := pw.WriteObject(&gitprotocolio.PackFileObject{Type: gitprotocolio.ObjectBlob, Data: base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range []*gitprotocolio.PackFileObject{
+		{Type: gitprotocolio.ObjectOfsDelta, BaseOffset: baseOffset, Data: ofsDelta},
+		{Type: gitprotocolio.ObjectRefDelta, BaseObjectID: baseOID, Data: refDelta},
+		{Type: gitprotocolio.ObjectBlob, Data: huge},
+		{Type: gitprotocolio.ObjectTree, Data: tree1Data},
+		{Type: gitprotocolio.ObjectTree, Data: tree2Data},
+		{Type: gitprotocolio.ObjectCommit, Data: commit},
+		{Type: gitprotocolio.ObjectTag, Data: tag},
+	} {
+		if _, err := pw.WriteObject(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scanner reads the same objects back.
+	objs, err := scanPackFile(buf.Bytes(), objectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs[3].Data) != len(huge) {
+		t.Errorf("want the huge blob of %d bytes, got %d", len(huge), len(objs[3].Data))
+	}
+
+	packFile := filepath.Join(string(r), "test.pack")
+	if err := ioutil.WriteFile(packFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("index-pack", "--strict", "--object-format="+objectFormat, packFile); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ioutil.ReadFile(filepath.Join(string(r), "test.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := r.runWithStdin(bytes.NewReader(idx), "show-index", "--object-format="+objectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		got = append(got, strings.Fields(line)[1])
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("want objects %v, got %v", want, got)
+	}
+}
+
+func TestTreeObject_order(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	blobOID := gitprotocolio.HashObject(gitprotocolio.ObjectBlob, nil, "")
+	treeOID := gitprotocolio.HashObject(gitprotocolio.ObjectTree, nil, "")
+	tree := &gitprotocolio.TreeObject{Entries: []*gitprotocolio.TreeEntry{
+		{Mode: gitprotocolio.TreeModeFile, Name: "a.b", ObjectID: blobOID},
+		{Mode: gitprotocolio.TreeModeTree, Name: "a", ObjectID: treeOID},
+		{Mode: gitprotocolio.TreeModeExecutable, Name: "a0", ObjectID: blobOID},
+	}}
+	data, err := tree.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// git-mktree sorts the entries in the git order.
+	out, err := r.runWithStdin(strings.NewReader(fmt.Sprintf("100644 blob %s\ta.b\n040000 tree %s\ta\n100755 blob %s\ta0\n", blobOID, treeOID, blobOID)), "mktree", "--missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gitprotocolio.HashObject(gitprotocolio.ObjectTree, data, ""), strings.TrimSpace(out); got != want {
+		t.Errorf("want the tree %s, got %s", want, got)
+	}
+
+	tree.Entries = append(tree.Entries, &gitprotocolio.TreeEntry{Mode: gitprotocolio.TreeModeFile, Name: "a/b", ObjectID: blobOID})
+	if _, err := tree.Encode(); err == nil {
+		t.Error("want an error for a name with a slash")
+	}
+}
+
+func TestPackFileWriter_objectCount(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := gitprotocolio.NewPackFileWriter(&buf, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.WriteObject(&gitprotocolio.PackFileObject{Type: gitprotocolio.ObjectBlob, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err == nil {
+		t.Error("want an error for a missing object")
+	}
+}
@@ -21,3 +21,52 @@ func protocolParams() map[string][]string {
 		"Protocol V2": []string{"-c", "protocol.version=2"},
 	}
 }
+
+type objectFormatParam struct {
+	objectFormat string
+	args         []string
+}
+
+// objectFormatParams returns protocolParams for each object format of the
+// repositories (SHA-1 and SHA-256).
+func objectFormatParams() map[string]objectFormatParam {
+	m := map[string]objectFormatParam{}
+	for formatName, format := range map[string]string{
+		"SHA-1":   "sha1",
+		"SHA-256": "sha256",
+	} {
+		for name, args := range protocolParams() {
+			m[formatName+" "+name] = objectFormatParam{format, args}
+		}
+	}
+	return m
+}
+
+type bidiParam struct {
+	url  string
+	args []string
+}
+
+// bidiParams returns protocolParams for each bidi transport (SSH and Git
+// wire).
+func bidiParams() map[string]bidiParam {
+	m := map[string]bidiParam{}
+	for transport, url := range map[string]string{
+		"SSH": sshServerURL,
+		"Git": gitDaemonProxyURL,
+	} {
+		for name, args := range protocolParams() {
+			m[transport+" "+name] = bidiParam{url, args}
+		}
+	}
+	return m
+}
+
+// clientParams returns the protocol versions that client.Client requests.
+func clientParams() map[string]int {
+	return map[string]int{
+		"Protocol V0": 0,
+		"Protocol V1": 1,
+		"Protocol V2": 2,
+	}
+}
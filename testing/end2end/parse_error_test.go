@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestParseError_position(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []gitprotocolio.Packet{
+		gitprotocolio.BytesPacket("# service=git-upload-pack\n"),
+		gitprotocolio.FlushPacket{},
+		// The first ref must have the capabilities after NUL.
+		gitprotocolio.BytesPacket(zeroObjectID + " HEAD\n"),
+	} {
+		buf.Write(p.EncodeToPktLine())
+	}
+	// "001e# service=git-upload-pack\n" and "0000".
+	wantOffset := int64(30 + 4)
+
+	sc := gitprotocolio.NewInfoRefsResponse(&buf)
+	for sc.Scan() {
+	}
+	var pe *gitprotocolio.ParseError
+	if !errors.As(sc.Err(), &pe) {
+		t.Fatalf("want a ParseError, got %#v", sc.Err())
+	}
+	if pe.Scanner != "InfoRefsResponse" {
+		t.Errorf("want InfoRefsResponse, got %s", pe.Scanner)
+	}
+	if pe.PacketNumber != 3 {
+		t.Errorf("want packet 3, got %d", pe.PacketNumber)
+	}
+	if pe.Offset != wantOffset {
+		t.Errorf("want offset %d, got %d", wantOffset, pe.Offset)
+	}
+	if want := gitprotocolio.BytesPacket(zeroObjectID + " HEAD\n"); !reflect.DeepEqual(pe.Packet, want) {
+		t.Errorf("want %#v, got %#v", want, pe.Packet)
+	}
+	var se gitprotocolio.SyntaxError
+	if !errors.As(sc.Err(), &se) {
+		t.Errorf("want a SyntaxError, got %#v", sc.Err())
+	}
+}
+
+func TestParseError_earlyEOF(t *testing.T) {
+	var buf bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV2FetchRequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{WantObjectID: zeroObjectID},
+	} {
+		buf.Write(c.EncodeToPktLine())
+	}
+	size := int64(buf.Len())
+
+	sc := gitprotocolio.NewProtocolV2FetchRequest(&buf)
+	for sc.Scan() {
+	}
+	var pe *gitprotocolio.ParseError
+	if !errors.As(sc.Err(), &pe) {
+		t.Fatalf("want a ParseError, got %#v", sc.Err())
+	}
+	// The underlying ProtocolV2Request finds the early EOF, but the error
+	// names the scanner that the caller reads from.
+	if pe.Scanner != "ProtocolV2FetchRequest" || pe.PacketNumber != 4 || pe.Offset != size || pe.Packet != nil {
+		t.Errorf("want EOF of ProtocolV2FetchRequest after 3 packets, got %+v", pe)
+	}
+}
+
+func TestParseError_server(t *testing.T) {
+	refreshRemote()
+
+	var buf bytes.Buffer
+	buf.Write(gitprotocolio.BytesPacket("want\n").EncodeToPktLine())
+	resp, err := http.Post(strings.TrimSuffix(goServerURL, "/")+"/git-upload-pack", "application/x-git-upload-pack-request", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	sc := gitprotocolio.NewPacketScanner(resp.Body)
+	if sc.Scan() {
+		t.Errorf("want an error, got %#v", sc.Packet())
+	} else if want := "ProtocolV1UploadPackRequest state 0, packet 1 at offset 0"; sc.Err() == nil || !strings.Contains(sc.Err().Error(), want) {
+		t.Errorf("want %q, got %v", want, sc.Err())
+	}
+}
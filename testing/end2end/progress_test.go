@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/client"
+)
+
+func TestProgressParser(t *testing.T) {
+	var got []*gitprotocolio.ProgressMessage
+	p := gitprotocolio.NewProgressParser(func(m *gitprotocolio.ProgressMessage) {
+		got = append(got, m)
+	})
+	// Split the messages at arbitrary points like sideband packets.
+	for _, chunk := range []string{
+		"Enumerating objects: 20, done.\n",
+		"Counting objects:  45% (9/20)\rCounting",
+		" objects: 100% (20/20), done.   \n",
+		"Receiving objects:  50% (10/20), 1.00 MiB | 2.00 MiB/s\r",
+		"Total 20 (delta 3), reused 0 (delta 0), pack-reused 0\n",
+		"remote: Total 20 (delta 3), reused 5 (delta 1), pack-reused 12 (from 2)\n",
+		"remote: hello from hook\n\n",
+		// Hook messages that look like a meter up to the number.
+		"error: 1 commit rejected\n",
+		"remote: warning: 3 files too large\n",
+		"remote: Resolving deltas:   0% (0/3)\r",
+		"Resolving deltas: 100% (3/3), completed with 2 local objects.\n",
+		"unterminated",
+	} {
+		p.Write([]byte(chunk))
+	}
+	p.Flush()
+
+	want := []*gitprotocolio.ProgressMessage{
+		{
+			Text:     "Enumerating objects: 20, done.",
+			Progress: &gitprotocolio.Progress{Phase: "Enumerating objects", Current: 20, Done: true},
+		},
+		{
+			Text:      "Counting objects:  45% (9/20)",
+			Transient: true,
+			Progress:  &gitprotocolio.Progress{Phase: "Counting objects", Percent: 45, Current: 9, Total: 20},
+		},
+		{
+			Text:     "Counting objects: 100% (20/20), done.",
+			Progress: &gitprotocolio.Progress{Phase: "Counting objects", Percent: 100, Current: 20, Total: 20, Done: true},
+		},
+		{
+			Text:      "Receiving objects:  50% (10/20), 1.00 MiB | 2.00 MiB/s",
+			Transient: true,
+			Progress:  &gitprotocolio.Progress{Phase: "Receiving objects", Percent: 50, Current: 10, Total: 20, Transferred: "1.00 MiB", Rate: "2.00 MiB/s"},
+		},
+		{
+			Text:        "Total 20 (delta 3), reused 0 (delta 0), pack-reused 0",
+			PackSummary: &gitprotocolio.PackSummary{Objects: 20, Deltas: 3},
+		},
+		{
+			Text:        "Total 20 (delta 3), reused 5 (delta 1), pack-reused 12 (from 2)",
+			Remote:      true,
+			PackSummary: &gitprotocolio.PackSummary{Objects: 20, Deltas: 3, Reused: 5, ReusedDeltas: 1, PackReused: 12, PackReusedFrom: 2},
+		},
+		{
+			Text:   "hello from hook",
+			Remote: true,
+		},
+		{
+			Text: "error: 1 commit rejected",
+		},
+		{
+			Text:   "warning: 3 files too large",
+			Remote: true,
+		},
+		{
+			Text:      "Resolving deltas:   0% (0/3)",
+			Remote:    true,
+			Transient: true,
+			Progress:  &gitprotocolio.Progress{Phase: "Resolving deltas", Current: 0, Total: 3},
+		},
+		{
+			Text:     "Resolving deltas: 100% (3/3), completed with 2 local objects.",
+			Progress: &gitprotocolio.Progress{Phase: "Resolving deltas", Percent: 100, Current: 3, Total: 3, Done: true},
+		},
+		{
+			Text: "unterminated",
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d messages, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("want %+v, got %+v", want[i], got[i])
+		}
+	}
+}
+
+func TestProgressParser_fetch(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, version := range clientParams() {
+		var summary *gitprotocolio.PackSummary
+		p := gitprotocolio.NewProgressParser(func(m *gitprotocolio.ProgressMessage) {
+			if m.PackSummary != nil {
+				summary = m.PackSummary
+			}
+		})
+		c := &client.Client{ProtocolVersion: version}
+		result, err := c.Fetch(context.Background(), httpServerURL, &client.FetchRequest{
+			Wants:    []string{strings.TrimSuffix(want, "\n")},
+			Progress: p,
+		})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		ioutil.ReadAll(result.Pack)
+		result.Pack.Close()
+		p.Flush()
+		// A commit and an empty tree.
+		if summary == nil || summary.Objects != 2 {
+			t.Errorf("%s: want a summary of 2 objects, got %+v", name, summary)
+		}
+	}
+}
+
+func TestProgressParser_hookMessage(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	refreshRemote()
+	if err := os.MkdirAll(filepath.Join(string(remoteGitRepo), "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(remoteGitRepo), "hooks", "pre-receive"), []byte("#!/bin/sh\necho hello from hook\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.run("push", "--progress", httpProxyURL, "master:master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hookMessage, writing bool
+	p := gitprotocolio.NewProgressParser(func(m *gitprotocolio.ProgressMessage) {
+		if m.Remote && m.Text == "hello from hook" {
+			hookMessage = true
+		}
+		if m.Progress != nil && m.Progress.Phase == "Writing objects" && m.Progress.Done {
+			writing = true
+		}
+	})
+	p.Write([]byte(out))
+	p.Flush()
+	if !hookMessage {
+		t.Errorf("want the hook message, got %q", out)
+	}
+	if !writing {
+		t.Errorf("want the progress of writing objects, got %q", out)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+// newPushACLProxy returns a proxy with acl. The returned counter is the number
+// of the git-receive-pack requests sent to the delegate.
+func newPushACLProxy(acl *gptesting.PushACL) (*httptest.Server, *int32) {
+	var count int32
+	delegate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+			atomic.AddInt32(&count, 1)
+		}
+		gptesting.HTTPProxyHandler(httpServerURL).ServeHTTP(w, r)
+	})
+	delegateServer := httptest.NewServer(delegate)
+	proxy := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(delegateServer.URL, gptesting.HTTPProxyOptions{Authorizer: acl}))
+	proxy.Config.RegisterOnShutdown(delegateServer.Close)
+	return proxy, &count
+}
+
+func TestPushACL_rejectAll(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, count := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true},
+		},
+	})
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		refreshRemote()
+		atomic.StoreInt32(count, 0)
+		_, err := r.run(append(args, "push", s.URL, "master:refs/tags/v1", "master:refs/changes/1")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "[remote rejected] master -> v1 (permission denied)") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+		if got := atomic.LoadInt32(count); got != 0 {
+			t.Errorf("%s: want no request to the delegate, got %d", name, got)
+		}
+		if got, err := remoteGitRepo.run("for-each-ref"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != "" {
+			t.Errorf("%s: want no ref, got %s", name, got)
+		}
+	}
+}
+
+func TestPushACL_partialReject(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true},
+		},
+	})
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		refreshRemote()
+		_, err := r.run(append(args, "push", s.URL, "master:refs/tags/v1", "master:master")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "[remote rejected] master -> v1 (permission denied)") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+		if got, err := remoteGitRepo.run("rev-parse", "master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+		if _, err := remoteGitRepo.run("rev-parse", "--verify", "refs/tags/v1"); err == nil {
+			t.Errorf("%s: want no refs/tags/v1", name)
+		}
+	}
+}
+
+func TestPushACL_forceUpdateAndDelete(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true, AllowUpdate: true},
+		},
+		IsFastForward: func(_ *http.Request, oldObjectID, newObjectID string) (bool, error) {
+			// The client repository has all the objects.
+			_, err := r.run("merge-base", "--is-ancestor", oldObjectID, newObjectID)
+			return err == nil, nil
+		},
+	})
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		refreshRemote()
+		if _, err := r.run(append(args, "push", s.URL, "master~1:refs/heads/feature")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := r.run(append(args, "push", s.URL, "master:refs/heads/feature")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		_, err := r.run(append(args, "push", "--force", s.URL, "master~1:refs/heads/feature")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+		} else if !strings.Contains(err.Error(), "(force update not allowed)") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+		_, err = r.run(append(args, "push", s.URL, ":refs/heads/feature")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+		} else if !strings.Contains(err.Error(), "(delete not allowed)") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+	}
+}
+
+func TestPushACL_pushOptions(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true},
+		},
+		AllowedPushOptions: []string{"topic"},
+	})
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		refreshRemote()
+		if _, err := r.run(append(args, "push", "--push-option=topic=foo", s.URL, "master:refs/heads/a")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		_, err := r.run(append(args, "push", "--push-option=skip-ci", s.URL, "master:refs/heads/b")...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+		} else if !strings.Contains(err.Error(), "(push option not allowed: skip-ci)") {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+	}
+}
+
+func TestPushACL_signedPushOptions(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true},
+		},
+		AllowedPushOptions: []string{"topic"},
+	})
+	defer s.Close()
+
+	// The push options are read from the certificate, which is followed
+	// by its own flush packet and the unsigned push options.
+	refreshRemote()
+	if _, err := r.run("push", "--signed", "--push-option=topic=foo", s.URL, "master:refs/heads/a"); err != nil {
+		t.Error(err)
+	}
+	_, err := r.run("push", "--signed", "--push-option=skip-ci", s.URL, "master:refs/heads/b")
+	if err == nil {
+		t.Error("want an error, got nothing")
+	} else if !strings.Contains(err.Error(), "(push option not allowed: skip-ci)") {
+		t.Errorf("want a rejection, got %v", err)
+	}
+}
+
+func TestPushACL_reportStatus(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	oid, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid = strings.TrimSpace(oid)
+
+	s, _ := newPushACLProxy(&gptesting.PushACL{
+		Rules: []*gptesting.PushACLRule{
+			{RefPrefix: "refs/heads/", AllowCreate: true},
+		},
+	})
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name       string
+		refs       []string
+		wantUnpack string
+		wantRefs   []string
+	}{
+		{"partial", []string{"refs/heads/a", "refs/tags/v1", "refs/heads/b", "refs/tags/v2"}, "ok", []string{"ok refs/heads/a", "ng refs/tags/v1", "ok refs/heads/b", "ng refs/tags/v2"}},
+		{"all", []string{"refs/tags/v1", "refs/tags/v2"}, "permission denied", []string{"ng refs/tags/v1", "ng refs/tags/v2"}},
+	} {
+		// The objects exist in the delegate, so the pack is empty.
+		var body bytes.Buffer
+		for i, ref := range tc.refs {
+			c := &gitprotocolio.ProtocolV1ReceivePackRequestChunk{OldObjectID: zeroObjectID, NewObjectID: oid, RefName: ref}
+			if i == 0 {
+				c.Capabilities = []string{"report-status"}
+			}
+			body.Write(c.EncodeToPktLine())
+		}
+		body.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+		pw, err := gitprotocolio.NewPackFileWriter(&body, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Post(s.URL+"/git-receive-pack", "application/x-git-receive-pack-request", &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		sc := gitprotocolio.NewProtocolV1ReceivePackResponse(resp.Body)
+		var unpack string
+		var refs []string
+		for sc.Scan() {
+			c := sc.Chunk()
+			if c.UnpackStatus != "" {
+				unpack = c.UnpackStatus
+			}
+			if c.RefUpdateStatus != "" {
+				refs = append(refs, c.RefUpdateStatus+" "+c.RefName)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if unpack != tc.wantUnpack {
+			t.Errorf("%s: want unpack %q, got %q", tc.name, tc.wantUnpack, unpack)
+		}
+		if !reflect.DeepEqual(refs, tc.wantRefs) {
+			t.Errorf("%s: want the statuses %v, got %v", tc.name, tc.wantRefs, refs)
+		}
+	}
+}
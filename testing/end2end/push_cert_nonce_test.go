@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio/pushcert"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+func TestPushCertNonce_proxy(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		now      = time.Now()
+		step     time.Duration
+		statuses []pushcert.NonceStatus
+	)
+	policy := &gptesting.PushCertNoncePolicy{
+		Issuer: &pushcert.NonceIssuer{
+			Seed:      "proxynonce",
+			SlopLimit: 10 * time.Minute,
+			Now: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				now = now.Add(step)
+				return now
+			},
+		},
+		CheckNonce: func(_ *http.Request, status pushcert.NonceStatus, slop time.Duration) error {
+			mu.Lock()
+			defer mu.Unlock()
+			statuses = append(statuses, status)
+			if status != pushcert.NonceOK {
+				return fmt.Errorf("push-cert nonce %s (slop %v)", status, slop)
+			}
+			return nil
+		},
+	}
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+		Interceptors: []gptesting.InterceptorFactory{policy.Interceptor},
+	}))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name       string
+		step       time.Duration
+		wantStatus pushcert.NonceStatus
+	}{
+		{"fresh", 0, pushcert.NonceOK},
+		{"within the slop window", 5 * time.Minute, pushcert.NonceOK},
+		{"stale", time.Hour, pushcert.NonceSlop},
+	} {
+		refreshRemote()
+		// The delegate doesn't issue nonces.
+		if _, err := remoteGitRepo.run("config", "--unset", "receive.certNonceSeed"); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		step = tc.step
+		statuses = nil
+		mu.Unlock()
+
+		_, err := r.run("push", "--signed", s.URL, "master:master")
+		if tc.wantStatus == pushcert.NonceOK && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if tc.wantStatus != pushcert.NonceOK {
+			if err == nil {
+				t.Errorf("%s: want an error", tc.name)
+			} else if want := "push-cert nonce " + tc.wantStatus.String(); !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: want %q, got %v", tc.name, want, err)
+			}
+		}
+		mu.Lock()
+		if len(statuses) != 1 || statuses[0] != tc.wantStatus {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.wantStatus, statuses)
+		}
+		mu.Unlock()
+	}
+
+	refreshRemote()
+	if _, err := remoteGitRepo.run("config", "--unset", "receive.certNonceSeed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", "--signed", httpServerURL, "master:master"); err == nil {
+		t.Error("want an error for a signed push to a server that doesn't issue nonces")
+	}
+}
+
+func TestPushCertNonce_check(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	issuer := &pushcert.NonceIssuer{
+		Seed:      "seed",
+		SlopLimit: time.Minute,
+		Now:       func() time.Time { return now },
+	}
+	nonce := issuer.Issue("/repo")
+	if want := pushcert.GenerateNonce("seed", "/repo", now, ""); nonce != want {
+		t.Errorf("want %q, got %q", want, nonce)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		issuer    *pushcert.NonceIssuer
+		path      string
+		nonce     string
+		wantState pushcert.NonceStatus
+		wantSlop  time.Duration
+	}{
+		{"same second", issuer, "/repo", nonce, pushcert.NonceOK, 0},
+		{"within the slop window", issuer, "/repo", pushcert.GenerateNonce("seed", "/repo", now.Add(-30*time.Second), ""), pushcert.NonceOK, 30 * time.Second},
+		{"from a server ahead", issuer, "/repo", pushcert.GenerateNonce("seed", "/repo", now.Add(30*time.Second), ""), pushcert.NonceOK, -30 * time.Second},
+		{"stale", issuer, "/repo", pushcert.GenerateNonce("seed", "/repo", now.Add(-2*time.Minute), ""), pushcert.NonceSlop, 2 * time.Minute},
+		{"another repository", issuer, "/another", nonce, pushcert.NonceBad, 0},
+		{"another seed", issuer, "/repo", pushcert.GenerateNonce("another", "/repo", now, ""), pushcert.NonceBad, 0},
+		{"malformed", issuer, "/repo", "nonce", pushcert.NonceBad, 0},
+		{"missing", issuer, "/repo", "", pushcert.NonceMissing, 0},
+		{"unsolicited", &pushcert.NonceIssuer{}, "/repo", nonce, pushcert.NonceUnsolicited, 0},
+		{"no slop window", &pushcert.NonceIssuer{Seed: "seed", Now: issuer.Now}, "/repo", pushcert.GenerateNonce("seed", "/repo", now.Add(-time.Second), ""), pushcert.NonceSlop, time.Second},
+	} {
+		status, slop := tc.issuer.Check(tc.path, tc.nonce)
+		if status != tc.wantState || slop != tc.wantSlop {
+			t.Errorf("%s: want %v and %v, got %v and %v", tc.name, tc.wantState, tc.wantSlop, status, slop)
+		}
+	}
+}
@@ -15,11 +15,15 @@
 package end2end
 
 import (
+	"context"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/google/gitprotocolio/client"
 )
 
 func TestPush(t *testing.T) {
@@ -214,3 +218,68 @@ func TestPush_GPGSign(t *testing.T) {
 		}
 	}
 }
+
+func TestPush_protocolV2(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("-c", "protocol.version=2", "push", httpProxyURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := remoteGitRepo.run("rev-parse", "master"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	// git doesn't send "version=2" for a push. Send it to all the requests
+	// of a push.
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	oldOID := strings.TrimSuffix(want, "\n")
+	newOID, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := r.runWithStdin(strings.NewReader(newOID+"^"+oldOID+"\n"), "pack-objects", "--stdout", "--revs", "-q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOID = strings.TrimSuffix(newOID, "\n")
+	c := &client.Client{HTTPClient: &http.Client{Transport: protocolV2Transport{}}}
+	result, err := c.Push(context.Background(), httpProxyURL, &client.PushRequest{
+		Commands: []*client.PushCommand{
+			{RefName: "refs/heads/master", OldObjectID: oldOID, NewObjectID: newOID},
+		},
+		Pack: strings.NewReader(pack),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UnpackStatus != "ok" || len(result.RefStatuses) != 1 || !result.RefStatuses[0].OK {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	if got, err := remoteGitRepo.run("rev-parse", "master"); err != nil {
+		t.Fatal(err)
+	} else if got != newOID+"\n" {
+		t.Errorf("want %s, got %s", newOID, got)
+	}
+}
+
+// protocolV2Transport sets "Git-Protocol: version=2" to the requests.
+type protocolV2Transport struct{}
+
+func (protocolV2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Git-Protocol", "version=2")
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/pushcert"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+// recordPushCertInterceptor records the push certificate chunks of the
+// receive-pack requests.
+type recordPushCertInterceptor struct {
+	gptesting.NopInterceptor
+	mu     *sync.Mutex
+	chunks *[]*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+}
+
+func (i recordPushCertInterceptor) ProtocolV1ReceivePackRequest(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) ([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk, error) {
+	if c.PackStream == nil {
+		i.mu.Lock()
+		*i.chunks = append(*i.chunks, c)
+		i.mu.Unlock()
+	}
+	return []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{c}, nil
+}
+
+// gpgKeyRing signs and verifies the push certificates with gpg and the keys in
+// the GnuPG home directory.
+type gpgKeyRing string
+
+func (home gpgKeyRing) SignDetached(payload []byte) ([]byte, error) {
+	cmd := exec.Command("gpg", "--homedir", string(home), "--batch", "--armor", "--detach-sign")
+	cmd.Stdin = bytes.NewReader(payload)
+	return cmd.Output()
+}
+
+func (home gpgKeyRing) VerifyDetached(payload, signature []byte) (string, error) {
+	f, err := ioutil.TempFile("", "gitprotocolio_signature")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(signature)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("gpg", "--homedir", string(home), "--batch", "--status-fd=1", "--verify", f.Name(), "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg cannot verify the signature: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// "[GNUPG:] GOODSIG <key ID> <user ID>"
+		if ss := strings.SplitN(line, " ", 4); len(ss) == 4 && ss[0] == "[GNUPG:]" && ss[1] == "GOODSIG" {
+			return ss[3], nil
+		}
+	}
+	return "", errors.New("no good signature")
+}
+
+func TestPushCert_verify(t *testing.T) {
+	refreshRemote()
+	var (
+		mu     sync.Mutex
+		chunks []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	)
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+		Interceptors: []gptesting.InterceptorFactory{func(*http.Request) gptesting.Interceptor {
+			return recordPushCertInterceptor{mu: &mu, chunks: &chunks}
+		}},
+	}))
+	defer s.Close()
+
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	newOID, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", "--signed", "--push-option=opt", s.URL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	cert, err := pushcert.FromChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cert.Pusher, "local root <local-root@example.com> ") {
+		t.Errorf("unexpected pusher: %q", cert.Pusher)
+	}
+	if want := []string{"opt"}; len(cert.PushOptions) != 1 || cert.PushOptions[0] != want[0] {
+		t.Errorf("want push options %v, got %v", want, cert.PushOptions)
+	}
+	if _, err := cert.Verify(gpgKeyRing(gnuPGHome)); err != nil {
+		t.Errorf("cannot verify the signature: %v", err)
+	}
+	// git-http-backend runs git-receive-pack in the repository with ".".
+	if _, err := pushcert.CheckNonce("testnonce", ".", cert.Nonce); err != nil {
+		t.Errorf("cannot check the nonce %q: %v", cert.Nonce, err)
+	}
+	want := []*pushcert.Command{{
+		OldObjectID: zeroObjectID,
+		NewObjectID: strings.TrimSuffix(newOID, "\n"),
+		RefName:     "refs/heads/master",
+	}}
+	if err := cert.CheckCommands(want); err != nil {
+		t.Error(err)
+	}
+	if err := cert.CheckCommands(append(want, &pushcert.Command{OldObjectID: zeroObjectID, NewObjectID: zeroObjectID, RefName: "refs/heads/another"})); err == nil {
+		t.Error("want an error for a command that is not signed")
+	}
+
+	// Tampering the certificate invalidates the signature.
+	cert.Commands[0].RefName = "refs/heads/another"
+	if _, err := cert.Verify(gpgKeyRing(gnuPGHome)); err == nil {
+		t.Error("want an error for a tampered certificate")
+	}
+}
+
+func TestPushCert_generate(t *testing.T) {
+	signer := gpgKeyRing(gnuPGHome)
+	emptyHome, err := ioutil.TempDir("", "gitprotocolio_gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyHome)
+	now := time.Now()
+	cert := &pushcert.Certificate{
+		Pusher:      "local root <local-root@example.com> 1500000000 +0000",
+		Pushee:      "https://example.com/repo",
+		Nonce:       pushcert.GenerateNonce("seed", "/repo", now, ""),
+		PushOptions: []string{"a", "b"},
+		Commands: []*pushcert.Command{{
+			OldObjectID: zeroObjectID,
+			NewObjectID: strings.Repeat("1", 40),
+			RefName:     "refs/heads/master",
+		}},
+	}
+	if err := cert.Sign(signer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Round-trip through the wire format.
+	var buf bytes.Buffer
+	for _, c := range cert.Chunks([]string{"report-status"}) {
+		buf.Write(c.EncodeToPktLine())
+	}
+	buf.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true}).EncodeToPktLine())
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	sc := gitprotocolio.NewProtocolV1ReceivePackRequest(&buf)
+	for sc.Scan() {
+		chunks = append(chunks, sc.Chunk())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pushcert.FromChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != cert.String() {
+		t.Errorf("want %q, got %q", cert.String(), got.String())
+	}
+	if id, err := got.Verify(signer); err != nil {
+		t.Errorf("cannot verify the signature: %v", err)
+	} else if want := "local root <local-root@example.com>"; id != want {
+		t.Errorf("want the signer %q, got %q", want, id)
+	}
+	if _, err := got.Verify(gpgKeyRing(emptyHome)); err == nil {
+		t.Error("want an error for an unknown signer")
+	}
+
+	stamp, err := pushcert.CheckNonce("seed", "/repo", got.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp.Unix() != now.Unix() {
+		t.Errorf("want %v, got %v", now.Unix(), stamp.Unix())
+	}
+	if _, err := pushcert.CheckNonce("seed", "/another", got.Nonce); err == nil {
+		t.Error("want an error for a nonce of another repository")
+	}
+	if _, err := pushcert.CheckNonce("another", "/repo", got.Nonce); err == nil {
+		t.Error("want an error for a nonce of another seed")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+func newRefVisibilityProxy(prefixes ...string) *httptest.Server {
+	policy := &gptesting.RefVisibilityPolicy{
+		DelegateURL: httpServerURL,
+		IsHidden:    gptesting.HideRefPrefixes(prefixes...),
+	}
+	return httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+		Interceptors: []gptesting.InterceptorFactory{policy.Interceptor},
+	}))
+}
+
+func TestRefVisibility_lsRemote(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", "master:refs/internal/secret"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want, err := r.run("ls-remote", httpServerURL, "HEAD", "refs/heads/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRefVisibilityProxy("refs/internal/")
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		if got, err := r.run(append(args, "ls-remote", s.URL)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestRefVisibility_hiddenFirstRef(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// HEAD is the first ref, and it has the capabilities.
+	s := newRefVisibilityProxy("HEAD")
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "clone", s.URL, "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("-C", "cloned", "rev-parse", "origin/master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestRefVisibility_rejectHiddenWant(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=secret"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = strings.TrimSuffix(secret, "\n")
+	if _, err := r.run("push", httpServerURL, "master:refs/internal/secret"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	remoteGitRepo.run("config", "uploadpack.allowAnySHA1InWant", "1")
+
+	s := newRefVisibilityProxy("refs/internal/")
+	defer s.Close()
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		_, err := r.run(append(args, "fetch", s.URL, secret)...)
+		if err == nil {
+			t.Errorf("%s: want an error, got nothing", name)
+		} else if !strings.Contains(err.Error(), "not our ref "+secret) {
+			t.Errorf("%s: want a rejection, got %v", name, err)
+		}
+	}
+
+	// git-fetch doesn't send want-ref. Send it directly.
+	var buf bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV2FetchRequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{WantRef: "refs/internal/secret"},
+		{NoMoreNegotiation: true},
+		{EndArgument: true},
+	} {
+		buf.Write(c.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", s.URL+"/git-upload-pack", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	sc := gitprotocolio.NewPacketScanner(resp.Body)
+	if sc.Scan() {
+		t.Errorf("want an error, got %#v", sc.Packet())
+	} else if want := "error: unknown ref refs/internal/secret"; sc.Err() == nil || sc.Err().Error() != want {
+		t.Errorf("want %q, got %v", want, sc.Err())
+	}
+}
+
+func TestRefVisibility_lookUpOnce(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=secret"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = strings.TrimSuffix(secret, "\n")
+	if _, err := r.run("push", httpServerURL, "master:refs/internal/secret"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	remoteGitRepo.run("config", "uploadpack.allowAnySHA1InWant", "1")
+
+	var lookups int32
+	lookupServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		gptesting.HTTPProxyHandler(httpServerURL).ServeHTTP(w, r)
+	}))
+	defer lookupServer.Close()
+
+	for _, tc := range []struct {
+		protocolVersion string
+		want            int32
+	}{
+		// The refs are taken from the relayed ref advertisement.
+		{"0", 0},
+		// The protocol v2 ref advertisement has no refs, so the refs
+		// are looked up for the first fetch only.
+		{"2", 1},
+	} {
+		atomic.StoreInt32(&lookups, 0)
+		policy := &gptesting.RefVisibilityPolicy{
+			DelegateURL: lookupServer.URL,
+			IsHidden:    gptesting.HideRefPrefixes("refs/internal/"),
+		}
+		s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{
+			Interceptors: []gptesting.InterceptorFactory{policy.Interceptor},
+		}))
+		defer s.Close()
+		for i := 0; i < 2; i++ {
+			r := createLocalGitRepo()
+			defer r.close()
+			if _, err := r.run("-c", "protocol.version="+tc.protocolVersion, "fetch", s.URL, secret); err == nil || !strings.Contains(err.Error(), "not our ref "+secret) {
+				t.Errorf("protocol v%s: want a rejection, got %v", tc.protocolVersion, err)
+			}
+		}
+		if got := atomic.LoadInt32(&lookups); got != tc.want {
+			t.Errorf("protocol v%s: want %d lookups, got %d", tc.protocolVersion, tc.want, got)
+		}
+	}
+}
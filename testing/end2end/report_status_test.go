@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+func TestReportStatusV2_options(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	newOID, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOID = strings.TrimSuffix(newOID, "\n")
+
+	// The delegate reports that refs/for/master is stored as
+	// refs/changes/1, like a proc-receive hook does.
+	var report bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{
+		{UnpackStatus: "ok"},
+		{RefUpdateStatus: "ok", RefName: "refs/for/master"},
+		{OptionRefName: "refs/changes/1"},
+		{OptionOldObjectID: zeroObjectID},
+		{OptionNewObjectID: newOID},
+		{EndOfResponse: true},
+	} {
+		report.Write(c.EncodeToPktLine())
+	}
+	delegate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, "/git-receive-pack") {
+			gptesting.HTTPProxyHandler(httpServerURL).ServeHTTP(w, req)
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		w.Write(gitprotocolio.SideBandMainPacket(report.Bytes()).EncodeToPktLine())
+		w.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+	}))
+	defer delegate.Close()
+	proxy := httptest.NewServer(gptesting.HTTPProxyHandler(delegate.URL))
+	defer proxy.Close()
+
+	for name, args := range protocolParams() {
+		out, err := r.run(append(args, "push", "--porcelain", proxy.URL, "master:refs/for/master")...)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if want := "refs/heads/master:refs/changes/1"; !strings.Contains(out, want) {
+			t.Errorf("%s: want %s, got %s", name, want, out)
+		}
+	}
+}
+
+func TestReportStatus_relayedOnce(t *testing.T) {
+	var report bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{
+		{UnpackStatus: "ok"},
+		{RefUpdateStatus: "ok", RefName: "refs/heads/master"},
+		{EndOfResponse: true},
+	} {
+		report.Write(c.EncodeToPktLine())
+	}
+	delegate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		sbw := gitprotocolio.NewSideBandWriter(w, gitprotocolio.SideBand64kMaxPacketSize)
+		io.WriteString(sbw.Progress(), "progress\n")
+		sbw.Main().Write(report.Bytes())
+		sbw.Close()
+	}))
+	defer delegate.Close()
+	proxy := httptest.NewServer(gptesting.HTTPProxyHandler(delegate.URL))
+	defer proxy.Close()
+
+	var req bytes.Buffer
+	for _, c := range []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{
+			OldObjectID:  zeroObjectID,
+			NewObjectID:  zeroObjectID,
+			RefName:      "refs/heads/master",
+			Capabilities: []string{"report-status", "side-band-64k"},
+		},
+		{EndOfCommands: true},
+	} {
+		req.Write(c.EncodeToPktLine())
+	}
+	resp, err := http.Post(proxy.URL+"/git-receive-pack", "application/x-git-receive-pack-request", &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The main stream must be relayed once, not as both the re-encoded
+	// report-status and the original packet.
+	var progress bytes.Buffer
+	main, err := ioutil.ReadAll(gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(resp.Body), gitprotocolio.SideBand64kMaxPacketSize, func(bs []byte) {
+		progress.Write(bs)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(main, report.Bytes()) {
+		t.Errorf("want %q, got %q", report.String(), string(main))
+	}
+	if progress.String() != "progress\n" {
+		t.Errorf("want the progress message once, got %q", progress.String())
+	}
+}
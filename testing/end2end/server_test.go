@@ -0,0 +1,313 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestServer_lsRemote(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("tag", "--annotate", "--message=tag", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", "v1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want, err := r.run("ls-remote", httpServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range protocolParams() {
+		if got, err := r.run(append(args, "ls-remote", goServerURL)...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestServer_clone(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, args := range protocolParams() {
+		r = createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "clone", goServerURL, "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("-C", "cloned", "rev-parse", "origin/master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestServer_incrementalFetch(t *testing.T) {
+	for name, args := range protocolParams() {
+		refreshRemote()
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		local := createLocalGitRepo()
+		defer local.close()
+		if _, err := local.run(append(args, "pull", goServerURL, "master")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := local.run("commit", "--allow-empty", "--message=local"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+			t.Fatal(err)
+		}
+		want, err := r.run("rev-parse", "master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := local.run(append(args, "fetch", goServerURL, "master")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := local.run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestServer_push(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range protocolParams() {
+		refreshRemote()
+		if _, err := r.run(append(args, "push", goServerURL, "master:master", "master:another")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := r.run("ls-remote", httpServerURL, "refs/heads/master"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != strings.TrimSuffix(want, "\n")+"\trefs/heads/master\n" {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+		if _, err := r.run(append(args, "push", goServerURL, ":another")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestServer_nonFastForwardReject(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	refreshRemote()
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	r = createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=another"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("fetch", httpServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range protocolParams() {
+		if _, err := r.run(append(args, "push", "--force", goServerURL, "master:master")...); err == nil {
+			t.Errorf("%s: want error, got nothing", name)
+			continue
+		} else if cmderr, ok := err.(*commandError); !ok {
+			t.Errorf("%s: want commandError, got %v", name, err)
+			continue
+		} else if !strings.Contains(cmderr.output, "non-fast-forward") {
+			t.Errorf("%s: want a non-fastforward error, got %v", name, err)
+			continue
+		}
+	}
+}
+
+// postServer sends the packets to the service of the Go server, and returns
+// the response body.
+func postServer(t *testing.T, service, gitProtocol string, packets ...gitprotocolio.Packet) string {
+	req, err := http.NewRequest(http.MethodPost, goServerURL+service, encodePackets(packets...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	if gitProtocol != "" {
+		req.Header.Set("Git-Protocol", gitProtocol)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestServer_invalidRequest(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	oid, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid = strings.TrimSpace(oid)
+	sha256OID := strings.Repeat("0", 64)
+
+	for _, tc := range []struct {
+		name        string
+		service     string
+		gitProtocol string
+		packets     []gitprotocolio.Packet
+		want        string
+	}{
+		{"v1 revision as a have", "git-upload-pack", "", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("want " + oid + " multi_ack_detailed\n"),
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.BytesPacket("have HEAD\n"),
+			gitprotocolio.BytesPacket("done\n"),
+		}, "invalid object ID"},
+		{"v1 SHA-256 have", "git-upload-pack", "", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("want " + oid + " multi_ack_detailed\n"),
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.BytesPacket("have " + sha256OID + "\n"),
+			gitprotocolio.BytesPacket("done\n"),
+		}, "object ID length mismatch"},
+		{"v2 revision as a have", "git-upload-pack", "version=2", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=fetch"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.BytesPacket("want " + oid + "\n"),
+			gitprotocolio.BytesPacket("have master~1\n"),
+			gitprotocolio.BytesPacket("done\n"),
+			gitprotocolio.FlushPacket{},
+		}, "invalid object ID"},
+		{"invalid ref name", "git-receive-pack", "", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket(oid + " " + zeroObjectID + " refs/heads/a..b\x00report-status\n"),
+			gitprotocolio.FlushPacket{},
+		}, "invalid ref name"},
+	} {
+		got := postServer(t, tc.service, tc.gitProtocol, tc.packets...)
+		if !strings.Contains(got, "ERR ") || !strings.Contains(got, tc.want) {
+			t.Errorf("%s: want an error packet with %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestServer_multiAckDetailed(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	oid, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid = strings.TrimSpace(oid)
+
+	for _, tc := range []struct {
+		caps string
+		want string
+	}{
+		{" multi_ack_detailed", "ACK " + oid + " common\n"},
+		{"", ""},
+	} {
+		resp := gitprotocolio.NewProtocolV1UploadPackResponse(strings.NewReader(postServer(t, "git-upload-pack", "",
+			gitprotocolio.BytesPacket("want "+oid+tc.caps+"\n"),
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.BytesPacket("have "+oid+"\n"),
+			gitprotocolio.FlushPacket{},
+		)))
+		var got string
+		for resp.Scan() {
+			if c := resp.Chunk(); c.AckObjectID != "" {
+				got += string(c.EncodeToPktLine()[4:])
+			}
+		}
+		if err := resp.Err(); err != nil {
+			t.Errorf("%q: %v", tc.caps, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want ACKs %q, got %q", tc.caps, tc.want, got)
+		}
+	}
+}
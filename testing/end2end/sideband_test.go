@@ -0,0 +1,227 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func encodePackets(packets ...gitprotocolio.Packet) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, p := range packets {
+		buf.Write(p.EncodeToPktLine())
+	}
+	return &buf
+}
+
+func TestSideBandReader(t *testing.T) {
+	large := strings.Repeat("x", gitprotocolio.SideBandMaxPacketSize-5)
+	for _, tc := range []struct {
+		name          string
+		input         *bytes.Buffer
+		maxPacketSize int
+		want          string
+		wantProgress  string
+		wantErr       func(error) bool
+	}{
+		{
+			name: "demultiplex",
+			input: encodePackets(
+				gitprotocolio.SideBandMainPacket("main1\n"),
+				gitprotocolio.SideBandReportPacket("progress1\r"),
+				gitprotocolio.SideBandMainPacket("main2\n"),
+				gitprotocolio.SideBandReportPacket("progress2\n"),
+				gitprotocolio.FlushPacket{},
+				// Not read after the flush.
+				gitprotocolio.SideBandMainPacket("main3\n"),
+			),
+			maxPacketSize: gitprotocolio.SideBand64kMaxPacketSize,
+			want:          "main1\nmain2\n",
+			wantProgress:  "progress1\rprogress2\n",
+		},
+		{
+			name: "error",
+			input: encodePackets(
+				gitprotocolio.SideBandMainPacket("main1\n"),
+				gitprotocolio.SideBandErrorPacket("fatal"),
+				gitprotocolio.SideBandMainPacket("main2\n"),
+			),
+			maxPacketSize: gitprotocolio.SideBand64kMaxPacketSize,
+			want:          "main1\n",
+			wantErr: func(err error) bool {
+				var ep gitprotocolio.ErrorPacket
+				return errors.As(err, &ep) && ep == "fatal"
+			},
+		},
+		{
+			name: "side-band limit",
+			input: encodePackets(
+				gitprotocolio.SideBandMainPacket(large),
+				gitprotocolio.SideBandMainPacket(large+"x"),
+				gitprotocolio.FlushPacket{},
+			),
+			maxPacketSize: gitprotocolio.SideBandMaxPacketSize,
+			want:          large,
+			wantErr: func(err error) bool {
+				var se gitprotocolio.SyntaxError
+				return errors.As(err, &se)
+			},
+		},
+		{
+			name: "side-band-64k allows large packets",
+			input: encodePackets(
+				gitprotocolio.SideBandMainPacket(large+"x"),
+				gitprotocolio.FlushPacket{},
+			),
+			maxPacketSize: gitprotocolio.SideBand64kMaxPacketSize,
+			want:          large + "x",
+		},
+		{
+			name:          "unknown channel",
+			input:         encodePackets(gitprotocolio.BytesPacket("\x04data")),
+			maxPacketSize: gitprotocolio.SideBand64kMaxPacketSize,
+			wantErr: func(err error) bool {
+				var se gitprotocolio.SyntaxError
+				return errors.As(err, &se)
+			},
+		},
+		{
+			name:          "no flush",
+			input:         encodePackets(gitprotocolio.SideBandMainPacket("main1\n")),
+			maxPacketSize: gitprotocolio.SideBand64kMaxPacketSize,
+			want:          "main1\n",
+			wantErr: func(err error) bool {
+				return err == io.ErrUnexpectedEOF
+			},
+		},
+	} {
+		var progress bytes.Buffer
+		rd := gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(tc.input), tc.maxPacketSize, func(bs []byte) {
+			progress.Write(bs)
+		})
+		got, err := ioutil.ReadAll(rd)
+		if string(got) != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, string(got))
+		}
+		if progress.String() != tc.wantProgress {
+			t.Errorf("%s: want progress %q, got %q", tc.name, tc.wantProgress, progress.String())
+		}
+		if tc.wantErr == nil && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if tc.wantErr != nil && !tc.wantErr(err) {
+			t.Errorf("%s: unexpected error %#v", tc.name, err)
+		}
+	}
+}
+
+func TestSideBandWriter(t *testing.T) {
+	for _, maxPacketSize := range []int{gitprotocolio.SideBandMaxPacketSize, gitprotocolio.SideBand64kMaxPacketSize} {
+		var buf bytes.Buffer
+		w := gitprotocolio.NewSideBandWriter(&buf, maxPacketSize)
+		main := strings.Repeat("0123456789", 10000)
+		if _, err := io.WriteString(w.Main(), main); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w.Progress(), "progress\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w.Main(), "after close"); err == nil {
+			t.Errorf("%d: want an error for a write after Close", maxPacketSize)
+		}
+
+		// The main stream is split into full packets and a remainder.
+		var sizes []int
+		sc := gitprotocolio.NewPacketScanner(bytes.NewReader(buf.Bytes()))
+		for sc.Scan() {
+			if bp, ok := sc.Packet().(gitprotocolio.BytesPacket); ok && bp[0] == 1 {
+				sizes = append(sizes, len(bp)+4)
+			}
+		}
+		full := len(main) / (maxPacketSize - 5)
+		if len(sizes) != full+1 {
+			t.Errorf("%d: want %d packets, got %d", maxPacketSize, full+1, len(sizes))
+		}
+		for i, sz := range sizes {
+			if i < full && sz != maxPacketSize {
+				t.Errorf("%d: want a full packet, got %d bytes", maxPacketSize, sz)
+			}
+		}
+
+		var progress bytes.Buffer
+		rd := gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(&buf), maxPacketSize, func(bs []byte) {
+			progress.Write(bs)
+		})
+		got, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Errorf("%d: %v", maxPacketSize, err)
+		}
+		if string(got) != main {
+			t.Errorf("%d: the main stream doesn't match", maxPacketSize)
+		}
+		if progress.String() != "progress\n" {
+			t.Errorf("%d: want progress %q, got %q", maxPacketSize, "progress\n", progress.String())
+		}
+	}
+}
+
+func TestSideBandWriter_concurrent(t *testing.T) {
+	var buf bytes.Buffer
+	w := gitprotocolio.NewSideBandWriter(&buf, gitprotocolio.SideBandMaxPacketSize)
+	msg := strings.Repeat("x", 3000)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.WriteString(w.Main(), msg)
+		}()
+		go func() {
+			defer wg.Done()
+			io.WriteString(w.Progress(), "progress\n")
+		}()
+	}
+	wg.Wait()
+	io.WriteString(w.Error(), "fatal")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress bytes.Buffer
+	rd := gitprotocolio.NewSideBandReader(gitprotocolio.NewPacketScanner(&buf), gitprotocolio.SideBandMaxPacketSize, func(bs []byte) {
+		progress.Write(bs)
+	})
+	got, err := ioutil.ReadAll(rd)
+	if want := strings.Repeat(msg, 10); string(got) != want {
+		t.Errorf("want %d bytes of the main stream, got %d", len(want), len(got))
+	}
+	if want := strings.Repeat("progress\n", 10); progress.String() != want {
+		t.Errorf("want %q, got %q", want, progress.String())
+	}
+	if err != gitprotocolio.ErrorPacket("fatal") {
+		t.Errorf("want the error message, got %#v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	gptesting "github.com/google/gitprotocolio/testing"
+)
+
+func TestStrictValidation_checkRefName(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+
+	for _, refName := range []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/feature/x-1",
+		"refs/tags/v1.0",
+		"refs/heads/a..b",
+		"refs/heads/.hidden",
+		"refs/heads/master.lock",
+		"refs/heads/master.",
+		"refs/heads//master",
+		"/refs/heads/master",
+		"refs/heads/master/",
+		"refs/heads/a b",
+		"refs/heads/a\tb",
+		"refs/heads/a~1",
+		"refs/heads/a^",
+		"refs/heads/a:b",
+		"refs/heads/a?",
+		"refs/heads/a*",
+		"refs/heads/a[b",
+		"refs/heads/a\\b",
+		"refs/heads/a@{1}",
+		"@",
+	} {
+		_, gitErr := r.run("check-ref-format", "--allow-onelevel", refName)
+		err := gitprotocolio.CheckRefName(refName)
+		if (gitErr == nil) != (err == nil) {
+			t.Errorf("%q: git-check-ref-format returns %v, got %v", refName, gitErr, err)
+		}
+		var re *gitprotocolio.InvalidRefNameError
+		if err != nil && !errors.As(err, &re) {
+			t.Errorf("%q: want an InvalidRefNameError, got %#v", refName, err)
+		}
+	}
+}
+
+func TestStrictValidation_proxy(t *testing.T) {
+	refreshRemote()
+	s := httptest.NewServer(gptesting.HTTPProxyHandlerWithOptions(httpServerURL, gptesting.HTTPProxyOptions{StrictValidation: true}))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name        string
+		service     string
+		gitProtocol string
+		chunks      []gitprotocolio.Packet
+		want        string
+	}{
+		{
+			name:    "non-hex want",
+			service: "git-upload-pack",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{
+					WantObjectID: strings.Repeat("x", 40),
+					Capabilities: []string{"ofs-delta"},
+				},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+			},
+			want: "error: invalid object ID",
+		},
+		{
+			name:        "protocol v2 non-hex want",
+			service:     "git-upload-pack",
+			gitProtocol: "version=2",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV2FetchRequestChunk{Command: "fetch"},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{EndCapability: true},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{WantObjectID: strings.Repeat("x", 40)},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{NoMoreNegotiation: true},
+				&gitprotocolio.ProtocolV2FetchRequestChunk{EndArgument: true},
+			},
+			want: "error: invalid object ID",
+		},
+		{
+			name:    "invalid ref name",
+			service: "git-receive-pack",
+			chunks: []gitprotocolio.Packet{
+				&gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+					OldObjectID:  zeroObjectID,
+					NewObjectID:  zeroObjectID,
+					RefName:      "refs/heads/../../config",
+					Capabilities: []string{"report-status"},
+				},
+				&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true},
+			},
+			want: "error: invalid ref name",
+		},
+	} {
+		req, err := http.NewRequest(http.MethodPost, s.URL+"/"+tc.service, encodePackets(tc.chunks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-"+tc.service+"-request")
+		if tc.gitProtocol != "" {
+			req.Header.Set("Git-Protocol", tc.gitProtocol)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := gitprotocolio.NewPacketScanner(resp.Body)
+		if sc.Scan() {
+			t.Errorf("%s: want an error, got %#v", tc.name, sc.Packet())
+		} else if sc.Err() == nil || !strings.HasPrefix(sc.Err().Error(), tc.want) {
+			t.Errorf("%s: want %q, got %v", tc.name, tc.want, sc.Err())
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// trafficRecorder relays the requests to git-http-backend, and records the
+// bodies of the POST requests and their responses.
+type trafficRecorder struct {
+	mu        sync.Mutex
+	requests  [][]byte
+	responses [][]byte
+}
+
+func (rec *trafficRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gr
+	}
+	reqBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequest(r.Method, strings.TrimSuffix(httpServerURL, "/")+r.URL.RequestURI(), bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Accept-Encoding")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if r.Method == http.MethodPost {
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, reqBody)
+		rec.responses = append(rec.responses, respBody)
+		rec.mu.Unlock()
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
+
+// recordedTraffic is a pair of a recorded request and its response.
+type recordedTraffic struct {
+	request  []byte
+	response []byte
+}
+
+// allTraffic returns the recorded requests for the command, and their
+// responses.
+func (rec *trafficRecorder) allTraffic(command string) []recordedTraffic {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var ret []recordedTraffic
+	for i, req := range rec.requests {
+		// git sends some of the command lines without LF.
+		sc := gitprotocolio.NewPacketScanner(bytes.NewReader(req))
+		if !sc.Scan() {
+			continue
+		}
+		if bp, ok := sc.Packet().(gitprotocolio.BytesPacket); ok && strings.TrimSuffix(string(bp), "\n") == "command="+command {
+			ret = append(ret, recordedTraffic{req, rec.responses[i]})
+		}
+	}
+	return ret
+}
+
+// findTraffic returns the first recorded request for the command, and its
+// response.
+func (rec *trafficRecorder) findTraffic(t *testing.T, command string) ([]byte, []byte) {
+	if ts := rec.allTraffic(command); len(ts) != 0 {
+		return ts[0].request, ts[0].response
+	}
+	t.Fatalf("no %s request is recorded", command)
+	return nil, nil
+}
+
+func TestProtocolV2Request_responseEnd(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []gitprotocolio.Packet
+	}{
+		{"before a command", []gitprotocolio.Packet{
+			gitprotocolio.ResponseEndPacket{},
+			gitprotocolio.BytesPacket("command=ls-refs\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"between commands", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=ls-refs\n"),
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.ResponseEndPacket{},
+		}},
+	} {
+		sc := gitprotocolio.NewProtocolV2Request(encodePackets(tc.input...))
+		for sc.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+}
+
+func TestProtocolV2Response_responseEnd(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   []gitprotocolio.Packet
+		wantErr bool
+	}{
+		{"after a response", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("ok\n"),
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.ResponseEndPacket{},
+		}, false},
+		{"after an empty response", []gitprotocolio.Packet{
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.ResponseEndPacket{},
+		}, false},
+		{"before any content", []gitprotocolio.Packet{
+			gitprotocolio.ResponseEndPacket{},
+		}, true},
+		{"twice", []gitprotocolio.Packet{
+			gitprotocolio.FlushPacket{},
+			gitprotocolio.ResponseEndPacket{},
+			gitprotocolio.ResponseEndPacket{},
+		}, true},
+		{"in a response", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("ok\n"),
+			gitprotocolio.ResponseEndPacket{},
+		}, true},
+	} {
+		sc := gitprotocolio.NewProtocolV2Response(encodePackets(tc.input...))
+		n := 0
+		for sc.Scan() {
+			n++
+		}
+		if !tc.wantErr {
+			if sc.Err() != nil {
+				t.Errorf("%s: %v", tc.name, sc.Err())
+			}
+			if n != len(tc.input) {
+				t.Errorf("%s: want %d chunks, got %d", tc.name, len(tc.input), n)
+			}
+			continue
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestProtocolV2FetchRequest_capturedTraffic(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	for _, msg := range []string{"first", "second"} {
+		if _, err := r.run("commit", "--allow-empty", "--message="+msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.run("push", httpServerURL, "master~1:refs/heads/base", "master:refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &trafficRecorder{}
+	s := httptest.NewServer(rec)
+	defer s.Close()
+	// Each fetch starts from an empty repository, except for the unshallow
+	// fetch that sends the shallow lines and the haves.
+	for _, fetches := range [][][]string{
+		{{"--depth=1", "--filter=blob:none"}, {"--unshallow"}},
+		{{"--shallow-exclude=base"}},
+		{{"--shallow-since=2000-01-01"}},
+	} {
+		c := createLocalGitRepo()
+		defer c.close()
+		for _, args := range fetches {
+			args = append([]string{"-c", "protocol.version=2", "fetch"}, args...)
+			if _, err := c.run(append(args, s.URL, "master:refs/remotes/origin/master")...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var got gitprotocolio.ProtocolV2FetchRequestChunk
+	for _, tr := range rec.allTraffic("fetch") {
+		var buf bytes.Buffer
+		sc := gitprotocolio.NewProtocolV2FetchRequest(bytes.NewReader(tr.request))
+		for sc.Scan() {
+			c := sc.Chunk()
+			switch {
+			case c.WantObjectID != "":
+				got.WantObjectID = c.WantObjectID
+			case c.HaveObjectID != "":
+				got.HaveObjectID = c.HaveObjectID
+			case c.ShallowObjectID != "":
+				got.ShallowObjectID = c.ShallowObjectID
+			case c.DeepenDepth != 0:
+				got.DeepenDepth = c.DeepenDepth
+			case c.DeepenSince != 0:
+				got.DeepenSince = c.DeepenSince
+			case c.DeepenNotRef != "":
+				got.DeepenNotRef = c.DeepenNotRef
+			case c.FilterSpec != "":
+				got.FilterSpec = c.FilterSpec
+			case c.NoMoreNegotiation:
+				got.NoMoreNegotiation = true
+			}
+			buf.Write(c.EncodeToPktLine())
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v\nrequest: %q", err, tr.request)
+		}
+		if !bytes.Equal(buf.Bytes(), tr.request) {
+			t.Errorf("the request is not re-encoded byte-for-byte:\nwant %q\ngot  %q", tr.request, buf.Bytes())
+		}
+	}
+	if got.WantObjectID == "" || got.HaveObjectID == "" || got.ShallowObjectID == "" || !got.NoMoreNegotiation {
+		t.Errorf("want want, have, shallow, and done in the requests, got %#v", got)
+	}
+	if got.DeepenDepth == 0 || got.DeepenSince == 0 || got.DeepenNotRef != "base" || got.FilterSpec != "blob:none" {
+		t.Errorf("want deepen, deepen-since, deepen-not, and filter in the requests, got %#v", got)
+	}
+}
+
+func TestProtocolV2FetchRequest_malformed(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		arguments []string
+	}{
+		{"option after want", []string{"want " + zeroObjectID + "\n", "thin-pack"}},
+		{"want after have", []string{"have " + zeroObjectID + "\n", "want " + zeroObjectID + "\n"}},
+		{"argument after done", []string{"want " + zeroObjectID + "\n", "done\n", "have " + zeroObjectID + "\n"}},
+		{"deepen and deepen-since", []string{"deepen 1", "deepen-since 1500000000"}},
+		{"bad depth", []string{"deepen x"}},
+		{"bad deepen-since", []string{"deepen-since -1"}},
+		{"unknown argument", []string{"unknown"}},
+		{"want without object ID", []string{"want"}},
+	} {
+		packets := []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=fetch"),
+			gitprotocolio.DelimPacket{},
+		}
+		for _, arg := range tc.arguments {
+			packets = append(packets, gitprotocolio.BytesPacket(arg))
+		}
+		packets = append(packets, gitprotocolio.FlushPacket{})
+		sc := gitprotocolio.NewProtocolV2FetchRequest(encodePackets(packets...))
+		for sc.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+
+	sc := gitprotocolio.NewProtocolV2FetchRequest(encodePackets(
+		gitprotocolio.BytesPacket("command=ls-refs\n"),
+		gitprotocolio.FlushPacket{},
+	))
+	for sc.Scan() {
+	}
+	var se gitprotocolio.SyntaxError
+	if !errors.As(sc.Err(), &se) {
+		t.Errorf("another command: want a SyntaxError, got %v", sc.Err())
+	}
+}
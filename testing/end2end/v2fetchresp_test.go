@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestProtocolV2FetchResponse_capturedTraffic(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	for _, msg := range []string{"first", "second", "third"} {
+		if _, err := r.run("commit", "--allow-empty", "--message="+msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.run("push", httpServerURL, "master~1:refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &trafficRecorder{}
+	s := httptest.NewServer(rec)
+	defer s.Close()
+	c := createLocalGitRepo()
+	defer c.close()
+	// A shallow fetch has shallow-info, and the fetch after a new commit
+	// has acknowledgments.
+	if _, err := c.run("-c", "protocol.version=2", "fetch", "--depth=1", s.URL, "master:refs/remotes/origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.run("-c", "protocol.version=2", "fetch", "--unshallow", s.URL, "master:refs/remotes/origin/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	sections := map[string]bool{}
+	for _, tr := range rec.allTraffic("fetch") {
+		var buf bytes.Buffer
+		sc := gitprotocolio.NewProtocolV2FetchResponse(bytes.NewReader(tr.response))
+		sc.EnableStrictValidation()
+		for sc.Scan() {
+			c := sc.Chunk()
+			switch {
+			case c.StartOfAcknowledgments:
+				sections["acknowledgments"] = true
+			case c.StartOfShallowInfo:
+				sections["shallow-info"] = true
+			case c.StartOfPackfile:
+				sections["packfile"] = true
+			case c.AckObjectID != "":
+				sections["ACK"] = true
+			}
+			buf.Write(c.EncodeToPktLine())
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v\nresponse: %q", err, tr.response)
+		}
+		if !bytes.Equal(buf.Bytes(), tr.response) {
+			t.Errorf("the response is not re-encoded byte-for-byte:\nwant %q\ngot  %q", tr.response, buf.Bytes())
+		}
+	}
+	for _, section := range []string{"acknowledgments", "ACK", "shallow-info", "packfile"} {
+		if !sections[section] {
+			t.Errorf("want %s in the responses", section)
+		}
+	}
+}
+
+func TestProtocolV2FetchResponse_malformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []gitprotocolio.Packet
+	}{
+		{"ACK after NAK", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("acknowledgments\n"),
+			gitprotocolio.BytesPacket("NAK\n"),
+			gitprotocolio.BytesPacket("ACK " + zeroObjectID + "\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"NAK after ACK", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("acknowledgments\n"),
+			gitprotocolio.BytesPacket("ACK " + zeroObjectID + "\n"),
+			gitprotocolio.BytesPacket("NAK\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"ready after NAK", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("acknowledgments\n"),
+			gitprotocolio.BytesPacket("NAK\n"),
+			gitprotocolio.BytesPacket("ready\n"),
+			gitprotocolio.DelimPacket{},
+		}},
+		{"no section header", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("NAK\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"misordered sections", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("wanted-refs\n"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.BytesPacket("shallow-info\n"),
+		}},
+		{"bad shallow-info", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("shallow-info\n"),
+			gitprotocolio.BytesPacket("deepen " + zeroObjectID + "\n"),
+		}},
+		{"unknown sideband", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("packfile\n"),
+			gitprotocolio.BytesPacket("\x04data"),
+		}},
+		{"early EOF", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("packfile\n"),
+			gitprotocolio.SideBandMainPacket("PACK"),
+		}},
+	} {
+		sc := gitprotocolio.NewProtocolV2FetchResponse(encodePackets(tc.input...))
+		for sc.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestProtocolV2LsRefs_capturedTraffic(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("tag", "--annotate", "--message=v1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &trafficRecorder{}
+	s := httptest.NewServer(rec)
+	defer s.Close()
+	if _, err := r.run("-c", "protocol.version=2", "ls-remote", "--symref", s.URL); err != nil {
+		t.Fatal(err)
+	}
+	req, resp := rec.findTraffic(t, "ls-refs")
+	testProtocolV2LsRefsRequest(t, req)
+
+	var buf bytes.Buffer
+	refs := map[string]*gitprotocolio.ProtocolV2LsRefsResponseChunk{}
+	respScanner := gitprotocolio.NewProtocolV2LsRefsResponse(bytes.NewReader(resp))
+	respScanner.EnableStrictValidation()
+	for respScanner.Scan() {
+		if c := respScanner.Chunk(); c.RefName != "" {
+			refs[c.RefName] = c
+		}
+		buf.Write(respScanner.Chunk().EncodeToPktLine())
+	}
+	if err := respScanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), resp) {
+		t.Errorf("the response is not re-encoded byte-for-byte:\nwant %q\ngot  %q", resp, buf.Bytes())
+	}
+	if c, ok := refs["HEAD"]; !ok || c.SymrefTarget != "refs/heads/master" {
+		t.Errorf("want HEAD pointing to refs/heads/master, got %#v", c)
+	}
+	if c, ok := refs["refs/tags/v1"]; !ok || c.PeeledObjectID == "" {
+		t.Errorf("want refs/tags/v1 with the peeled object ID, got %#v", c)
+	}
+
+	// git-fetch sends the ref-prefixes of the refspecs.
+	rec = &trafficRecorder{}
+	s = httptest.NewServer(rec)
+	defer s.Close()
+	if _, err := r.run("-c", "protocol.version=2", "fetch", s.URL, "refs/tags/*:refs/tags/*"); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = rec.findTraffic(t, "ls-refs")
+	if chunks := testProtocolV2LsRefsRequest(t, req); !containsRefPrefix(chunks, "refs/tags/") {
+		t.Errorf("want the ref-prefix refs/tags/, got %q", req)
+	}
+}
+
+// testProtocolV2LsRefsRequest parses the request, and checks that the chunks
+// are re-encoded to the same bytes.
+func testProtocolV2LsRefsRequest(t *testing.T, req []byte) []*gitprotocolio.ProtocolV2LsRefsRequestChunk {
+	var buf bytes.Buffer
+	var chunks []*gitprotocolio.ProtocolV2LsRefsRequestChunk
+	sc := gitprotocolio.NewProtocolV2LsRefsRequest(bytes.NewReader(req))
+	for sc.Scan() {
+		chunks = append(chunks, sc.Chunk())
+		buf.Write(sc.Chunk().EncodeToPktLine())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), req) {
+		t.Errorf("the request is not re-encoded byte-for-byte:\nwant %q\ngot  %q", req, buf.Bytes())
+	}
+	return chunks
+}
+
+func containsRefPrefix(chunks []*gitprotocolio.ProtocolV2LsRefsRequestChunk, prefix string) bool {
+	for _, c := range chunks {
+		if c.RefPrefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProtocolV2LsRefsRequest_malformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []gitprotocolio.Packet
+	}{
+		{"another command", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=fetch\n"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.FlushPacket{},
+		}},
+		{"empty ref-prefix", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=ls-refs\n"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.BytesPacket("ref-prefix \n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"unknown argument", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=ls-refs\n"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.BytesPacket("want " + zeroObjectID + "\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"early EOF", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket("command=ls-refs\n"),
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.BytesPacket("peel\n"),
+		}},
+	} {
+		sc := gitprotocolio.NewProtocolV2LsRefsRequest(encodePackets(tc.input...))
+		for sc.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+}
+
+func TestProtocolV2LsRefsResponse_malformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []gitprotocolio.Packet
+	}{
+		{"no ref name", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket(zeroObjectID + "\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"unknown attribute", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket(zeroObjectID + " HEAD unknown:x\n"),
+			gitprotocolio.FlushPacket{},
+		}},
+		{"delimiter", []gitprotocolio.Packet{
+			gitprotocolio.DelimPacket{},
+			gitprotocolio.FlushPacket{},
+		}},
+		{"early EOF", []gitprotocolio.Packet{
+			gitprotocolio.BytesPacket(zeroObjectID + " HEAD\n"),
+		}},
+	} {
+		sc := gitprotocolio.NewProtocolV2LsRefsResponse(encodePackets(tc.input...))
+		for sc.Scan() {
+		}
+		var se gitprotocolio.SyntaxError
+		if !errors.As(sc.Err(), &se) {
+			t.Errorf("%s: want a SyntaxError, got %v", tc.name, sc.Err())
+		}
+	}
+}
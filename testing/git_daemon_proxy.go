@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+// GitDaemonProxy is a Git transport (git://) server that fronts git-daemon.
+// The traffic is parsed and re-encoded by gitprotocolio. A git-daemon process
+// is started in the inetd mode for each connection.
+type GitDaemonProxy struct {
+	// StrictValidation and ObjectFormatValidation are the validations of
+	// the client's requests like HTTPProxyOptions. They must be set before
+	// Serve.
+	StrictValidation       bool
+	ObjectFormatValidation bool
+
+	gitBinary string
+	gitDir    string
+}
+
+// NewGitDaemonProxy returns a GitDaemonProxy that serves the repositories
+// under gitDir.
+func NewGitDaemonProxy(gitBinary, gitDir string) *GitDaemonProxy {
+	return &GitDaemonProxy{gitBinary: gitBinary, gitDir: gitDir}
+}
+
+// Serve accepts incoming connections on the listener l.
+func (p *GitDaemonProxy) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+func (p *GitDaemonProxy) serveConn(conn net.Conn) {
+	defer conn.Close()
+	req, err := gitprotocolio.ReadGitProtocolConnectRequest(conn)
+	if err != nil {
+		writeParseError(conn, err, nil)
+		return
+	}
+	if req.Service != "git-upload-pack" && req.Service != "git-receive-pack" {
+		writePacket(conn, gitprotocolio.ErrorPacket("unknown service: "+req.Service))
+		return
+	}
+
+	cmd := exec.Command(p.gitBinary, "daemon", "--inetd", "--export-all", "--informative-errors", "--enable=receive-pack", "--base-path="+p.gitDir)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("cannot create a pipe: %v", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("cannot create a pipe: %v", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("cannot start git-daemon: %v", err)
+		return
+	}
+	defer cmd.Wait()
+
+	if err := writePacket(stdin, req); err != nil {
+		stdin.Close()
+		return
+	}
+	v := bidiValidation{strict: p.StrictValidation, objectFormat: p.ObjectFormatValidation}
+	proxyBidiService(conn, stdin, stdout, req.Service, isProtocolV2(strings.Join(req.ExtraParameters, ":")), v)
+}
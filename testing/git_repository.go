@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/google/gitprotocolio/server"
+)
+
+const zeroObjectID = "0000000000000000000000000000000000000000"
+
+// GitRepository is a server.Repository that is backed by the git plumbing
+// commands.
+type GitRepository struct {
+	gitBinary string
+	gitDir    string
+}
+
+// NewGitRepository returns a GitRepository for the repository at gitDir.
+func NewGitRepository(gitBinary, gitDir string) *GitRepository {
+	return &GitRepository{gitBinary: gitBinary, gitDir: gitDir}
+}
+
+// ListRefs implements server.Repository.
+func (g *GitRepository) ListRefs(ctx context.Context) ([]*server.Ref, error) {
+	var refs []*server.Ref
+	if target, err := g.run(ctx, "symbolic-ref", "HEAD"); err == nil {
+		if oid, err := g.run(ctx, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+			refs = append(refs, &server.Ref{Name: "HEAD", ObjectID: oid, SymrefTarget: target})
+		}
+	}
+	out, err := g.run(ctx, "for-each-ref", "--format=%(objectname) %(refname) %(*objectname)")
+	if err != nil {
+		return nil, err
+	}
+	if out == "" {
+		return refs, nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		ss := strings.Split(line, " ")
+		if len(ss) != 3 {
+			return nil, fmt.Errorf("unexpected for-each-ref output: %s", line)
+		}
+		refs = append(refs, &server.Ref{Name: ss[1], ObjectID: ss[0], PeeledObjectID: ss[2]})
+	}
+	return refs, nil
+}
+
+// HasObject implements server.Repository.
+func (g *GitRepository) HasObject(ctx context.Context, objectID string) (bool, error) {
+	_, err := g.run(ctx, "cat-file", "-e", objectID)
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return false, err
+}
+
+// WritePack implements server.Repository.
+func (g *GitRepository) WritePack(ctx context.Context, w io.Writer, req *server.PackRequest) error {
+	args := []string{"pack-objects", "--stdout", "--revs"}
+	if req.OfsDelta {
+		args = append(args, "--delta-base-offset")
+	}
+	if req.Progress != nil {
+		args = append(args, "--progress")
+	} else {
+		args = append(args, "-q")
+	}
+	var stdin bytes.Buffer
+	for _, oid := range req.Wants {
+		fmt.Fprintln(&stdin, oid)
+	}
+	for _, oid := range req.Haves {
+		fmt.Fprintln(&stdin, "^"+oid)
+	}
+	cmd := exec.CommandContext(ctx, g.gitBinary, args...)
+	cmd.Dir = g.gitDir
+	cmd.Stdin = &stdin
+	cmd.Stdout = w
+	if req.Progress != nil {
+		cmd.Stderr = req.Progress
+	}
+	return cmd.Run()
+}
+
+// UnpackObjects implements server.Repository.
+func (g *GitRepository) UnpackObjects(ctx context.Context, pack io.Reader) error {
+	cmd := exec.CommandContext(ctx, g.gitBinary, "unpack-objects", "-q")
+	cmd.Dir = g.gitDir
+	cmd.Stdin = pack
+	if bs, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bs)
+	}
+	return nil
+}
+
+// UpdateRef implements server.Repository. Non-fast-forward updates are
+// rejected.
+func (g *GitRepository) UpdateRef(ctx context.Context, update *server.RefUpdate) error {
+	if update.NewObjectID == zeroObjectID {
+		if _, err := g.run(ctx, "update-ref", "-d", update.RefName, update.OldObjectID); err != nil {
+			return errors.New("failed to delete")
+		}
+		return nil
+	}
+	if update.OldObjectID != zeroObjectID {
+		if _, err := g.run(ctx, "merge-base", "--is-ancestor", update.OldObjectID, update.NewObjectID); err != nil {
+			return errors.New("non-fast-forward")
+		}
+	}
+	if _, err := g.run(ctx, "update-ref", update.RefName, update.NewObjectID, update.OldObjectID); err != nil {
+		return errors.New("failed to update ref")
+	}
+	return nil
+}
+
+func (g *GitRepository) run(ctx context.Context, arg ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, g.gitBinary, arg...)
+	cmd.Dir = g.gitDir
+	bs, err := cmd.Output()
+	return strings.TrimSuffix(string(bs), "\n"), err
+}
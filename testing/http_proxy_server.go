@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"sync"
 
 	"github.com/google/gitprotocolio"
@@ -31,7 +32,33 @@ import (
 // HTTPProxyHandler returns an http.handler that delegates requests to the
 // provided URL.
 func HTTPProxyHandler(delegateURL string) http.Handler {
-	s := &httpProxyServer{delegateURL}
+	return HTTPProxyHandlerWithOptions(delegateURL, HTTPProxyOptions{})
+}
+
+// HTTPProxyOptions is the options of HTTPProxyHandlerWithOptions.
+type HTTPProxyOptions struct {
+	// Authorizer authorizes the pushes if not nil. The rejected updates
+	// are not sent to the delegate. If all updates are rejected, the proxy
+	// responds without sending a request to the delegate.
+	Authorizer PushAuthorizer
+	// Interceptors create the interceptors for each request. The chunks
+	// are passed through the interceptors in order.
+	Interceptors []InterceptorFactory
+	// StrictValidation rejects the requests with a malformed object ID or
+	// an invalid ref name before sending them to the delegate.
+	StrictValidation bool
+	// ObjectFormatValidation rejects the ref advertisements and the
+	// requests with an object ID that doesn't match the negotiated object
+	// format. The protocol v0/v1 upload-pack requests are checked against
+	// the last ref advertisement, since git doesn't send the object format
+	// with them.
+	ObjectFormatValidation bool
+}
+
+// HTTPProxyHandlerWithOptions returns an http.handler that delegates requests
+// to the provided URL with the options.
+func HTTPProxyHandlerWithOptions(delegateURL string, opts HTTPProxyOptions) http.Handler {
+	s := &httpProxyServer{delegateURL: delegateURL, opts: opts}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/info/refs", s.infoRefsHandler)
 	mux.HandleFunc("/git-upload-pack", s.uploadPackHandler)
@@ -41,6 +68,20 @@ func HTTPProxyHandler(delegateURL string) http.Handler {
 
 type httpProxyServer struct {
 	delegateURL string
+	opts        HTTPProxyOptions
+
+	mu sync.Mutex
+	// objectFormat is the object format of the last ref advertisement. It's
+	// empty until the first advertisement is relayed.
+	objectFormat string
+}
+
+// advertisedObjectFormat returns the object format of the last ref
+// advertisement, or an empty string if unknown.
+func (s *httpProxyServer) advertisedObjectFormat() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objectFormat
 }
 
 func (s *httpProxyServer) infoRefsHandler(w http.ResponseWriter, r *http.Request) {
@@ -56,7 +97,13 @@ func (s *httpProxyServer) infoRefsHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 	req.Header.Add("Accept", "*/*")
-	if proto := r.Header.Get("Git-Protocol"); proto == "version=2" || proto == "version=1" {
+	proto := r.Header.Get("Git-Protocol")
+	if proto == "version=2" && r.URL.Query().Get("service") == "git-receive-pack" {
+		// git-receive-pack doesn't support protocol v2. Like git,
+		// fall back to v0.
+		proto = ""
+	}
+	if proto == "version=2" || proto == "version=1" {
 		req.Header.Add("Git-Protocol", proto)
 	}
 
@@ -70,13 +117,24 @@ func (s *httpProxyServer) infoRefsHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	ic := newInterceptorChain(r, s.opts.Interceptors)
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", r.URL.Query().Get("service")))
 	infoRefsResp := gitprotocolio.NewInfoRefsResponse(resp.Body)
+	if s.opts.ObjectFormatValidation {
+		infoRefsResp.EnableObjectFormatValidation()
+	}
 	for infoRefsResp.Scan() {
-		if err := writePacket(w, infoRefsResp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+		chunks, err := ic.InfoRefsResponse(infoRefsResp.Chunk())
+		if err != nil {
+			writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 			return
 		}
+		for _, c := range chunks {
+			if err := writePacket(w, c); err != nil {
+				writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+				return
+			}
+		}
 	}
 
 	if err := infoRefsResp.Err(); err != nil {
@@ -88,6 +146,15 @@ func (s *httpProxyServer) infoRefsHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
+	if caps := infoRefsResp.Capabilities(); len(caps) != 0 {
+		objectFormat, ok := caps.Lookup("object-format")
+		if !ok {
+			objectFormat = gitprotocolio.ObjectFormatSHA1
+		}
+		s.mu.Lock()
+		s.objectFormat = objectFormat
+		s.mu.Unlock()
+	}
 }
 
 func (s *httpProxyServer) uploadPackHandler(w http.ResponseWriter, r *http.Request) {
@@ -105,29 +172,48 @@ func (s *httpProxyServer) uploadPackHandler(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
+	ic := newInterceptorChain(r, s.opts.Interceptors)
 	if r.Header.Get("Git-Protocol") == "version=2" {
-		serveProtocolV2(u, w, r)
+		s.uploadPackV2Handler(u, w, r, ic)
 		return
 	}
-	uploadPackV1Handler(u, w, r)
+	s.uploadPackV1Handler(u, w, r, ic)
 }
 
-func uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Request) {
+func (s *httpProxyServer) uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Request, ic Interceptor) {
 	pr, pw := io.Pipe()
 	go func() {
 		defer pw.Close()
 		v1Req := gitprotocolio.NewProtocolV1UploadPackRequest(r.Body)
+		if objectFormat := s.advertisedObjectFormat(); s.opts.ObjectFormatValidation && objectFormat != "" {
+			// Git doesn't send the "object-format" capability
+			// with the wants, so the object format comes from the
+			// ref advertisement.
+			v1Req.EnableObjectFormatValidation(objectFormat)
+		}
+		if s.opts.StrictValidation {
+			v1Req.EnableStrictValidation()
+		}
 
 		for v1Req.Scan() {
-			if err := writePacket(pw, v1Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+			chunks, err := ic.ProtocolV1UploadPackRequest(v1Req.Chunk())
+			if err != nil {
+				pw.CloseWithError(&rejectionError{err})
 				return
 			}
+			for _, c := range chunks {
+				if err := writePacket(pw, c); err != nil {
+					writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+					return
+				}
+			}
 		}
 
 		if err := v1Req.Err(); err != nil {
 			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
 				writePacket(pw, ep)
+			} else if isInvalidInput(err) {
+				pw.CloseWithError(&rejectionError{err})
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
 				log.Printf("Parsing error: %#v, parser: %#v", err, v1Req)
@@ -146,7 +232,7 @@ func uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Requ
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		http.Error(w, "cannot send a request to the delegate", http.StatusInternalServerError)
+		writeDelegateError(w, "git-upload-pack", err)
 		return
 	}
 	if resp.StatusCode != http.StatusOK {
@@ -157,10 +243,17 @@ func uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Requ
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
 	v1Resp := gitprotocolio.NewProtocolV1UploadPackResponse(resp.Body)
 	for v1Resp.Scan() {
-		if err := writePacket(w, v1Resp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+		chunks, err := ic.ProtocolV1UploadPackResponse(v1Resp.Chunk())
+		if err != nil {
+			writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 			return
 		}
+		for _, c := range chunks {
+			if err := writePacket(w, c); err != nil {
+				writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+				return
+			}
+		}
 	}
 
 	if err := v1Resp.Err(); err != nil {
@@ -189,22 +282,87 @@ func (s *httpProxyServer) receivePackHandler(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
-	if r.Header.Get("Git-Protocol") == "version=2" {
-		serveProtocolV2(u, w, r)
-		return
-	}
-	receivePackV1Handler(u, w, r)
+	// The ref advertisement is v0 even if the client requests v2, and
+	// the request is the same for v0 and v1. Ignore Git-Protocol.
+	ic := newInterceptorChain(r, s.opts.Interceptors)
+	s.receivePackV1Handler(u, w, r, ic)
 }
 
-func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Request) {
+func (s *httpProxyServer) receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Request, ic Interceptor) {
+	v1Req := gitprotocolio.NewProtocolV1ReceivePackRequest(r.Body)
+	if s.opts.ObjectFormatValidation {
+		// Git sends the "object-format" capability with the commands,
+		// so the object format doesn't need the ref advertisement.
+		v1Req.EnableObjectFormatValidation("")
+	}
+	if s.opts.StrictValidation {
+		v1Req.EnableStrictValidation()
+	}
+	// head is the chunks that are read before sending the request to the
+	// delegate.
+	var head []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	if a := s.opts.Authorizer; a != nil {
+		p, err := readPushCommands(v1Req)
+		if err != nil {
+			w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+			writeParseError(w, err, v1Req)
+			return
+		}
+		head = p.chunks
+		if len(p.updates) != 0 {
+			reasons, err := authorizePush(a, r, p)
+			if err != nil {
+				http.Error(w, "cannot authorize the push", http.StatusInternalServerError)
+				log.Printf("cannot authorize the push: %v", err)
+				return
+			}
+			head = p.applyRejections(reasons)
+			rejections := p.rejectionChunks(reasons)
+			if len(rejections) == len(p.updates) {
+				w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+				writePushRejection(w, v1Req, p, reasons)
+				return
+			}
+			if len(rejections) != 0 {
+				ic = interceptorChain{ic, &pushRejectionInterceptor{p: p, reasons: reasons}}
+			}
+		}
+	}
+
 	pr, pw := io.Pipe()
+	// capsCh receives the capabilities sent to the delegate, which decide
+	// the format of the response. It's closed without a value if there's
+	// no command.
+	capsCh := make(chan gitprotocolio.Capabilities, 1)
 	go func() {
 		defer pw.Close()
-		v1Req := gitprotocolio.NewProtocolV1ReceivePackRequest(r.Body)
-
+		defer close(capsCh)
+		sentCaps := false
+		relay := func(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) bool {
+			chunks, err := ic.ProtocolV1ReceivePackRequest(c)
+			if err != nil {
+				pw.CloseWithError(&rejectionError{err})
+				return false
+			}
+			for _, c := range chunks {
+				if len(c.Capabilities) != 0 && !sentCaps {
+					capsCh <- c.Capabilities
+					sentCaps = true
+				}
+				if err := writePacket(pw, c); err != nil {
+					writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+					return false
+				}
+			}
+			return true
+		}
+		for _, c := range head {
+			if !relay(c) {
+				return
+			}
+		}
 		for v1Req.Scan() {
-			if err := writePacket(pw, v1Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+			if !relay(v1Req.Chunk()) {
 				return
 			}
 		}
@@ -212,6 +370,8 @@ func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Req
 		if err := v1Req.Err(); err != nil {
 			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
 				writePacket(pw, ep)
+			} else if isInvalidInput(err) {
+				pw.CloseWithError(&rejectionError{err})
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
 				log.Printf("Parsing error: %#v, parser: %#v", err, v1Req)
@@ -230,7 +390,21 @@ func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Req
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		http.Error(w, "cannot send a request to the delegate", http.StatusInternalServerError)
+		var re *rejectionError
+		// The request goroutine stops reading v1Req before closing the
+		// pipe with a rejectionError.
+		if errors.As(err, &re) {
+			if sz := v1Req.Capabilities().SideBandPacketSize(); sz != 0 {
+				// git-send-pack demultiplexes the response and
+				// cannot read an ERR packet.
+				w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+				sbw := gitprotocolio.NewSideBandWriter(w, sz)
+				writeSideBandError(sbw, re.Error())
+				sbw.Close()
+				return
+			}
+		}
+		writeDelegateError(w, "git-receive-pack", err)
 		return
 	}
 	if resp.StatusCode != http.StatusOK {
@@ -238,74 +412,110 @@ func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	pktWt := synchronizedWriter{w: w}
-	mainRd, mainWt := io.Pipe()
-	go func() {
-		defer mainWt.Close()
-		sc := gitprotocolio.NewPacketScanner(resp.Body)
-	scanner:
-		for sc.Scan() {
-			switch p := sc.Packet().(type) {
-			case gitprotocolio.BytesPacket:
-				sp := gitprotocolio.ParseSideBandPacket(p)
-				if mp, ok := sp.(gitprotocolio.SideBandMainPacket); ok {
-					if _, err := mainWt.Write(mp); err != nil {
-						pktWt.closeWithError(err)
-						return
-					}
-				}
-				pktWt.writePacket(sp)
-			case gitprotocolio.FlushPacket:
-				break scanner
-			default:
-				pktWt.closeWithError(fmt.Errorf("unexpected packet: %#v", sc.Packet()))
+	w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+	copyReceivePackV1Response(w, gitprotocolio.NewPacketScanner(resp.Body), ic, <-capsCh)
+}
+
+// copyReceivePackV1Response parses the git-receive-pack response from scanner
+// and writes it to w. The response is sideband encoded if caps has "side-band"
+// or "side-band-64k", and it's empty if caps doesn't have "report-status" or
+// "report-status-v2". The report-status chunks are passed through ic.
+func copyReceivePackV1Response(w io.Writer, scanner *gitprotocolio.PacketScanner, ic Interceptor, caps gitprotocolio.Capabilities) {
+	if !caps.Has("report-status") && !caps.Has("report-status-v2") {
+		return
+	}
+	sz := caps.SideBandPacketSize()
+	if sz == 0 {
+		v1Resp := gitprotocolio.NewProtocolV1ReceivePackResponseFromScanner(scanner)
+		for v1Resp.Scan() {
+			chunks, err := ic.ProtocolV1ReceivePackResponse(v1Resp.Chunk())
+			if err != nil {
+				writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 				return
 			}
+			for _, c := range chunks {
+				if err := writePacket(w, c); err != nil {
+					return
+				}
+			}
 		}
-		if err := sc.Err(); err != nil {
-			pktWt.closeWithError(err)
+		writeParseError(w, v1Resp.Err(), v1Resp)
+		return
+	}
+
+	sbw := gitprotocolio.NewSideBandWriter(w, sz)
+	// The progress messages are relayed as is, and the main stream is
+	// re-encoded.
+	mainRd := gitprotocolio.NewSideBandReader(scanner, sz, func(bs []byte) {
+		sbw.Progress().Write(bs)
+	})
+	v1Resp := gitprotocolio.NewProtocolV1ReceivePackResponse(mainRd)
+	for v1Resp.Scan() {
+		chunks, err := ic.ProtocolV1ReceivePackResponse(v1Resp.Chunk())
+		if err != nil {
+			writeSideBandError(sbw, err.Error())
+			return
 		}
-	}()
-	ch, chunkWt := gitprotocolio.NewChunkedWriter(0xFFFF - 5)
-	go func() {
-		defer chunkWt.Close()
-		v1Resp := gitprotocolio.NewProtocolV1ReceivePackResponse(mainRd)
-		for v1Resp.Scan() {
-			if err := writePacket(chunkWt, v1Resp.Chunk()); err != nil {
-				pktWt.closeWithError(err)
+		for _, c := range chunks {
+			if err := writePacket(sbw.Main(), c); err != nil {
+				writeSideBandError(sbw, err.Error())
 				return
 			}
 		}
-		if err := v1Resp.Err(); err != nil {
-			log.Println(err)
-			pktWt.closeWithError(err)
+	}
+	if err := v1Resp.Err(); err != nil {
+		if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+			// Relay the delegate's error message as is.
+			writeSideBandError(sbw, string(ep))
+			return
 		}
-	}()
-
-	w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
-	for bs := range ch {
-		pktWt.writePacket(gitprotocolio.SideBandMainPacket(bs))
+		log.Println(err)
+		writeSideBandError(sbw, err.Error())
+		return
 	}
-	pktWt.writePacket(gitprotocolio.FlushPacket{})
+	sbw.Close()
+}
 
+// writeSideBandError writes the error message to the error channel. Like
+// git, the message ends with LF.
+func writeSideBandError(sbw *gitprotocolio.SideBandWriter, msg string) {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	sbw.Error().Write([]byte(msg))
 }
 
-func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request) {
+func (s *httpProxyServer) uploadPackV2Handler(delegateURL string, w http.ResponseWriter, r *http.Request, ic Interceptor) {
 	pr, pw := io.Pipe()
 	go func() {
 		defer pw.Close()
 		v2Req := gitprotocolio.NewProtocolV2Request(r.Body)
+		if s.opts.ObjectFormatValidation {
+			v2Req.EnableObjectFormatValidation(s.advertisedObjectFormat())
+		}
+		if s.opts.StrictValidation {
+			v2Req.EnableStrictValidation()
+		}
 
 		for v2Req.Scan() {
-			if err := writePacket(pw, v2Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+			chunks, err := ic.ProtocolV2Request(v2Req.Chunk())
+			if err != nil {
+				pw.CloseWithError(&rejectionError{err})
 				return
 			}
+			for _, c := range chunks {
+				if err := writePacket(pw, c); err != nil {
+					writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
+					return
+				}
+			}
 		}
 
 		if err := v2Req.Err(); err != nil {
 			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
 				writePacket(pw, ep)
+			} else if isInvalidInput(err) {
+				pw.CloseWithError(&rejectionError{err})
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
 				log.Printf("Parsing error: %#v, parser: %#v", err, v2Req)
@@ -325,7 +535,7 @@ func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		http.Error(w, "cannot send a request to the delegate", http.StatusInternalServerError)
+		writeDelegateError(w, "git-upload-pack", err)
 		return
 	}
 	if resp.StatusCode != http.StatusOK {
@@ -336,10 +546,17 @@ func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request)
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
 	v2Resp := gitprotocolio.NewProtocolV2Response(resp.Body)
 	for v2Resp.Scan() {
-		if err := writePacket(w, v2Resp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+		chunks, err := ic.ProtocolV2Response(v2Resp.Chunk())
+		if err != nil {
+			writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 			return
 		}
+		for _, c := range chunks {
+			if err := writePacket(w, c); err != nil {
+				writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
+				return
+			}
+		}
 	}
 
 	if err := v2Resp.Err(); err != nil {
@@ -352,6 +569,28 @@ func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// writeDelegateError writes a response for the error of a request to the
+// delegate. If an interceptor rejected the request, the client receives the
+// error as an error packet.
+func writeDelegateError(w http.ResponseWriter, service string, err error) {
+	var re *rejectionError
+	if !errors.As(err, &re) {
+		http.Error(w, "cannot send a request to the delegate", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	writePacket(w, gitprotocolio.ErrorPacket(re.Error()))
+}
+
+// isInvalidInput returns true if err is an error of the strict validation or
+// the object format validation.
+func isInvalidInput(err error) bool {
+	var oe *gitprotocolio.InvalidObjectIDError
+	var re *gitprotocolio.InvalidRefNameError
+	var fe *gitprotocolio.ObjectFormatError
+	return errors.As(err, &oe) || errors.As(err, &re) || errors.As(err, &fe)
+}
+
 func httpURLForLsRemote(base, service string) (string, error) {
 	u, err := url.Parse(base)
 	if err != nil {
@@ -386,29 +625,3 @@ func writePacket(w io.Writer, p gitprotocolio.Packet) error {
 	_, err := w.Write(p.EncodeToPktLine())
 	return err
 }
-
-type synchronizedWriter struct {
-	w      io.Writer
-	m      sync.Mutex
-	closed bool
-}
-
-func (s *synchronizedWriter) writePacket(p gitprotocolio.Packet) error {
-	s.m.Lock()
-	defer s.m.Unlock()
-	if s.closed {
-		return errors.New("already closed")
-	}
-	_, err := s.w.Write(p.EncodeToPktLine())
-	return err
-}
-
-func (s *synchronizedWriter) closeWithError(err error) {
-	s.m.Lock()
-	defer s.m.Unlock()
-	if s.closed {
-		return
-	}
-	s.closed = true
-	s.w.Write(gitprotocolio.SideBandErrorPacket(err.Error()).EncodeToPktLine())
-}
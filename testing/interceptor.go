@@ -0,0 +1,162 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"net/http"
+
+	"github.com/google/gitprotocolio"
+)
+
+// Interceptor intercepts the chunks that the proxy relays. Each method is
+// called with a chunk and returns the chunks that are relayed instead. Return
+// the chunk itself to relay it as is, nil to drop it, or multiple chunks to
+// inject new ones. If a method returns an error, the proxy stops relaying and
+// sends the error message to the client as an error packet.
+type Interceptor interface {
+	// InfoRefsResponse intercepts the /info/refs response chunks.
+	InfoRefsResponse(*gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error)
+	// ProtocolV1UploadPackRequest intercepts the protocol v0/v1
+	// git-upload-pack request chunks.
+	ProtocolV1UploadPackRequest(*gitprotocolio.ProtocolV1UploadPackRequestChunk) ([]*gitprotocolio.ProtocolV1UploadPackRequestChunk, error)
+	// ProtocolV1UploadPackResponse intercepts the protocol v0/v1
+	// git-upload-pack response chunks.
+	ProtocolV1UploadPackResponse(*gitprotocolio.ProtocolV1UploadPackResponseChunk) ([]*gitprotocolio.ProtocolV1UploadPackResponseChunk, error)
+	// ProtocolV1ReceivePackRequest intercepts the protocol v0/v1
+	// git-receive-pack request chunks.
+	ProtocolV1ReceivePackRequest(*gitprotocolio.ProtocolV1ReceivePackRequestChunk) ([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk, error)
+	// ProtocolV1ReceivePackResponse intercepts the protocol v0/v1
+	// git-receive-pack response chunks. They are the report-status
+	// chunks, which are decoded from the sideband if necessary.
+	ProtocolV1ReceivePackResponse(*gitprotocolio.ProtocolV1ReceivePackResponseChunk) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error)
+	// ProtocolV2Request intercepts the protocol v2 request chunks.
+	ProtocolV2Request(*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, error)
+	// ProtocolV2Response intercepts the protocol v2 response chunks.
+	ProtocolV2Response(*gitprotocolio.ProtocolV2ResponseChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error)
+}
+
+// InterceptorFactory creates an Interceptor for an HTTP request. Since it's
+// called for each request, the Interceptor can keep a per-request state, such
+// as the protocol v2 command that it has seen in the request.
+type InterceptorFactory func(*http.Request) Interceptor
+
+// NopInterceptor is an Interceptor that relays all chunks as is. Embed it to
+// implement only some of the methods.
+type NopInterceptor struct{}
+
+// InfoRefsResponse implements Interceptor.
+func (NopInterceptor) InfoRefsResponse(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+}
+
+// ProtocolV1UploadPackRequest implements Interceptor.
+func (NopInterceptor) ProtocolV1UploadPackRequest(c *gitprotocolio.ProtocolV1UploadPackRequestChunk) ([]*gitprotocolio.ProtocolV1UploadPackRequestChunk, error) {
+	return []*gitprotocolio.ProtocolV1UploadPackRequestChunk{c}, nil
+}
+
+// ProtocolV1UploadPackResponse implements Interceptor.
+func (NopInterceptor) ProtocolV1UploadPackResponse(c *gitprotocolio.ProtocolV1UploadPackResponseChunk) ([]*gitprotocolio.ProtocolV1UploadPackResponseChunk, error) {
+	return []*gitprotocolio.ProtocolV1UploadPackResponseChunk{c}, nil
+}
+
+// ProtocolV1ReceivePackRequest implements Interceptor.
+func (NopInterceptor) ProtocolV1ReceivePackRequest(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) ([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk, error) {
+	return []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{c}, nil
+}
+
+// ProtocolV1ReceivePackResponse implements Interceptor.
+func (NopInterceptor) ProtocolV1ReceivePackResponse(c *gitprotocolio.ProtocolV1ReceivePackResponseChunk) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error) {
+	return []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{c}, nil
+}
+
+// ProtocolV2Request implements Interceptor.
+func (NopInterceptor) ProtocolV2Request(c *gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	return []*gitprotocolio.ProtocolV2RequestChunk{c}, nil
+}
+
+// ProtocolV2Response implements Interceptor.
+func (NopInterceptor) ProtocolV2Response(c *gitprotocolio.ProtocolV2ResponseChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	return []*gitprotocolio.ProtocolV2ResponseChunk{c}, nil
+}
+
+// interceptorChain is an Interceptor that passes the chunks through the
+// interceptors in order. The chunks returned by an interceptor are passed to
+// the next one.
+type interceptorChain []Interceptor
+
+func newInterceptorChain(r *http.Request, factories []InterceptorFactory) interceptorChain {
+	var chain interceptorChain
+	for _, f := range factories {
+		chain = append(chain, f(r))
+	}
+	return chain
+}
+
+func (ic interceptorChain) InfoRefsResponse(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	return interceptChain(ic, c, Interceptor.InfoRefsResponse)
+}
+
+func (ic interceptorChain) ProtocolV1UploadPackRequest(c *gitprotocolio.ProtocolV1UploadPackRequestChunk) ([]*gitprotocolio.ProtocolV1UploadPackRequestChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV1UploadPackRequest)
+}
+
+func (ic interceptorChain) ProtocolV1UploadPackResponse(c *gitprotocolio.ProtocolV1UploadPackResponseChunk) ([]*gitprotocolio.ProtocolV1UploadPackResponseChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV1UploadPackResponse)
+}
+
+func (ic interceptorChain) ProtocolV1ReceivePackRequest(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) ([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV1ReceivePackRequest)
+}
+
+func (ic interceptorChain) ProtocolV1ReceivePackResponse(c *gitprotocolio.ProtocolV1ReceivePackResponseChunk) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV1ReceivePackResponse)
+}
+
+func (ic interceptorChain) ProtocolV2Request(c *gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV2Request)
+}
+
+func (ic interceptorChain) ProtocolV2Response(c *gitprotocolio.ProtocolV2ResponseChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	return interceptChain(ic, c, Interceptor.ProtocolV2Response)
+}
+
+// interceptChain passes the chunk through the interceptors with intercept,
+// which is one of the Interceptor methods.
+func interceptChain[T any](ic interceptorChain, c T, intercept func(Interceptor, T) ([]T, error)) ([]T, error) {
+	chunks := []T{c}
+	for _, i := range ic {
+		var next []T
+		for _, c := range chunks {
+			cs, err := intercept(i, c)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, cs...)
+		}
+		chunks = next
+	}
+	return chunks, nil
+}
+
+// rejectionError is an error that rejects the client's request while relaying
+// it, such as an error returned by an Interceptor or an invalid input. It's
+// used to distinguish the error from the delegate's errors.
+type rejectionError struct {
+	err error
+}
+
+func (e *rejectionError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/server"
+)
+
+// PushAuthorizer authorizes the ref updates of a push.
+type PushAuthorizer interface {
+	// AuthorizePush returns the reason of the rejection for each update,
+	// or an empty string if the update is allowed. The reasons are sent
+	// to the client as "ng <ref> <reason>".
+	AuthorizePush(r *http.Request, updates []*server.RefUpdate, pushOptions []string) ([]string, error)
+}
+
+// PushACLRule is a rule of PushACL.
+type PushACLRule struct {
+	// RefPrefix is the prefix of the refs that this rule applies to.
+	RefPrefix        string
+	AllowCreate      bool
+	AllowUpdate      bool
+	AllowForceUpdate bool
+	AllowDelete      bool
+}
+
+// PushACL is a PushAuthorizer with per-ref rules.
+type PushACL struct {
+	// Rules are checked in order, and the first rule that matches the ref
+	// applies. If no rule matches, the update is rejected.
+	Rules []*PushACLRule
+	// AllowedPushOptions are the keys of the push options that clients
+	// can send. If a push has other push options, all updates are
+	// rejected.
+	AllowedPushOptions []string
+	// IsFastForward returns true if newObjectID is a descendant of
+	// oldObjectID. Note that the new objects are in the pack file that
+	// follows the commands, so they might not exist in the delegate yet.
+	// If nil, all updates of existing refs are considered as force
+	// updates.
+	IsFastForward func(r *http.Request, oldObjectID, newObjectID string) (bool, error)
+}
+
+// AuthorizePush implements PushAuthorizer.
+func (a *PushACL) AuthorizePush(r *http.Request, updates []*server.RefUpdate, pushOptions []string) ([]string, error) {
+	reasons := make([]string, len(updates))
+	for _, o := range pushOptions {
+		if !a.isAllowedPushOption(o) {
+			for i := range reasons {
+				reasons[i] = "push option not allowed: " + o
+			}
+			return reasons, nil
+		}
+	}
+	for i, u := range updates {
+		reason, err := a.authorizeRefUpdate(r, u)
+		if err != nil {
+			return nil, err
+		}
+		reasons[i] = reason
+	}
+	return reasons, nil
+}
+
+func (a *PushACL) isAllowedPushOption(o string) bool {
+	key := strings.SplitN(o, "=", 2)[0]
+	for _, k := range a.AllowedPushOptions {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *PushACL) authorizeRefUpdate(r *http.Request, u *server.RefUpdate) (string, error) {
+	var rule *PushACLRule
+	for _, rl := range a.Rules {
+		if strings.HasPrefix(u.RefName, rl.RefPrefix) {
+			rule = rl
+			break
+		}
+	}
+	if rule == nil {
+		return "permission denied", nil
+	}
+	switch {
+	case u.OldObjectID == zeroObjectID:
+		if !rule.AllowCreate {
+			return "create not allowed", nil
+		}
+	case u.NewObjectID == zeroObjectID:
+		if !rule.AllowDelete {
+			return "delete not allowed", nil
+		}
+	default:
+		if rule.AllowForceUpdate {
+			return "", nil
+		}
+		if !rule.AllowUpdate {
+			return "update not allowed", nil
+		}
+		if a.IsFastForward == nil {
+			return "force update not allowed", nil
+		}
+		ff, err := a.IsFastForward(r, u.OldObjectID, u.NewObjectID)
+		if err != nil {
+			return "", err
+		}
+		if !ff {
+			return "force update not allowed", nil
+		}
+	}
+	return "", nil
+}
+
+// pushCommands is the command part of a git-receive-pack request.
+type pushCommands struct {
+	// chunks are the chunks read from the request.
+	chunks       []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	capabilities gitprotocolio.Capabilities
+	updates      []*server.RefUpdate
+	pushOptions  []string
+	// signed is true if the commands are in a push certificate.
+	signed bool
+}
+
+// readPushCommands reads the commands and the push options from req.
+func readPushCommands(req *gitprotocolio.ProtocolV1ReceivePackRequest) (*pushCommands, error) {
+	p := &pushCommands{}
+	for req.Scan() {
+		c := req.Chunk()
+		p.chunks = append(p.chunks, c)
+		switch {
+		case c.StartOfPushCert:
+			p.signed = true
+			p.capabilities = c.Capabilities
+		case c.OldObjectID != "" && c.NewObjectID != "" && c.RefName != "":
+			if len(p.updates) == 0 && !p.signed {
+				p.capabilities = c.Capabilities
+			}
+			p.updates = append(p.updates, &server.RefUpdate{
+				RefName:     c.RefName,
+				OldObjectID: c.OldObjectID,
+				NewObjectID: c.NewObjectID,
+			})
+		case c.CertPushOption != "":
+			p.pushOptions = append(p.pushOptions, c.CertPushOption)
+		case c.PushOption != "":
+			p.pushOptions = append(p.pushOptions, c.PushOption)
+		case c.EndOfCommands:
+			if len(p.updates) == 0 || !p.capabilities.Has("push-options") {
+				return p, nil
+			}
+		case c.EndOfPushCert:
+			// The push options in the certificate are the signed
+			// ones. The rest of the request is relayed as is.
+			return p, nil
+		case c.EndOfPushOptions:
+			return p, nil
+		}
+	}
+	if err := req.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no command")
+}
+
+// applyRejections returns the chunks without the rejected commands. The
+// capabilities are moved to the first remaining command.
+func (p *pushCommands) applyRejections(reasons []string) []*gitprotocolio.ProtocolV1ReceivePackRequestChunk {
+	var ret []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	i := 0
+	needCapabilities := true
+	for _, c := range p.chunks {
+		if c.OldObjectID == "" || c.NewObjectID == "" || c.RefName == "" || p.signed {
+			ret = append(ret, c)
+			continue
+		}
+		rejected := reasons[i] != ""
+		i++
+		if rejected {
+			continue
+		}
+		if needCapabilities {
+			c = &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+				Capabilities: p.capabilities,
+				OldObjectID:  c.OldObjectID,
+				NewObjectID:  c.NewObjectID,
+				RefName:      c.RefName,
+			}
+			needCapabilities = false
+		} else if c.Capabilities != nil {
+			c = &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+				OldObjectID: c.OldObjectID,
+				NewObjectID: c.NewObjectID,
+				RefName:     c.RefName,
+			}
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// rejectionChunks returns the report-status chunks for the rejected updates.
+func (p *pushCommands) rejectionChunks(reasons []string) []*gitprotocolio.ProtocolV1ReceivePackResponseChunk {
+	var ret []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	for i, u := range p.updates {
+		if reasons[i] != "" {
+			ret = append(ret, rejectionChunk(u, reasons[i]))
+		}
+	}
+	return ret
+}
+
+func rejectionChunk(u *server.RefUpdate, reason string) *gitprotocolio.ProtocolV1ReceivePackResponseChunk {
+	return &gitprotocolio.ProtocolV1ReceivePackResponseChunk{
+		RefUpdateStatus:      "ng",
+		RefName:              u.RefName,
+		RefUpdateFailMessage: reason,
+	}
+}
+
+// authorizePush authorizes the commands. It returns the reasons of the
+// rejections. A push certificate signs all the commands, so they cannot be
+// partially rejected. Neither can an atomic push.
+func authorizePush(a PushAuthorizer, r *http.Request, p *pushCommands) ([]string, error) {
+	reasons, err := a.AuthorizePush(r, p.updates, p.pushOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(reasons) != len(p.updates) {
+		return nil, fmt.Errorf("the authorizer returned %d reasons for %d updates", len(reasons), len(p.updates))
+	}
+	if !p.signed && !p.capabilities.Has("atomic") {
+		return reasons, nil
+	}
+	for _, reason := range reasons {
+		if reason != "" {
+			for i := range reasons {
+				if reasons[i] == "" {
+					reasons[i] = "atomic push failed"
+				}
+			}
+			break
+		}
+	}
+	return reasons, nil
+}
+
+// writePushRejection writes the report-status response that rejects all the
+// updates. The rest of the request, which is the pack file, is read and
+// discarded so that the client can read the response.
+func writePushRejection(w io.Writer, req *gitprotocolio.ProtocolV1ReceivePackRequest, p *pushCommands, reasons []string) {
+	for req.Scan() {
+	}
+	// report-status-v2 is the same as report-status for the rejections.
+	if !p.capabilities.Has("report-status") && !p.capabilities.Has("report-status-v2") {
+		return
+	}
+	var buf bytes.Buffer
+	// Like git-receive-pack that fails before unpacking, report the
+	// reason as the unpack status.
+	writePacket(&buf, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{UnpackStatus: reasons[0]})
+	for _, c := range p.rejectionChunks(reasons) {
+		writePacket(&buf, c)
+	}
+	writePacket(&buf, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{EndOfResponse: true})
+
+	sz := p.capabilities.SideBandPacketSize()
+	if sz == 0 {
+		w.Write(buf.Bytes())
+		return
+	}
+	sbw := gitprotocolio.NewSideBandWriter(w, sz)
+	sbw.Main().Write(buf.Bytes())
+	sbw.Close()
+}
+
+// pushRejectionInterceptor adds the report-status of the rejected updates to
+// the delegate's response. The statuses are in the order of the commands.
+type pushRejectionInterceptor struct {
+	NopInterceptor
+	p       *pushCommands
+	reasons []string
+	// next is the index of the first update whose status is not relayed
+	// yet.
+	next int
+}
+
+func (i *pushRejectionInterceptor) ProtocolV1ReceivePackResponse(c *gitprotocolio.ProtocolV1ReceivePackResponseChunk) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error) {
+	if c.RefUpdateStatus == "" && !c.EndOfResponse {
+		return []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{c}, nil
+	}
+	// Insert the rejections of the updates before the one of c. All the
+	// rest precede the end of the response.
+	var ret []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	for ; i.next < len(i.p.updates); i.next++ {
+		u := i.p.updates[i.next]
+		if i.reasons[i.next] == "" {
+			if u.RefName == c.RefName {
+				i.next++
+				break
+			}
+			continue
+		}
+		ret = append(ret, rejectionChunk(u, i.reasons[i.next]))
+	}
+	return append(ret, c), nil
+}
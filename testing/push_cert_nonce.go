@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/pushcert"
+)
+
+// PushCertNoncePolicy lets the proxy issue the nonces of signed pushes instead
+// of the delegate. The proxy advertises "push-cert=<nonce>" in the ref
+// advertisement of git-receive-pack, and checks the nonce in the push
+// certificate. This makes signed pushes work with a delegate that doesn't
+// issue nonces.
+//
+// If the delegate issues nonces, its nonce is replaced, and the delegate sees
+// a nonce that it doesn't know.
+type PushCertNoncePolicy struct {
+	Issuer *pushcert.NonceIssuer
+	// CheckNonce is called with the status of the nonce for each signed
+	// push. If it returns an error, the push is rejected. If nil, all
+	// pushes are accepted.
+	CheckNonce func(r *http.Request, status pushcert.NonceStatus, slop time.Duration) error
+}
+
+// Interceptor returns an Interceptor for a request. This is an
+// InterceptorFactory.
+func (p *PushCertNoncePolicy) Interceptor(r *http.Request) Interceptor {
+	return &pushCertNonceInterceptor{policy: p, r: r}
+}
+
+type pushCertNonceInterceptor struct {
+	NopInterceptor
+	policy       *PushCertNoncePolicy
+	r            *http.Request
+	nonceChecked bool
+}
+
+// repositoryPath returns the path of the repository that the request is for.
+// The nonce is tied to it.
+func (i *pushCertNonceInterceptor) repositoryPath() string {
+	p := i.r.URL.Path
+	for _, suffix := range []string{"/info/refs", "/git-receive-pack"} {
+		p = strings.TrimSuffix(p, suffix)
+	}
+	return "/" + strings.Trim(p, "/")
+}
+
+func (i *pushCertNonceInterceptor) InfoRefsResponse(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	if i.r.URL.Query().Get("service") != "git-receive-pack" || c.ObjectID == "" || len(c.Capabilities) == 0 {
+		return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+	}
+	nonce := i.policy.Issuer.Issue(i.repositoryPath())
+	if nonce == "" {
+		return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+	}
+	var caps []string
+	for _, cap := range c.Capabilities {
+		if key, _ := gitprotocolio.ParseCapability(cap); key != "push-cert" {
+			caps = append(caps, cap)
+		}
+	}
+	nc := *c
+	nc.Capabilities = append(caps, "push-cert="+nonce)
+	return []*gitprotocolio.InfoRefsResponseChunk{&nc}, nil
+}
+
+func (i *pushCertNonceInterceptor) ProtocolV1ReceivePackRequest(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) ([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk, error) {
+	switch {
+	case c.Nonce != "":
+		if err := i.check(c.Nonce); err != nil {
+			return nil, err
+		}
+	case c.EndOfCertPushOptions && !i.nonceChecked:
+		// The certificate doesn't have a nonce.
+		if err := i.check(""); err != nil {
+			return nil, err
+		}
+	}
+	return []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{c}, nil
+}
+
+func (i *pushCertNonceInterceptor) check(nonce string) error {
+	i.nonceChecked = true
+	status, slop := i.policy.Issuer.Check(i.repositoryPath(), nonce)
+	if i.policy.CheckNonce == nil {
+		return nil
+	}
+	return i.policy.CheckNonce(i.r, status, slop)
+}
@@ -0,0 +1,326 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/client"
+)
+
+// RefVisibilityPolicy hides refs from the clients of the proxy. The hidden refs
+// are removed from the ref advertisement and the ls-refs response, and the
+// requests that want the hidden ref tips are rejected.
+//
+// Only the exact tips of the hidden refs are rejected. The objects that are
+// reachable only from the hidden refs are not protected. Over the stateless
+// protocol v0, like smart HTTP, git-upload-pack accepts a want that is
+// reachable from any ref, so a client that knows such an object ID can still
+// fetch it.
+//
+// The tips are taken from the ref advertisements and the ls-refs responses
+// that the proxy relays, so a ref update is seen when the next one is relayed.
+// Before the first one, the refs are looked up from DelegateURL.
+type RefVisibilityPolicy struct {
+	// DelegateURL is the URL that the proxy delegates to. It's used to
+	// look up the refs when a client sends wants before the proxy relays
+	// any refs.
+	DelegateURL string
+	// IsHidden returns true if the ref should be hidden.
+	IsHidden func(refName string) bool
+
+	mu sync.Mutex
+	// refs maps the ref names, including the peeled "^{}" ones, to the
+	// object IDs that the delegate advertised last.
+	refs map[string]string
+}
+
+// HideRefPrefixes returns a function for RefVisibilityPolicy.IsHidden that
+// hides the refs that start with any of the prefixes.
+func HideRefPrefixes(prefixes ...string) func(string) bool {
+	return func(refName string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(refName, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Interceptor returns an Interceptor for a request. This is an
+// InterceptorFactory.
+func (p *RefVisibilityPolicy) Interceptor(r *http.Request) Interceptor {
+	return &refVisibilityInterceptor{policy: p, ctx: r.Context()}
+}
+
+func (p *RefVisibilityPolicy) isHidden(refName string) bool {
+	return p.IsHidden(strings.TrimSuffix(refName, "^{}"))
+}
+
+// setRefs replaces the refs with the ones in a full ref advertisement.
+func (p *RefVisibilityPolicy) setRefs(refs map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs = refs
+}
+
+// updateRef updates a ref seen in an ls-refs response. The response can be
+// limited by ref-prefix, so the other refs are kept, and it doesn't replace the
+// lookup if the refs are not known yet.
+func (p *RefVisibilityPolicy) updateRef(refName, oid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refs != nil {
+		p.refs[refName] = oid
+	}
+}
+
+// hiddenTips returns the object IDs that only hidden refs point to.
+func (p *RefVisibilityPolicy) hiddenTips(ctx context.Context) (map[string]bool, error) {
+	p.mu.Lock()
+	known := p.refs != nil
+	p.mu.Unlock()
+	if !known {
+		remoteRefs, err := (&client.Client{}).LsRemote(ctx, p.DelegateURL)
+		if err != nil {
+			return nil, err
+		}
+		refs := map[string]string{}
+		for _, ref := range remoteRefs {
+			refs[ref.Name] = ref.ObjectID
+			if ref.PeeledObjectID != "" {
+				refs[ref.Name+"^{}"] = ref.PeeledObjectID
+			}
+		}
+		p.setRefs(refs)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hidden := map[string]bool{}
+	visible := map[string]bool{}
+	for refName, oid := range p.refs {
+		if p.isHidden(refName) {
+			hidden[oid] = true
+		} else {
+			visible[oid] = true
+		}
+	}
+	for oid := range visible {
+		delete(hidden, oid)
+	}
+	return hidden, nil
+}
+
+type refVisibilityInterceptor struct {
+	NopInterceptor
+	policy *RefVisibilityPolicy
+	ctx    context.Context
+
+	// pendingCapabilities are the capabilities of a hidden first ref.
+	// They are moved to the next visible ref.
+	pendingCapabilities []string
+	// advertisedRefs are the refs in the relayed ref advertisement,
+	// including the hidden ones.
+	advertisedRefs map[string]string
+	// hidden is the result of hiddenTips. It's looked up on the first
+	// want.
+	hidden map[string]bool
+	// command is the protocol v2 command of the request.
+	command string
+}
+
+func (i *refVisibilityInterceptor) InfoRefsResponse(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	if c.Ref != "" {
+		// The placeholder of an empty repository makes this a v0/v1
+		// ref advertisement, unlike the protocol v2 capabilities.
+		if i.advertisedRefs == nil {
+			i.advertisedRefs = map[string]string{}
+		}
+		if c.Ref != "capabilities^{}" {
+			i.advertisedRefs[c.Ref] = c.ObjectID
+		}
+	}
+	if c.EndOfRequest && i.advertisedRefs != nil {
+		i.policy.setRefs(i.advertisedRefs)
+	}
+	if c.EndOfRequest && i.pendingCapabilities != nil {
+		// All refs are hidden. Advertise the capabilities in the
+		// same way as an empty repository.
+		placeholder := &gitprotocolio.InfoRefsResponseChunk{
+			ObjectID:     zeroObjectID,
+			Ref:          "capabilities^{}",
+			Capabilities: i.pendingCapabilities,
+		}
+		i.pendingCapabilities = nil
+		return []*gitprotocolio.InfoRefsResponseChunk{placeholder, c}, nil
+	}
+	if c.Ref == "" {
+		return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+	}
+	if c.Capabilities != nil {
+		c = &gitprotocolio.InfoRefsResponseChunk{
+			ObjectID:     c.ObjectID,
+			Ref:          c.Ref,
+			Capabilities: i.filterCapabilities(c.Capabilities),
+		}
+	}
+	if i.policy.isHidden(c.Ref) {
+		if c.Capabilities != nil {
+			i.pendingCapabilities = c.Capabilities
+		}
+		return nil, nil
+	}
+	if i.pendingCapabilities != nil {
+		c = &gitprotocolio.InfoRefsResponseChunk{
+			ObjectID:     c.ObjectID,
+			Ref:          c.Ref,
+			Capabilities: i.pendingCapabilities,
+		}
+		i.pendingCapabilities = nil
+	}
+	return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+}
+
+// filterCapabilities removes the symref capabilities that refer to hidden
+// refs.
+func (i *refVisibilityInterceptor) filterCapabilities(caps []string) []string {
+	ret := []string{}
+	for _, c := range caps {
+		hidden := false
+		for from, to := range gitprotocolio.Capabilities([]string{c}).Symrefs() {
+			// A symref capability has only one symref.
+			hidden = i.policy.isHidden(from) || i.policy.isHidden(to)
+			break
+		}
+		if !hidden {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func (i *refVisibilityInterceptor) ProtocolV1UploadPackRequest(c *gitprotocolio.ProtocolV1UploadPackRequestChunk) ([]*gitprotocolio.ProtocolV1UploadPackRequestChunk, error) {
+	if c.WantObjectID != "" {
+		if err := i.checkWant(c.WantObjectID); err != nil {
+			return nil, err
+		}
+	}
+	return []*gitprotocolio.ProtocolV1UploadPackRequestChunk{c}, nil
+}
+
+func (i *refVisibilityInterceptor) ProtocolV2Request(c *gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	if c.Command != "" {
+		i.command = c.Command
+	}
+	if i.command != "fetch" || len(c.Argument) == 0 {
+		return []*gitprotocolio.ProtocolV2RequestChunk{c}, nil
+	}
+	arg, err := scanFetchArgument(c.Argument)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case arg.WantObjectID != "":
+		if err := i.checkWant(arg.WantObjectID); err != nil {
+			return nil, err
+		}
+	case arg.WantRef != "":
+		if i.policy.isHidden(arg.WantRef) {
+			return nil, fmt.Errorf("unknown ref %s", arg.WantRef)
+		}
+	}
+	return []*gitprotocolio.ProtocolV2RequestChunk{c}, nil
+}
+
+func (i *refVisibilityInterceptor) ProtocolV2Response(c *gitprotocolio.ProtocolV2ResponseChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	if i.command != "ls-refs" || len(c.Response) == 0 {
+		return []*gitprotocolio.ProtocolV2ResponseChunk{c}, nil
+	}
+	ref, err := scanLsRefsResponse(c.Response)
+	if err != nil {
+		return nil, err
+	}
+	i.policy.updateRef(ref.RefName, ref.ObjectID)
+	if ref.PeeledObjectID != "" {
+		i.policy.updateRef(ref.RefName+"^{}", ref.PeeledObjectID)
+	}
+	if i.policy.isHidden(ref.RefName) {
+		return nil, nil
+	}
+	if ref.SymrefTarget == "" || !i.policy.isHidden(ref.SymrefTarget) {
+		return []*gitprotocolio.ProtocolV2ResponseChunk{c}, nil
+	}
+	// Remove the symref-target that refers to a hidden ref like the
+	// symref capability in protocol v0/v1.
+	ref.SymrefTarget = ""
+	return []*gitprotocolio.ProtocolV2ResponseChunk{
+		{Response: ref.EncodeToPktLine()[4:]},
+	}, nil
+}
+
+// scanFetchArgument parses an argument of the fetch command with
+// ProtocolV2FetchRequest. The interceptor sees one packet at a time, so the
+// argument is put in a request of its own.
+func scanFetchArgument(arg []byte) (*gitprotocolio.ProtocolV2FetchRequestChunk, error) {
+	var buf bytes.Buffer
+	buf.Write((&gitprotocolio.ProtocolV2FetchRequestChunk{Command: "fetch"}).EncodeToPktLine())
+	buf.Write((&gitprotocolio.ProtocolV2FetchRequestChunk{EndCapability: true}).EncodeToPktLine())
+	buf.Write(gitprotocolio.BytesPacket(arg).EncodeToPktLine())
+	buf.Write((&gitprotocolio.ProtocolV2FetchRequestChunk{EndArgument: true}).EncodeToPktLine())
+	req := gitprotocolio.NewProtocolV2FetchRequest(&buf)
+	for req.Scan() {
+		if c := req.Chunk(); c.Command == "" && !c.EndCapability {
+			return c, nil
+		}
+	}
+	if err := req.Err(); err != nil {
+		return nil, err
+	}
+	return nil, gitprotocolio.SyntaxError(fmt.Sprintf("unexpected fetch argument: %#v", arg))
+}
+
+// scanLsRefsResponse parses a ref of the ls-refs response with
+// ProtocolV2LsRefsResponse.
+func scanLsRefsResponse(line []byte) (*gitprotocolio.ProtocolV2LsRefsResponseChunk, error) {
+	var buf bytes.Buffer
+	buf.Write(gitprotocolio.BytesPacket(line).EncodeToPktLine())
+	resp := gitprotocolio.NewProtocolV2LsRefsResponse(&buf)
+	if !resp.Scan() {
+		return nil, resp.Err()
+	}
+	return resp.Chunk(), nil
+}
+
+func (i *refVisibilityInterceptor) checkWant(oid string) error {
+	if i.hidden == nil {
+		hidden, err := i.policy.hiddenTips(i.ctx)
+		if err != nil {
+			return fmt.Errorf("cannot look up the refs: %v", err)
+		}
+		i.hidden = hidden
+	}
+	if i.hidden[oid] {
+		return fmt.Errorf("upload-pack: not our ref %s", oid)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer is a Git SSH transport server that is backed by git-upload-pack and
+// git-receive-pack. The traffic is parsed and re-encoded by gitprotocolio.
+type SSHServer struct {
+	// StrictValidation and ObjectFormatValidation are the validations of
+	// the client's requests like HTTPProxyOptions. They must be set before
+	// Serve.
+	StrictValidation       bool
+	ObjectFormatValidation bool
+
+	gitBinary string
+	gitDir    string
+	config    *ssh.ServerConfig
+}
+
+// NewSSHServer returns an SSHServer that serves the repositories under gitDir.
+// The host key is generated for each server. Clients are not authenticated.
+func NewSSHServer(gitBinary, gitDir string) (*SSHServer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	return &SSHServer{gitBinary: gitBinary, gitDir: gitDir, config: config}, nil
+}
+
+// Serve accepts incoming connections on the listener l.
+func (s *SSHServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SSHServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Printf("SSH handshake failed: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			log.Printf("cannot accept a channel: %v", err)
+			continue
+		}
+		go s.serveSession(ch, chReqs)
+	}
+}
+
+func (s *SSHServer) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	var gitProtocol string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if env.Name == "GIT_PROTOCOL" {
+				gitProtocol = env.Value
+			}
+			req.Reply(true, nil)
+		case "exec":
+			var exe struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exe); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			service, repo, err := parseSSHCommand(exe.Command)
+			if err != nil {
+				req.Reply(false, nil)
+				fmt.Fprintf(ch.Stderr(), "%v\n", err)
+				return
+			}
+			req.Reply(true, nil)
+			status := s.runService(ch, service, repo, gitProtocol)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *SSHServer) runService(ch ssh.Channel, service, repo, gitProtocol string) uint32 {
+	gitDir := filepath.Join(s.gitDir, repo)
+	if gitDir != s.gitDir && !strings.HasPrefix(gitDir, s.gitDir+string(filepath.Separator)) {
+		fmt.Fprintf(ch.Stderr(), "invalid repository: %s\n", repo)
+		return 128
+	}
+
+	cmd := exec.Command(s.gitBinary, strings.TrimPrefix(service, "git-"), gitDir)
+	cmd.Env = os.Environ()
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+gitProtocol)
+	}
+	cmd.Stderr = ch.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 128
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 128
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(ch.Stderr(), "cannot start %s: %v\n", service, err)
+		return 128
+	}
+
+	v := bidiValidation{strict: s.StrictValidation, objectFormat: s.ObjectFormatValidation}
+	proxyBidiService(ch, stdin, stdout, service, isProtocolV2(gitProtocol), v)
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return uint32(exitErr.ExitCode())
+		}
+		return 128
+	}
+	return 0
+}
+
+// parseSSHCommand parses a command like "git-upload-pack '/repo'".
+func parseSSHCommand(command string) (string, string, error) {
+	ss := strings.SplitN(command, " ", 2)
+	if len(ss) != 2 {
+		return "", "", fmt.Errorf("invalid command: %s", command)
+	}
+	service := ss[0]
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		return "", "", fmt.Errorf("unknown service: %s", service)
+	}
+	// Git quotes the path with single quotes. A single quote in the path
+	// is written as '\''.
+	arg := ss[1]
+	var sb strings.Builder
+	for len(arg) != 0 {
+		switch {
+		case arg[0] == '\'':
+			end := strings.IndexByte(arg[1:], '\'')
+			if end == -1 {
+				return "", "", fmt.Errorf("unterminated quote: %s", command)
+			}
+			sb.WriteString(arg[1 : end+1])
+			arg = arg[end+2:]
+		case arg[0] == '\\' && len(arg) > 1:
+			sb.WriteByte(arg[1])
+			arg = arg[2:]
+		default:
+			sb.WriteByte(arg[0])
+			arg = arg[1:]
+		}
+	}
+	return service, sb.String(), nil
+}
@@ -27,6 +27,66 @@ type SyntaxError string
 
 func (s SyntaxError) Error() string { return string(s) }
 
+// ParseError is an error returned by a scanner when it cannot parse the input.
+// It records where the error happened. The underlying error, usually a
+// SyntaxError, can be retrieved with errors.As.
+type ParseError struct {
+	// Scanner is the name of the scanner type that the caller reads from
+	// (e.g. "InfoRefsResponse"), even if an underlying scanner finds the
+	// error.
+	Scanner string
+	// State is the internal state of the scanner after reading Packet. It's
+	// meaningful only for debugging.
+	State int
+	// Offset is the byte offset of Packet in the input. At EOF, this is
+	// the size of the input.
+	Offset int64
+	// PacketNumber is the 1-based number of Packet in the input. At EOF,
+	// this is the number of the packets plus one.
+	PacketNumber int
+	// Packet is the packet that the scanner cannot parse. This is nil if
+	// the packet cannot be read.
+	Packet Packet
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v (%s state %d, packet %d at offset %d)", e.Err, e.Scanner, e.State, e.PacketNumber, e.Offset)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError returns a ParseError at the current packet of ps if err is
+// about the input. Other errors, such as I/O errors and ErrorPacket, are
+// returned as-is. A ParseError of the underlying scanner keeps its position,
+// but takes scanner and state, so that the error names the scanner that the
+// caller reads from.
+func newParseError(err error, scanner string, state int, ps *PacketScanner) error {
+	if pe, ok := err.(*ParseError); ok {
+		ret := *pe
+		ret.Scanner = scanner
+		ret.State = state
+		return &ret
+	}
+	switch err.(type) {
+	case SyntaxError, *InvalidObjectIDError, *InvalidRefNameError, *ObjectFormatError:
+	default:
+		return err
+	}
+	return &ParseError{
+		Scanner:      scanner,
+		State:        state,
+		Offset:       ps.offset,
+		PacketNumber: ps.packetNumber,
+		Packet:       ps.curr,
+		Err:          err,
+	}
+}
+
 // Packet is the interface that wraps a packet line.
 type Packet interface {
 	EncodeToPktLine() []byte
@@ -48,6 +108,15 @@ func (DelimPacket) EncodeToPktLine() []byte {
 	return []byte("0001")
 }
 
+// ResponseEndPacket is the response-end packet ("0002"). This is used in the
+// stateless-connect mode of protocol v2 to indicate the end of a response.
+type ResponseEndPacket struct{}
+
+// EncodeToPktLine serializes the packet.
+func (ResponseEndPacket) EncodeToPktLine() []byte {
+	return []byte("0002")
+}
+
 // BytesPacket is a packet with a content.
 type BytesPacket []byte
 
@@ -99,6 +168,14 @@ type PacketScanner struct {
 	curr         Packet
 	packFileMode bool
 	scanner      *bufio.Scanner
+
+	// offset is the byte offset of curr, and consumed is the number of
+	// bytes read so far.
+	offset       int64
+	consumed     int64
+	packetNumber int
+	// done is true after the underlying scanner stops.
+	done bool
 }
 
 // NewPacketScanner returns a new PacketScanner to read from r.
@@ -124,15 +201,22 @@ func (s *PacketScanner) Packet() Packet {
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (s *PacketScanner) Scan() bool {
-	if s.err != nil {
+	if s.err != nil || s.done {
 		return false
 	}
 	if !s.scanner.Scan() {
-		s.err = s.scanner.Err()
+		s.done = true
+		s.offset = s.consumed
+		s.packetNumber++
+		s.curr = nil
+		s.err = newParseError(s.scanner.Err(), "PacketScanner", 0, s)
 		return false
 	}
 
 	bs := s.scanner.Bytes()
+	s.offset = s.consumed
+	s.consumed += int64(len(bs))
+	s.packetNumber++
 	if s.packFileMode {
 		if len(bs) == 0 {
 			// EOF
@@ -149,13 +233,18 @@ func (s *PacketScanner) Scan() bool {
 		s.curr = DelimPacket{}
 		return true
 	}
+	if bytes.Equal(bs, []byte("0002")) {
+		s.curr = ResponseEndPacket{}
+		return true
+	}
 	if bytes.Equal(bs, []byte("PACK")) {
 		s.packFileMode = true
 		s.curr = PackFileIndicatorPacket{}
 		return true
 	}
 	if len(bs) == 4 {
-		s.err = SyntaxError("unknown special packet: " + string(bs))
+		s.curr = nil
+		s.err = newParseError(SyntaxError("unknown special packet: "+string(bs)), "PacketScanner", 0, s)
 		return false
 	}
 	if bytes.Equal(bs[4:8], []byte("ERR ")) {
@@ -178,9 +267,9 @@ func (s *PacketScanner) packetSplitFunc(data []byte, atEOF bool) (int, []byte, e
 	}
 	sz, err := strconv.ParseUint(string(data[:4]), 16, 32)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, SyntaxError("cannot parse the packet size: " + string(data[:4]))
 	}
-	if sz == 0 || sz == 1 {
+	if sz == 0 || sz == 1 || sz == 2 {
 		// Special packet.
 		return 4, data[:4], nil
 	}
@@ -41,6 +41,7 @@ const (
 	protocolV1ReceivePackRequestStateScanOptionalPushOptions
 	protocolV1ReceivePackRequestStateScanPushOptions
 	protocolV1ReceivePackRequestStateScanPackFile
+	protocolV1ReceivePackRequestStateEnd
 )
 
 // ProtocolV1ReceivePackRequestChunk is a chunk of a protocol v1
@@ -131,6 +132,13 @@ type ProtocolV1ReceivePackRequest struct {
 	state   protocolV1ReceivePackRequestState
 	err     error
 	curr    *ProtocolV1ReceivePackRequestChunk
+
+	capabilities Capabilities
+	objectFormat objectFormatValidator
+	strict       bool
+	// bidi allows a flush packet at the beginning, which is an empty
+	// request on the bidi-transports.
+	bidi bool
 }
 
 // NewProtocolV1ReceivePackRequest returns a new ProtocolV1ReceivePackRequest to
@@ -139,6 +147,13 @@ func NewProtocolV1ReceivePackRequest(rd io.Reader) *ProtocolV1ReceivePackRequest
 	return &ProtocolV1ReceivePackRequest{scanner: NewPacketScanner(rd)}
 }
 
+// NewBidiProtocolV1ReceivePackRequest returns a new ProtocolV1ReceivePackRequest to read the
+// request of the bidi-transports (SSH and Git wire) from rd. Unlike the HTTP
+// request, it can be a single flush packet if the client has nothing to push.
+func NewBidiProtocolV1ReceivePackRequest(rd io.Reader) *ProtocolV1ReceivePackRequest {
+	return &ProtocolV1ReceivePackRequest{scanner: NewPacketScanner(rd), bidi: true}
+}
+
 // Err returns the first non-EOF error that was encountered by the
 // ProtocolV1ReceivePackRequest.
 func (r *ProtocolV1ReceivePackRequest) Err() error {
@@ -150,12 +165,70 @@ func (r *ProtocolV1ReceivePackRequest) Chunk() *ProtocolV1ReceivePackRequestChun
 	return r.curr
 }
 
+// Capabilities returns the capabilities that the client requested with the
+// first command or the push certificate. This is valid after the chunk is
+// scanned.
+func (r *ProtocolV1ReceivePackRequest) Capabilities() Capabilities {
+	return r.capabilities
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names of the commands follow git-check-ref-format. A violation is
+// reported as an InvalidObjectIDError or an InvalidRefNameError. This must be
+// called before the first Scan.
+func (r *ProtocolV1ReceivePackRequest) EnableStrictValidation() {
+	r.strict = true
+}
+
+// EnableObjectFormatValidation makes the scanner check the lengths of the
+// object IDs of the commands and the shallows. objectFormat is the object
+// format that the server advertised. The "object-format" capability of the
+// first command or the push certificate must match it. If objectFormat is
+// empty, the client's capability is used, or SHA-1 without it. The shallows
+// before the first command are checked when the first command is scanned. A
+// mismatch is reported as an ObjectFormatError. This must be called before the
+// first Scan.
+func (r *ProtocolV1ReceivePackRequest) EnableObjectFormatValidation(objectFormat string) {
+	r.objectFormat.enabled = true
+	r.objectFormat.advertised = objectFormat
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1ReceivePackRequest) Scan() bool {
-	if r.err != nil {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV1ReceivePackRequest", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV1ReceivePackRequest", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV1ReceivePackRequest) validateChunk(c *ProtocolV1ReceivePackRequestChunk) error {
+	if r.strict {
+		if err := checkObjectIDs(c.ClientShallow, c.OldObjectID, c.NewObjectID); err != nil {
+			return err
+		}
+		if err := checkRefNames(c.RefName); err != nil {
+			return err
+		}
+	}
+	if c.Capabilities != nil {
+		if err := r.objectFormat.negotiate(r.capabilities); err != nil {
+			return err
+		}
+	}
+	return r.objectFormat.check(c.ClientShallow, c.OldObjectID, c.NewObjectID)
+}
+
+func (r *ProtocolV1ReceivePackRequest) scan() bool {
+	if r.err != nil || r.state == protocolV1ReceivePackRequestStateEnd {
 		return false
 	}
 	if !r.scanner.Scan() {
@@ -170,6 +243,16 @@ func (r *ProtocolV1ReceivePackRequest) Scan() bool {
 transition:
 	switch r.state {
 	case protocolV1ReceivePackRequestStateBegin:
+		if _, ok := pkt.(FlushPacket); ok && r.bidi {
+			// On the bidi-transports, a client that has nothing to
+			// push sends a flush packet after the ref
+			// advertisement.
+			r.state = protocolV1ReceivePackRequestStateEnd
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				EndOfCommands: true,
+			}
+			return true
+		}
 		bp, ok := pkt.(BytesPacket)
 		if !ok {
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
@@ -198,17 +281,14 @@ transition:
 			r.err = SyntaxError("cannot split into two: " + string(bp))
 			return false
 		}
-		caps := []string{}
-		if capStr := strings.TrimPrefix(strings.TrimSuffix(string(zss[1]), "\n"), " "); capStr != "" {
-			// This is to avoid strings.Split("", " ") => []string{""}.
-			caps = strings.Split(capStr, " ")
-		}
+		caps := ParseCapabilities(strings.TrimPrefix(strings.TrimSuffix(string(zss[1]), "\n"), " "))
 		ss := strings.SplitN(string(zss[0]), " ", 3)
 		if len(ss) != 3 {
 			r.err = SyntaxError("cannot split into three: " + string(zss[0]))
 			return false
 		}
 		r.state = protocolV1ReceivePackRequestStateScanCommand
+		r.capabilities = caps
 		r.curr = &ProtocolV1ReceivePackRequestChunk{
 			Capabilities: caps,
 			OldObjectID:  ss[0],
@@ -251,12 +331,9 @@ transition:
 			r.err = SyntaxError("cannot split into two: " + string(bp))
 			return false
 		}
-		caps := []string{}
-		if capStr := strings.TrimPrefix(strings.TrimSuffix(string(zss[1]), "\n"), " "); capStr != "" {
-			// This is to avoid strings.Split("", " ") => []string{""}.
-			caps = strings.Split(capStr, " ")
-		}
+		caps := ParseCapabilities(strings.TrimPrefix(strings.TrimSuffix(string(zss[1]), "\n"), " "))
 		r.state = protocolV1ReceivePackRequestStateScanCertVersion
+		r.capabilities = caps
 		r.curr = &ProtocolV1ReceivePackRequestChunk{
 			Capabilities:    caps,
 			StartOfPushCert: true,
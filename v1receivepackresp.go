@@ -25,6 +25,7 @@ type protocolV1ReceivePackResponseState int
 const (
 	protocolV1ReceivePackResponseStateBegin protocolV1ReceivePackResponseState = iota
 	protocolV1ReceivePackResponseStateScanResult
+	protocolV1ReceivePackResponseStateScanResultOrOption
 	protocolV1ReceivePackResponseStateEnd
 )
 
@@ -35,7 +36,14 @@ type ProtocolV1ReceivePackResponseChunk struct {
 	RefUpdateStatus      string
 	RefName              string
 	RefUpdateFailMessage string
-	EndOfResponse        bool
+
+	// The report-status-v2 options of the preceding "ok" status.
+	OptionRefName      string
+	OptionOldObjectID  string
+	OptionNewObjectID  string
+	OptionForcedUpdate bool
+
+	EndOfResponse bool
 }
 
 // EncodeToPktLine serializes the chunk.
@@ -49,6 +57,18 @@ func (c *ProtocolV1ReceivePackResponseChunk) EncodeToPktLine() []byte {
 		}
 		return BytesPacket([]byte(fmt.Sprintf("%s %s %s\n", c.RefUpdateStatus, c.RefName, c.RefUpdateFailMessage))).EncodeToPktLine()
 	}
+	if c.OptionRefName != "" {
+		return BytesPacket([]byte(fmt.Sprintf("option refname %s\n", c.OptionRefName))).EncodeToPktLine()
+	}
+	if c.OptionOldObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("option old-oid %s\n", c.OptionOldObjectID))).EncodeToPktLine()
+	}
+	if c.OptionNewObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("option new-oid %s\n", c.OptionNewObjectID))).EncodeToPktLine()
+	}
+	if c.OptionForcedUpdate {
+		return BytesPacket([]byte("option forced-update\n")).EncodeToPktLine()
+	}
 	if c.EndOfResponse {
 		return FlushPacket{}.EncodeToPktLine()
 	}
@@ -62,12 +82,21 @@ type ProtocolV1ReceivePackResponse struct {
 	state   protocolV1ReceivePackResponseState
 	err     error
 	curr    *ProtocolV1ReceivePackResponseChunk
+
+	strict bool
 }
 
 // NewProtocolV1ReceivePackResponse returns a new ProtocolV1ReceivePackResponse
 // to read from rd.
 func NewProtocolV1ReceivePackResponse(rd io.Reader) *ProtocolV1ReceivePackResponse {
-	return &ProtocolV1ReceivePackResponse{scanner: NewPacketScanner(rd)}
+	return NewProtocolV1ReceivePackResponseFromScanner(NewPacketScanner(rd))
+}
+
+// NewProtocolV1ReceivePackResponseFromScanner returns a new
+// ProtocolV1ReceivePackResponse to read the packets from scanner. This is used
+// to continue reading after the ref advertisement.
+func NewProtocolV1ReceivePackResponseFromScanner(scanner *PacketScanner) *ProtocolV1ReceivePackResponse {
+	return &ProtocolV1ReceivePackResponse{scanner: scanner}
 }
 
 // Err returns the first non-EOF error that was encountered by the
@@ -81,11 +110,42 @@ func (r *ProtocolV1ReceivePackResponse) Chunk() *ProtocolV1ReceivePackResponseCh
 	return r.curr
 }
 
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names follow git-check-ref-format. A violation is reported as an
+// InvalidObjectIDError or an InvalidRefNameError. This must be called before
+// the first Scan.
+func (r *ProtocolV1ReceivePackResponse) EnableStrictValidation() {
+	r.strict = true
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1ReceivePackResponse) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV1ReceivePackResponse", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV1ReceivePackResponse", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV1ReceivePackResponse) validateChunk(c *ProtocolV1ReceivePackResponseChunk) error {
+	if !r.strict {
+		return nil
+	}
+	if err := checkObjectIDs(c.OptionOldObjectID, c.OptionNewObjectID); err != nil {
+		return err
+	}
+	return checkRefNames(c.RefName, c.OptionRefName)
+}
+
+func (r *ProtocolV1ReceivePackResponse) scan() bool {
 	if r.err != nil || r.state == protocolV1ReceivePackResponseStateEnd {
 		return false
 	}
@@ -114,7 +174,7 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 			UnpackStatus: strings.SplitN(s, " ", 2)[1],
 		}
 		return true
-	case protocolV1ReceivePackResponseStateScanResult:
+	case protocolV1ReceivePackResponseStateScanResult, protocolV1ReceivePackResponseStateScanResultOrOption:
 		switch p := pkt.(type) {
 		case FlushPacket:
 			r.state = protocolV1ReceivePackResponseStateEnd
@@ -124,8 +184,17 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 			return true
 		case BytesPacket:
 			s := strings.TrimSuffix(string(p), "\n")
+			if strings.HasPrefix(s, "option ") {
+				if r.state != protocolV1ReceivePackResponseStateScanResultOrOption {
+					r.err = SyntaxError(fmt.Sprintf("unexpected option: %#v", s))
+					return false
+				}
+				r.curr, r.err = parseReportStatusOption(s)
+				return r.err == nil
+			}
 			if strings.HasPrefix(s, "ok ") {
 				ss := strings.SplitN(s, " ", 2)
+				r.state = protocolV1ReceivePackResponseStateScanResultOrOption
 				r.curr = &ProtocolV1ReceivePackResponseChunk{
 					RefUpdateStatus: ss[0],
 					RefName:         ss[1],
@@ -138,6 +207,7 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 					r.err = SyntaxError("cannot split into three: " + s)
 					return false
 				}
+				r.state = protocolV1ReceivePackResponseStateScanResult
 				r.curr = &ProtocolV1ReceivePackResponseChunk{
 					RefUpdateStatus:      ss[0],
 					RefName:              ss[1],
@@ -154,3 +224,20 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 	}
 	panic("impossible state")
 }
+
+// parseReportStatusOption parses a report-status-v2 option line.
+func parseReportStatusOption(s string) (*ProtocolV1ReceivePackResponseChunk, error) {
+	ss := strings.SplitN(strings.TrimPrefix(s, "option "), " ", 2)
+	switch {
+	case ss[0] == "forced-update" && len(ss) == 1:
+		return &ProtocolV1ReceivePackResponseChunk{OptionForcedUpdate: true}, nil
+	case len(ss) != 2 || ss[1] == "":
+	case ss[0] == "refname":
+		return &ProtocolV1ReceivePackResponseChunk{OptionRefName: ss[1]}, nil
+	case ss[0] == "old-oid":
+		return &ProtocolV1ReceivePackResponseChunk{OptionOldObjectID: ss[1]}, nil
+	case ss[0] == "new-oid":
+		return &ProtocolV1ReceivePackResponseChunk{OptionNewObjectID: ss[1]}, nil
+	}
+	return nil, SyntaxError(fmt.Sprintf("unknown option: %#v", s))
+}
@@ -93,6 +93,13 @@ type ProtocolV1UploadPackRequest struct {
 	state   protocolV1UploadPackRequestState
 	err     error
 	curr    *ProtocolV1UploadPackRequestChunk
+
+	capabilities Capabilities
+	objectFormat objectFormatValidator
+	strict       bool
+	// bidi allows a flush packet at the beginning, which is an empty
+	// request on the bidi-transports.
+	bidi bool
 }
 
 // NewProtocolV1UploadPackRequest returns a new ProtocolV1UploadPackRequest to
@@ -112,11 +119,68 @@ func (r *ProtocolV1UploadPackRequest) Chunk() *ProtocolV1UploadPackRequestChunk
 	return r.curr
 }
 
+// Capabilities returns the capabilities that the client requested with the
+// first want. This is valid after the first chunk is scanned.
+func (r *ProtocolV1UploadPackRequest) Capabilities() Capabilities {
+	return r.capabilities
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the deepen-not ref names follow git-check-ref-format. A violation is
+// reported as an InvalidObjectIDError or an InvalidRefNameError. This must be
+// called before the first Scan.
+func (r *ProtocolV1UploadPackRequest) EnableStrictValidation() {
+	r.strict = true
+}
+
+// EnableObjectFormatValidation makes the scanner check the lengths of the
+// object IDs of the wants, the shallows and the haves. objectFormat is the
+// object format that the server advertised. Git doesn't send the
+// "object-format" capability with the wants in protocol v0/v1, so the
+// advertised one is used unless the client sends a matching capability. If
+// objectFormat is empty, the client's capability is used, or SHA-1 without
+// it. A mismatch is reported as an ObjectFormatError. This must be called
+// before the first Scan.
+func (r *ProtocolV1UploadPackRequest) EnableObjectFormatValidation(objectFormat string) {
+	r.objectFormat.enabled = true
+	r.objectFormat.advertised = objectFormat
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1UploadPackRequest) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV1UploadPackRequest", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV1UploadPackRequest", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV1UploadPackRequest) validateChunk(c *ProtocolV1UploadPackRequestChunk) error {
+	if r.strict {
+		if err := checkObjectIDs(c.WantObjectID, c.ShallowObjectID, c.HaveObjectID); err != nil {
+			return err
+		}
+		if err := checkRefNames(c.DeepenNotRef); err != nil {
+			return err
+		}
+	}
+	if c.Capabilities != nil {
+		if err := r.objectFormat.negotiate(r.capabilities); err != nil {
+			return err
+		}
+	}
+	return r.objectFormat.check(c.WantObjectID, c.ShallowObjectID, c.HaveObjectID)
+}
+
+func (r *ProtocolV1UploadPackRequest) scan() bool {
 	if r.err != nil || r.state == protocolV1UploadPackRequestStateEnd {
 		return false
 	}
@@ -130,27 +194,37 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 	pkt := r.scanner.Packet()
 
 	if r.state == protocolV1UploadPackRequestStateBegin {
+		if _, ok := pkt.(FlushPacket); ok && r.bidi {
+			// On the bidi-transports, a client that doesn't want
+			// anything sends a flush packet after the ref
+			// advertisement.
+			r.state = protocolV1UploadPackRequestStateEnd
+			r.curr = &ProtocolV1UploadPackRequestChunk{
+				EndOneRound: true,
+			}
+			return true
+		}
 		bp, ok := pkt.(BytesPacket)
 		if !ok {
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
 			return false
 		}
-		ss := strings.SplitN(string(bp), " ", 3)
+		// The capabilities are optional.
+		ss := strings.SplitN(strings.TrimSuffix(string(bp), "\n"), " ", 3)
 		if len(ss) < 2 {
 			r.err = SyntaxError("cannot split wants: " + string(bp))
 			return false
 		}
-		caps := []string{}
+		caps := Capabilities{}
 		if len(ss) == 3 {
-			if capStr := strings.TrimSuffix(ss[2], "\n"); capStr != "" {
-				// This is to avoid strings.Split("", " ") => []string{""}.
-				caps = strings.Split(capStr, " ")
-			}
+			caps = ParseCapabilities(ss[2])
 		}
 		if ss[0] != "want" {
 			r.err = SyntaxError("the first packet is not want: " + string(bp))
+			return false
 		}
 		r.state = protocolV1UploadPackRequestStateScanWants
+		r.capabilities = caps
 		r.curr = &ProtocolV1UploadPackRequestChunk{
 			Capabilities: caps,
 			WantObjectID: ss[1],
@@ -29,6 +29,7 @@ const (
 	protocolV1UploadPackResponseStateScanUnshallows
 	protocolV1UploadPackResponseStateBeginAcknowledgements
 	protocolV1UploadPackResponseStateScanAcknowledgements
+	protocolV1UploadPackResponseStateBeginPacks
 	protocolV1UploadPackResponseStateScanPacks
 	protocolV1UploadPackResponseStateEnd
 )
@@ -76,12 +77,15 @@ func (c *ProtocolV1UploadPackResponseChunk) EncodeToPktLine() []byte {
 }
 
 // ProtocolV1UploadPackResponse provides an interface for reading a protocol v1
-// git-upload-pack response.
+// git-upload-pack response. The response to a negotiation round of the
+// stateless-RPC, which is a request without "done", ends after NAK.
 type ProtocolV1UploadPackResponse struct {
 	scanner *PacketScanner
 	state   protocolV1UploadPackResponseState
 	err     error
 	curr    *ProtocolV1UploadPackResponseChunk
+
+	strict bool
 }
 
 // NewProtocolV1UploadPackResponse returns a new ProtocolV1UploadPackResponse to
@@ -101,17 +105,44 @@ func (r *ProtocolV1UploadPackResponse) Chunk() *ProtocolV1UploadPackResponseChun
 	return r.curr
 }
 
+// EnableStrictValidation makes the scanner check that the object IDs are hex. A
+// violation is reported as an InvalidObjectIDError. This must be called before
+// the first Scan.
+func (r *ProtocolV1UploadPackResponse) EnableStrictValidation() {
+	r.strict = true
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1UploadPackResponse) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV1UploadPackResponse", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV1UploadPackResponse", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV1UploadPackResponse) validateChunk(c *ProtocolV1UploadPackResponseChunk) error {
+	if !r.strict {
+		return nil
+	}
+	return checkObjectIDs(c.ShallowObjectID, c.UnshallowObjectID, c.AckObjectID)
+}
+
+func (r *ProtocolV1UploadPackResponse) scan() bool {
 	if r.err != nil || r.state == protocolV1UploadPackResponseStateEnd {
 		return false
 	}
 	if !r.scanner.Scan() {
 		r.err = r.scanner.Err()
-		if r.err == nil && r.state != protocolV1UploadPackResponseStateBeginAcknowledgements {
+		if r.err == nil && r.state != protocolV1UploadPackResponseStateBeginAcknowledgements && r.state != protocolV1UploadPackResponseStateBeginPacks {
 			r.err = SyntaxError("early EOF")
 		}
 		return false
@@ -178,7 +209,7 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 				return true
 			}
 			if bytes.Equal(bp, []byte("NAK\n")) {
-				r.state = protocolV1UploadPackResponseStateScanPacks
+				r.state = protocolV1UploadPackResponseStateBeginPacks
 				r.curr = &ProtocolV1UploadPackResponseChunk{
 					Nak: true,
 				}
@@ -190,7 +221,7 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 			return false
 		}
 		fallthrough
-	case protocolV1UploadPackResponseStateScanPacks:
+	case protocolV1UploadPackResponseStateBeginPacks, protocolV1UploadPackResponseStateScanPacks:
 		switch p := pkt.(type) {
 		case FlushPacket:
 			r.state = protocolV1UploadPackResponseStateEnd
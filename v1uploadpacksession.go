@@ -0,0 +1,365 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type protocolV1UploadPackSessionState int
+
+const (
+	protocolV1UploadPackSessionStateAdvertisement protocolV1UploadPackSessionState = iota
+	protocolV1UploadPackSessionStateRequestWants
+	protocolV1UploadPackSessionStateResponseShallows
+	protocolV1UploadPackSessionStateRequestHaves
+	protocolV1UploadPackSessionStateResponseAcknowledgements
+	protocolV1UploadPackSessionStateResponseFinalAcknowledgements
+	protocolV1UploadPackSessionStateResponsePacks
+	protocolV1UploadPackSessionStateEnd
+)
+
+// ProtocolV1UploadPackSessionChunk is a chunk of a protocol v0/v1
+// git-upload-pack session. Exactly one of the fields is set.
+type ProtocolV1UploadPackSessionChunk struct {
+	// Advertisement is a chunk of the ref advertisement sent by the server.
+	Advertisement *InfoRefsResponseChunk
+	// Request is a chunk sent by the client.
+	Request *ProtocolV1UploadPackRequestChunk
+	// Response is a chunk sent by the server.
+	Response *ProtocolV1UploadPackResponseChunk
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV1UploadPackSessionChunk) EncodeToPktLine() []byte {
+	if c.Advertisement != nil {
+		return c.Advertisement.EncodeToPktLine()
+	}
+	if c.Request != nil {
+		return c.Request.EncodeToPktLine()
+	}
+	if c.Response != nil {
+		return c.Response.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ProtocolV1UploadPackSession provides an interface for reading a protocol
+// v0/v1 git-upload-pack session on a bidi-transport (SSH and Git wire).
+//
+// Unlike the stateless HTTP transport, the client sends the wants only once,
+// and then the client's haves and the server's acknowledgements interleave
+// over multiple rounds. ProtocolV1UploadPackSession reads the client-to-server
+// stream and the server-to-client stream in the order they are exchanged,
+// starting from the server's ref advertisement. It reads a stream only when
+// it's the stream's turn, so a proxy can forward each chunk before reading the
+// next one. The pack must be sideband-encoded.
+type ProtocolV1UploadPackSession struct {
+	respScanner   *PacketScanner
+	advertisement *InfoRefsResponse
+	request       *ProtocolV1UploadPackRequest
+	state         protocolV1UploadPackSessionState
+	err           error
+	curr          *ProtocolV1UploadPackSessionChunk
+
+	strict       bool
+	capabilities Capabilities
+	hasWant      bool
+	hasShallow   bool
+	multiAck     bool
+	noDone       bool
+	acked        bool
+	sentReady    bool
+}
+
+// NewProtocolV1UploadPackSession returns a new ProtocolV1UploadPackSession
+// that reads the client's requests from clientRd and the server's responses
+// from serverRd.
+func NewProtocolV1UploadPackSession(clientRd, serverRd io.Reader) *ProtocolV1UploadPackSession {
+	reqScanner := NewPacketScanner(clientRd)
+	respScanner := NewPacketScanner(serverRd)
+	return &ProtocolV1UploadPackSession{
+		respScanner:   respScanner,
+		advertisement: &InfoRefsResponse{scanner: respScanner},
+		request:       &ProtocolV1UploadPackRequest{scanner: reqScanner, bidi: true},
+	}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV1UploadPackSession.
+func (s *ProtocolV1UploadPackSession) Err() error {
+	return s.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+func (s *ProtocolV1UploadPackSession) Chunk() *ProtocolV1UploadPackSessionChunk {
+	return s.curr
+}
+
+// Capabilities returns the capabilities that the client requested with the
+// first want. This is valid after the first request chunk is scanned.
+func (s *ProtocolV1UploadPackSession) Capabilities() Capabilities {
+	return s.capabilities
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names follow git-check-ref-format in both streams. A violation
+// is reported as an InvalidObjectIDError or an InvalidRefNameError. This must
+// be called before the first Scan.
+func (s *ProtocolV1UploadPackSession) EnableStrictValidation() {
+	s.strict = true
+	s.advertisement.EnableStrictValidation()
+	s.request.EnableStrictValidation()
+}
+
+// EnableObjectFormatValidation makes the scanner check the lengths of the
+// object IDs of the ref advertisement and the client's requests. The requests
+// are checked against the object format that the server advertised. A mismatch
+// is reported as an ObjectFormatError. This must be called before the first
+// Scan.
+func (s *ProtocolV1UploadPackSession) EnableObjectFormatValidation() {
+	s.advertisement.EnableObjectFormatValidation()
+	s.request.objectFormat.enabled = true
+}
+
+// Scan advances the scanner to the next chunk. It returns false when the scan
+// stops, either by reaching the end of the session or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (s *ProtocolV1UploadPackSession) Scan() bool {
+	if !s.scan() {
+		// The errors in the request states are about the client's
+		// stream, and their positions are in the client's stream. The
+		// others are about the server's stream.
+		s.err = newParseError(s.err, "ProtocolV1UploadPackSession", int(s.state), s.respScanner)
+		return false
+	}
+	// The advertisement and the request are validated by their scanners.
+	if c := s.curr.Response; s.strict && c != nil {
+		if err := checkObjectIDs(c.ShallowObjectID, c.UnshallowObjectID, c.AckObjectID); err != nil {
+			s.err = newParseError(err, "ProtocolV1UploadPackSession", int(s.state), s.respScanner)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ProtocolV1UploadPackSession) scan() bool {
+	for {
+		if s.err != nil || s.state == protocolV1UploadPackSessionStateEnd {
+			return false
+		}
+		switch s.state {
+		case protocolV1UploadPackSessionStateAdvertisement:
+			return s.scanAdvertisement()
+		case protocolV1UploadPackSessionStateRequestWants, protocolV1UploadPackSessionStateRequestHaves:
+			return s.scanRequest()
+		case protocolV1UploadPackSessionStateResponseAcknowledgements:
+			if !s.multiAck && s.acked {
+				// Without multi_ack, the server sends
+				// nothing after the first ACK until the
+				// client sends done.
+				s.state = protocolV1UploadPackSessionStateRequestHaves
+				continue
+			}
+		case protocolV1UploadPackSessionStateResponseFinalAcknowledgements:
+			if !s.multiAck && s.acked {
+				s.state = protocolV1UploadPackSessionStateResponsePacks
+				continue
+			}
+		}
+		return s.scanResponse()
+	}
+}
+
+func (s *ProtocolV1UploadPackSession) scanAdvertisement() bool {
+	if !s.advertisement.Scan() {
+		s.err = s.advertisement.Err()
+		if s.err == nil {
+			s.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	c := s.advertisement.Chunk()
+	if c.ServiceHeader != "" {
+		s.err = SyntaxError("unexpected service header on a bidi-transport: " + c.ServiceHeader)
+		return false
+	}
+	if c.ProtocolVersion == 2 {
+		s.err = SyntaxError("protocol v2 is not a stateful session")
+		return false
+	}
+	if c.EndOfRequest {
+		s.state = protocolV1UploadPackSessionStateRequestWants
+		s.request.objectFormat.advertised = s.advertisement.objectFormat.format
+	}
+	s.curr = &ProtocolV1UploadPackSessionChunk{Advertisement: c}
+	return true
+}
+
+func (s *ProtocolV1UploadPackSession) scanRequest() bool {
+	if !s.request.Scan() {
+		s.err = s.request.Err()
+		return false
+	}
+	c := s.request.Chunk()
+	switch {
+	case c.WantObjectID != "":
+		if !s.hasWant {
+			s.hasWant = true
+			s.capabilities = c.Capabilities
+			for _, capability := range c.Capabilities {
+				switch capability {
+				case "multi_ack", "multi_ack_detailed":
+					s.multiAck = true
+				case "no-done":
+					s.noDone = true
+				}
+			}
+		}
+	case c.ShallowObjectID != "", c.DeepenDepth != 0, c.DeepenSince != 0, c.DeepenNotRef != "":
+		s.hasShallow = true
+	case c.EndOneRound:
+		if !s.hasWant {
+			// The client wants nothing.
+			s.state = protocolV1UploadPackSessionStateEnd
+		} else if s.state == protocolV1UploadPackSessionStateRequestWants {
+			if s.hasShallow {
+				s.state = protocolV1UploadPackSessionStateResponseShallows
+			} else {
+				s.state = protocolV1UploadPackSessionStateRequestHaves
+			}
+		} else {
+			s.state = protocolV1UploadPackSessionStateResponseAcknowledgements
+		}
+	case c.NoMoreNegotiation:
+		s.state = protocolV1UploadPackSessionStateResponseFinalAcknowledgements
+	}
+	s.curr = &ProtocolV1UploadPackSessionChunk{Request: c}
+	return true
+}
+
+func (s *ProtocolV1UploadPackSession) scanResponse() bool {
+	if !s.respScanner.Scan() {
+		s.err = s.respScanner.Err()
+		if s.err == nil {
+			s.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	pkt := s.respScanner.Packet()
+
+	switch s.state {
+	case protocolV1UploadPackSessionStateResponseShallows:
+		switch p := pkt.(type) {
+		case FlushPacket:
+			s.state = protocolV1UploadPackSessionStateRequestHaves
+			s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+				EndOfShallows: true,
+			}}
+			return true
+		case BytesPacket:
+			ss := strings.SplitN(strings.TrimSuffix(string(p), "\n"), " ", 2)
+			if len(ss) != 2 {
+				break
+			}
+			if ss[0] == "shallow" {
+				s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+					ShallowObjectID: ss[1],
+				}}
+				return true
+			}
+			if ss[0] == "unshallow" {
+				s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+					UnshallowObjectID: ss[1],
+				}}
+				return true
+			}
+		}
+	case protocolV1UploadPackSessionStateResponseAcknowledgements, protocolV1UploadPackSessionStateResponseFinalAcknowledgements:
+		bp, ok := pkt.(BytesPacket)
+		if !ok {
+			break
+		}
+		if bytes.Equal(bp, []byte("NAK\n")) {
+			if s.state == protocolV1UploadPackSessionStateResponseFinalAcknowledgements {
+				s.state = protocolV1UploadPackSessionStateResponsePacks
+			} else if s.noDone && s.sentReady {
+				// The server doesn't wait for done, and sends
+				// the final ACK.
+				s.state = protocolV1UploadPackSessionStateResponseFinalAcknowledgements
+			} else {
+				s.state = protocolV1UploadPackSessionStateRequestHaves
+			}
+			s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+				Nak: true,
+			}}
+			return true
+		}
+		if !bytes.HasPrefix(bp, []byte("ACK ")) {
+			break
+		}
+		ss := strings.SplitN(strings.TrimSuffix(string(bp), "\n"), " ", 3)
+		if len(ss) < 2 {
+			s.err = SyntaxError("cannot split ACK: " + string(bp))
+			return false
+		}
+		detail := ""
+		if len(ss) == 3 {
+			detail = ss[2]
+		}
+		s.acked = true
+		if detail == "ready" {
+			s.sentReady = true
+		}
+		if !s.multiAck {
+			// The single ACK is sent only once.
+			if s.state == protocolV1UploadPackSessionStateResponseFinalAcknowledgements {
+				s.state = protocolV1UploadPackSessionStateResponsePacks
+			} else {
+				s.state = protocolV1UploadPackSessionStateRequestHaves
+			}
+		} else if detail == "" && s.state == protocolV1UploadPackSessionStateResponseFinalAcknowledgements {
+			// The final ACK without a detail precedes the pack.
+			s.state = protocolV1UploadPackSessionStateResponsePacks
+		}
+		s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+			AckObjectID: ss[1],
+			AckDetail:   detail,
+		}}
+		return true
+	case protocolV1UploadPackSessionStateResponsePacks:
+		switch p := pkt.(type) {
+		case FlushPacket:
+			s.state = protocolV1UploadPackSessionStateEnd
+			s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+				EndOfRequest: true,
+			}}
+			return true
+		case BytesPacket:
+			s.curr = &ProtocolV1UploadPackSessionChunk{Response: &ProtocolV1UploadPackResponseChunk{
+				PackStream: p,
+			}}
+			return true
+		}
+	default:
+		panic("impossible state")
+	}
+	s.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+	return false
+}
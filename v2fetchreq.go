@@ -0,0 +1,359 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type protocolV2FetchRequestState int
+
+// The argument states are ordered. An argument that belongs to an earlier
+// state than the current one is misordered.
+const (
+	protocolV2FetchRequestStateBegin protocolV2FetchRequestState = iota
+	protocolV2FetchRequestStateScanCapabilities
+	protocolV2FetchRequestStateScanOptions
+	protocolV2FetchRequestStateScanWants
+	protocolV2FetchRequestStateScanHaves
+	protocolV2FetchRequestStateScanDone
+	protocolV2FetchRequestStateEnd
+)
+
+// ProtocolV2FetchRequestChunk is a chunk of a protocol v2 fetch request.
+type ProtocolV2FetchRequestChunk struct {
+	Command       string
+	Capability    string
+	EndCapability bool
+
+	ThinPack        bool
+	NoProgress      bool
+	IncludeTag      bool
+	OfsDelta        bool
+	SidebandAll     bool
+	WaitForDone     bool
+	ShallowObjectID string
+	DeepenDepth     int
+	DeepenRelative  bool
+	// Seconds from UNIX epoch.
+	DeepenSince          uint64
+	DeepenNotRef         string
+	FilterSpec           string
+	PackfileURIProtocols []string
+
+	WantObjectID      string
+	WantRef           string
+	HaveObjectID      string
+	NoMoreNegotiation bool
+
+	EndArgument bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV2FetchRequestChunk) EncodeToPktLine() []byte {
+	// Like git, only the want, want-ref, have, and done lines have LF.
+	if c.Command != "" {
+		return BytesPacket([]byte(fmt.Sprintf("command=%s", c.Command))).EncodeToPktLine()
+	}
+	if c.Capability != "" {
+		return BytesPacket([]byte(c.Capability)).EncodeToPktLine()
+	}
+	if c.EndCapability {
+		return DelimPacket{}.EncodeToPktLine()
+	}
+	if c.ThinPack {
+		return BytesPacket([]byte("thin-pack")).EncodeToPktLine()
+	}
+	if c.NoProgress {
+		return BytesPacket([]byte("no-progress")).EncodeToPktLine()
+	}
+	if c.IncludeTag {
+		return BytesPacket([]byte("include-tag")).EncodeToPktLine()
+	}
+	if c.OfsDelta {
+		return BytesPacket([]byte("ofs-delta")).EncodeToPktLine()
+	}
+	if c.SidebandAll {
+		return BytesPacket([]byte("sideband-all")).EncodeToPktLine()
+	}
+	if c.WaitForDone {
+		return BytesPacket([]byte("wait-for-done")).EncodeToPktLine()
+	}
+	if c.ShallowObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("shallow %s", c.ShallowObjectID))).EncodeToPktLine()
+	}
+	if c.DeepenDepth != 0 {
+		return BytesPacket([]byte(fmt.Sprintf("deepen %d", c.DeepenDepth))).EncodeToPktLine()
+	}
+	if c.DeepenRelative {
+		return BytesPacket([]byte("deepen-relative")).EncodeToPktLine()
+	}
+	if c.DeepenSince != 0 {
+		return BytesPacket([]byte(fmt.Sprintf("deepen-since %d", c.DeepenSince))).EncodeToPktLine()
+	}
+	if c.DeepenNotRef != "" {
+		return BytesPacket([]byte(fmt.Sprintf("deepen-not %s", c.DeepenNotRef))).EncodeToPktLine()
+	}
+	if c.FilterSpec != "" {
+		return BytesPacket([]byte(fmt.Sprintf("filter %s", c.FilterSpec))).EncodeToPktLine()
+	}
+	if len(c.PackfileURIProtocols) != 0 {
+		return BytesPacket([]byte(fmt.Sprintf("packfile-uris %s", strings.Join(c.PackfileURIProtocols, ",")))).EncodeToPktLine()
+	}
+	if c.WantObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("want %s\n", c.WantObjectID))).EncodeToPktLine()
+	}
+	if c.WantRef != "" {
+		return BytesPacket([]byte(fmt.Sprintf("want-ref %s\n", c.WantRef))).EncodeToPktLine()
+	}
+	if c.HaveObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("have %s\n", c.HaveObjectID))).EncodeToPktLine()
+	}
+	if c.NoMoreNegotiation {
+		return BytesPacket([]byte("done\n")).EncodeToPktLine()
+	}
+	if c.EndArgument {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ProtocolV2FetchRequest provides an interface for reading a protocol v2 fetch
+// request. It reads one fetch command.
+type ProtocolV2FetchRequest struct {
+	scanner *ProtocolV2Request
+	state   protocolV2FetchRequestState
+	err     error
+	curr    *ProtocolV2FetchRequestChunk
+
+	hasDeepen      bool
+	hasDeepenSince bool
+	objectFormat   objectFormatValidator
+	strict         bool
+}
+
+// NewProtocolV2FetchRequest returns a new ProtocolV2FetchRequest to read from
+// rd.
+func NewProtocolV2FetchRequest(rd io.Reader) *ProtocolV2FetchRequest {
+	return &ProtocolV2FetchRequest{scanner: NewProtocolV2Request(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV2FetchRequest.
+func (r *ProtocolV2FetchRequest) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent request chunk generated by a call to Scan.
+func (r *ProtocolV2FetchRequest) Chunk() *ProtocolV2FetchRequestChunk {
+	return r.curr
+}
+
+// Capabilities returns the capabilities of the command that have been scanned
+// so far.
+func (r *ProtocolV2FetchRequest) Capabilities() Capabilities {
+	return r.scanner.Capabilities()
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names of want-ref and deepen-not follow git-check-ref-format. A
+// violation is reported as an InvalidObjectIDError or an InvalidRefNameError.
+// This must be called before the first Scan.
+func (r *ProtocolV2FetchRequest) EnableStrictValidation() {
+	r.strict = true
+}
+
+// EnableObjectFormatValidation makes the scanner check the lengths of the
+// object IDs of the shallows, the wants and the haves. objectFormat is the
+// object format that the server advertised. The "object-format" capability
+// line must match it. If objectFormat is empty, the client's capability is
+// used, or SHA-1 without it. A mismatch is reported as an ObjectFormatError.
+// This must be called before the first Scan.
+func (r *ProtocolV2FetchRequest) EnableObjectFormatValidation(objectFormat string) {
+	r.objectFormat.enabled = true
+	r.objectFormat.advertised = objectFormat
+}
+
+// Scan advances the scanner to the next chunk. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ProtocolV2FetchRequest) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2FetchRequest", int(r.state), r.scanner.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV2FetchRequest", int(r.state), r.scanner.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV2FetchRequest) validateChunk(c *ProtocolV2FetchRequestChunk) error {
+	return validateProtocolV2FetchChunk(c, r.strict, &r.objectFormat, r.Capabilities())
+}
+
+// validateProtocolV2FetchChunk validates a chunk of a fetch command. caps are
+// the capabilities of the command.
+func validateProtocolV2FetchChunk(c *ProtocolV2FetchRequestChunk, strict bool, objectFormat *objectFormatValidator, caps Capabilities) error {
+	if strict {
+		if err := checkObjectIDs(c.ShallowObjectID, c.WantObjectID, c.HaveObjectID); err != nil {
+			return err
+		}
+		if err := checkRefNames(c.WantRef, c.DeepenNotRef); err != nil {
+			return err
+		}
+	}
+	if c.EndCapability {
+		if err := objectFormat.negotiate(caps); err != nil {
+			return err
+		}
+	}
+	return objectFormat.check(c.ShallowObjectID, c.WantObjectID, c.HaveObjectID)
+}
+
+func (r *ProtocolV2FetchRequest) scan() bool {
+	if r.err != nil || r.state == protocolV2FetchRequestStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != protocolV2FetchRequestStateBegin {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	c := r.scanner.Chunk()
+
+	switch r.state {
+	case protocolV2FetchRequestStateBegin:
+		if c.Command != "fetch" {
+			r.err = SyntaxError(fmt.Sprintf("unexpected chunk: %#v", c))
+			return false
+		}
+		r.state = protocolV2FetchRequestStateScanCapabilities
+		r.curr = &ProtocolV2FetchRequestChunk{
+			Command: c.Command,
+		}
+		return true
+	case protocolV2FetchRequestStateScanCapabilities:
+		if c.EndCapability {
+			r.state = protocolV2FetchRequestStateScanOptions
+			r.curr = &ProtocolV2FetchRequestChunk{
+				EndCapability: true,
+			}
+			return true
+		}
+		r.curr = &ProtocolV2FetchRequestChunk{
+			Capability: c.Capability,
+		}
+		return true
+	}
+
+	if c.EndArgument {
+		r.state = protocolV2FetchRequestStateEnd
+		r.curr = &ProtocolV2FetchRequestChunk{
+			EndArgument: true,
+		}
+		return true
+	}
+	s := strings.TrimSuffix(string(c.Argument), "\n")
+	if r.state == protocolV2FetchRequestStateScanDone {
+		r.err = SyntaxError("unexpected argument after done: " + s)
+		return false
+	}
+	chunk, state, err := parseProtocolV2FetchArgument(s)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	if state < r.state {
+		r.err = SyntaxError("misordered argument: " + s)
+		return false
+	}
+	if chunk.DeepenDepth != 0 {
+		r.hasDeepen = true
+	}
+	if chunk.DeepenSince != 0 || chunk.DeepenNotRef != "" {
+		r.hasDeepenSince = true
+	}
+	if r.hasDeepen && r.hasDeepenSince {
+		r.err = SyntaxError("deepen and deepen-since (or deepen-not) cannot be used together")
+		return false
+	}
+	r.state = state
+	r.curr = chunk
+	return true
+}
+
+func parseProtocolV2FetchArgument(s string) (*ProtocolV2FetchRequestChunk, protocolV2FetchRequestState, error) {
+	switch s {
+	case "thin-pack":
+		return &ProtocolV2FetchRequestChunk{ThinPack: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "no-progress":
+		return &ProtocolV2FetchRequestChunk{NoProgress: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "include-tag":
+		return &ProtocolV2FetchRequestChunk{IncludeTag: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "ofs-delta":
+		return &ProtocolV2FetchRequestChunk{OfsDelta: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "sideband-all":
+		return &ProtocolV2FetchRequestChunk{SidebandAll: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "wait-for-done":
+		return &ProtocolV2FetchRequestChunk{WaitForDone: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "deepen-relative":
+		return &ProtocolV2FetchRequestChunk{DeepenRelative: true}, protocolV2FetchRequestStateScanOptions, nil
+	case "done":
+		return &ProtocolV2FetchRequestChunk{NoMoreNegotiation: true}, protocolV2FetchRequestStateScanDone, nil
+	}
+
+	ss := strings.SplitN(s, " ", 2)
+	if len(ss) != 2 || ss[1] == "" {
+		return nil, 0, SyntaxError("unexpected fetch argument: " + s)
+	}
+	switch ss[0] {
+	case "shallow":
+		return &ProtocolV2FetchRequestChunk{ShallowObjectID: ss[1]}, protocolV2FetchRequestStateScanOptions, nil
+	case "deepen":
+		depth, err := strconv.ParseInt(ss[1], 10, strconv.IntSize)
+		if err != nil || depth <= 0 {
+			return nil, 0, SyntaxError("cannot parse depth: " + ss[1])
+		}
+		return &ProtocolV2FetchRequestChunk{DeepenDepth: int(depth)}, protocolV2FetchRequestStateScanOptions, nil
+	case "deepen-since":
+		since, err := strconv.ParseUint(ss[1], 10, 64)
+		if err != nil || since == 0 {
+			return nil, 0, SyntaxError("cannot parse deepen-since: " + ss[1])
+		}
+		return &ProtocolV2FetchRequestChunk{DeepenSince: since}, protocolV2FetchRequestStateScanOptions, nil
+	case "deepen-not":
+		return &ProtocolV2FetchRequestChunk{DeepenNotRef: ss[1]}, protocolV2FetchRequestStateScanOptions, nil
+	case "filter":
+		return &ProtocolV2FetchRequestChunk{FilterSpec: ss[1]}, protocolV2FetchRequestStateScanOptions, nil
+	case "packfile-uris":
+		return &ProtocolV2FetchRequestChunk{PackfileURIProtocols: strings.Split(ss[1], ",")}, protocolV2FetchRequestStateScanOptions, nil
+	case "want":
+		return &ProtocolV2FetchRequestChunk{WantObjectID: ss[1]}, protocolV2FetchRequestStateScanWants, nil
+	case "want-ref":
+		return &ProtocolV2FetchRequestChunk{WantRef: ss[1]}, protocolV2FetchRequestStateScanWants, nil
+	case "have":
+		return &ProtocolV2FetchRequestChunk{HaveObjectID: ss[1]}, protocolV2FetchRequestStateScanHaves, nil
+	}
+	return nil, 0, SyntaxError("unexpected fetch argument: " + s)
+}
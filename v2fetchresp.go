@@ -0,0 +1,428 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type protocolV2FetchResponseState int
+
+const (
+	protocolV2FetchResponseStateBegin protocolV2FetchResponseState = iota
+	protocolV2FetchResponseStateBeginAcknowledgments
+	protocolV2FetchResponseStateScanAcks
+	protocolV2FetchResponseStateEndOfNak
+	protocolV2FetchResponseStateEndOfAcknowledgments
+	protocolV2FetchResponseStateBeginShallowInfo
+	protocolV2FetchResponseStateScanShallowInfo
+	protocolV2FetchResponseStateBeginWantedRefs
+	protocolV2FetchResponseStateScanWantedRefs
+	protocolV2FetchResponseStateBeginPackfileURIs
+	protocolV2FetchResponseStateScanPackfileURIs
+	protocolV2FetchResponseStateBeginPackfile
+	protocolV2FetchResponseStateScanPackfile
+	protocolV2FetchResponseStateEnd
+)
+
+// ProtocolV2FetchResponseChunk is a chunk of a protocol v2 fetch response.
+//
+// The packfile section is always sideband encoded. PackStream,
+// ProgressMessage, and ErrorMessage are the demultiplexed payloads of the
+// sideband channels.
+type ProtocolV2FetchResponseChunk struct {
+	StartOfAcknowledgments bool
+	AckObjectID            string
+	Nak                    bool
+	Ready                  bool
+
+	StartOfShallowInfo bool
+	ShallowObjectID    string
+	UnshallowObjectID  string
+
+	StartOfWantedRefs bool
+	WantedRefObjectID string
+	WantedRefName     string
+
+	StartOfPackfileURIs bool
+	PackfileHash        string
+	PackfileURI         string
+
+	StartOfPackfile bool
+	PackStream      []byte
+	ProgressMessage []byte
+	ErrorMessage    []byte
+
+	EndOfSection bool
+	EndResponse  bool
+	ResponseEnd  bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV2FetchResponseChunk) EncodeToPktLine() []byte {
+	if c.StartOfAcknowledgments {
+		return BytesPacket([]byte("acknowledgments\n")).EncodeToPktLine()
+	}
+	if c.AckObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("ACK %s\n", c.AckObjectID))).EncodeToPktLine()
+	}
+	if c.Nak {
+		return BytesPacket([]byte("NAK\n")).EncodeToPktLine()
+	}
+	if c.Ready {
+		return BytesPacket([]byte("ready\n")).EncodeToPktLine()
+	}
+	if c.StartOfShallowInfo {
+		return BytesPacket([]byte("shallow-info\n")).EncodeToPktLine()
+	}
+	// Unlike the other lines, git sends the shallow-info lines without LF.
+	if c.ShallowObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("shallow %s", c.ShallowObjectID))).EncodeToPktLine()
+	}
+	if c.UnshallowObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("unshallow %s", c.UnshallowObjectID))).EncodeToPktLine()
+	}
+	if c.StartOfWantedRefs {
+		return BytesPacket([]byte("wanted-refs\n")).EncodeToPktLine()
+	}
+	if c.WantedRefObjectID != "" && c.WantedRefName != "" {
+		return BytesPacket([]byte(fmt.Sprintf("%s %s\n", c.WantedRefObjectID, c.WantedRefName))).EncodeToPktLine()
+	}
+	if c.StartOfPackfileURIs {
+		return BytesPacket([]byte("packfile-uris\n")).EncodeToPktLine()
+	}
+	if c.PackfileHash != "" && c.PackfileURI != "" {
+		return BytesPacket([]byte(fmt.Sprintf("%s %s\n", c.PackfileHash, c.PackfileURI))).EncodeToPktLine()
+	}
+	if c.StartOfPackfile {
+		return BytesPacket([]byte("packfile\n")).EncodeToPktLine()
+	}
+	if len(c.PackStream) != 0 {
+		return SideBandMainPacket(c.PackStream).EncodeToPktLine()
+	}
+	if len(c.ProgressMessage) != 0 {
+		return SideBandReportPacket(c.ProgressMessage).EncodeToPktLine()
+	}
+	if len(c.ErrorMessage) != 0 {
+		return SideBandErrorPacket(c.ErrorMessage).EncodeToPktLine()
+	}
+	if c.EndOfSection {
+		return DelimPacket{}.EncodeToPktLine()
+	}
+	if c.EndResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	if c.ResponseEnd {
+		return ResponseEndPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ProtocolV2FetchResponse provides an interface for reading a protocol v2 fetch
+// response.
+type ProtocolV2FetchResponse struct {
+	scanner *PacketScanner
+	state   protocolV2FetchResponseState
+	err     error
+	curr    *ProtocolV2FetchResponseChunk
+
+	strict bool
+}
+
+// NewProtocolV2FetchResponse returns a new ProtocolV2FetchResponse to read
+// from rd.
+func NewProtocolV2FetchResponse(rd io.Reader) *ProtocolV2FetchResponse {
+	return &ProtocolV2FetchResponse{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV2FetchResponse.
+func (r *ProtocolV2FetchResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent response chunk generated by a call to Scan.
+//
+// The underlying array of PackStream, ProgressMessage, and ErrorMessage may
+// point to data that will be overwritten by a subsequent call to Scan.
+func (r *ProtocolV2FetchResponse) Chunk() *ProtocolV2FetchResponseChunk {
+	return r.curr
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names of wanted-refs follow git-check-ref-format. A violation is
+// reported as an InvalidObjectIDError or an InvalidRefNameError. This must be
+// called before the first Scan.
+func (r *ProtocolV2FetchResponse) EnableStrictValidation() {
+	r.strict = true
+}
+
+// Scan advances the scanner to the next chunk. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ProtocolV2FetchResponse) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2FetchResponse", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV2FetchResponse", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV2FetchResponse) validateChunk(c *ProtocolV2FetchResponseChunk) error {
+	if !r.strict {
+		return nil
+	}
+	if err := checkObjectIDs(c.AckObjectID, c.ShallowObjectID, c.UnshallowObjectID, c.WantedRefObjectID); err != nil {
+		return err
+	}
+	return checkRefNames(c.WantedRefName)
+}
+
+func (r *ProtocolV2FetchResponse) scan() bool {
+	if r.err != nil {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != protocolV2FetchResponseStateBegin && r.state != protocolV2FetchResponseStateEnd {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	pkt := r.scanner.Packet()
+
+	switch r.state {
+	case protocolV2FetchResponseStateBegin:
+		if bp, ok := pkt.(BytesPacket); ok && bytes.Equal(bp, []byte("acknowledgments\n")) {
+			r.state = protocolV2FetchResponseStateBeginAcknowledgments
+			r.curr = &ProtocolV2FetchResponseChunk{
+				StartOfAcknowledgments: true,
+			}
+			return true
+		}
+		fallthrough
+	case protocolV2FetchResponseStateBeginShallowInfo:
+		if bp, ok := pkt.(BytesPacket); ok && bytes.Equal(bp, []byte("shallow-info\n")) {
+			r.state = protocolV2FetchResponseStateScanShallowInfo
+			r.curr = &ProtocolV2FetchResponseChunk{
+				StartOfShallowInfo: true,
+			}
+			return true
+		}
+		fallthrough
+	case protocolV2FetchResponseStateBeginWantedRefs:
+		if bp, ok := pkt.(BytesPacket); ok && bytes.Equal(bp, []byte("wanted-refs\n")) {
+			r.state = protocolV2FetchResponseStateScanWantedRefs
+			r.curr = &ProtocolV2FetchResponseChunk{
+				StartOfWantedRefs: true,
+			}
+			return true
+		}
+		fallthrough
+	case protocolV2FetchResponseStateBeginPackfileURIs:
+		if bp, ok := pkt.(BytesPacket); ok && bytes.Equal(bp, []byte("packfile-uris\n")) {
+			r.state = protocolV2FetchResponseStateScanPackfileURIs
+			r.curr = &ProtocolV2FetchResponseChunk{
+				StartOfPackfileURIs: true,
+			}
+			return true
+		}
+		fallthrough
+	case protocolV2FetchResponseStateBeginPackfile:
+		if bp, ok := pkt.(BytesPacket); ok && bytes.Equal(bp, []byte("packfile\n")) {
+			r.state = protocolV2FetchResponseStateScanPackfile
+			r.curr = &ProtocolV2FetchResponseChunk{
+				StartOfPackfile: true,
+			}
+			return true
+		}
+		r.err = SyntaxError(fmt.Sprintf("expect a section header, but got: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateBeginAcknowledgments, protocolV2FetchResponseStateScanAcks, protocolV2FetchResponseStateEndOfNak:
+		// The section has either NAK or ACKs, not both.
+		switch p := pkt.(type) {
+		case FlushPacket:
+			// Without "ready", the response ends after the
+			// acknowledgments.
+			r.state = protocolV2FetchResponseStateEnd
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndResponse: true,
+			}
+			return true
+		case BytesPacket:
+			if r.state == protocolV2FetchResponseStateEndOfNak {
+				break
+			}
+			s := strings.TrimSuffix(string(p), "\n")
+			if s == "NAK" && r.state == protocolV2FetchResponseStateBeginAcknowledgments {
+				r.state = protocolV2FetchResponseStateEndOfNak
+				r.curr = &ProtocolV2FetchResponseChunk{
+					Nak: true,
+				}
+				return true
+			}
+			if s == "ready" {
+				r.state = protocolV2FetchResponseStateEndOfAcknowledgments
+				r.curr = &ProtocolV2FetchResponseChunk{
+					Ready: true,
+				}
+				return true
+			}
+			if strings.HasPrefix(s, "ACK ") {
+				r.state = protocolV2FetchResponseStateScanAcks
+				r.curr = &ProtocolV2FetchResponseChunk{
+					AckObjectID: strings.TrimPrefix(s, "ACK "),
+				}
+				return true
+			}
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateEndOfAcknowledgments:
+		if _, ok := pkt.(DelimPacket); !ok {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+			return false
+		}
+		r.state = protocolV2FetchResponseStateBeginShallowInfo
+		r.curr = &ProtocolV2FetchResponseChunk{
+			EndOfSection: true,
+		}
+		return true
+	case protocolV2FetchResponseStateScanShallowInfo:
+		switch p := pkt.(type) {
+		case DelimPacket:
+			r.state = protocolV2FetchResponseStateBeginWantedRefs
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndOfSection: true,
+			}
+			return true
+		case BytesPacket:
+			ss := strings.SplitN(strings.TrimSuffix(string(p), "\n"), " ", 2)
+			if len(ss) != 2 {
+				r.err = SyntaxError("cannot split into two: " + string(p))
+				return false
+			}
+			switch ss[0] {
+			case "shallow":
+				r.curr = &ProtocolV2FetchResponseChunk{
+					ShallowObjectID: ss[1],
+				}
+				return true
+			case "unshallow":
+				r.curr = &ProtocolV2FetchResponseChunk{
+					UnshallowObjectID: ss[1],
+				}
+				return true
+			}
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateScanWantedRefs:
+		switch p := pkt.(type) {
+		case DelimPacket:
+			r.state = protocolV2FetchResponseStateBeginPackfileURIs
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndOfSection: true,
+			}
+			return true
+		case BytesPacket:
+			ss := strings.SplitN(strings.TrimSuffix(string(p), "\n"), " ", 2)
+			if len(ss) != 2 {
+				r.err = SyntaxError("cannot split into two: " + string(p))
+				return false
+			}
+			r.curr = &ProtocolV2FetchResponseChunk{
+				WantedRefObjectID: ss[0],
+				WantedRefName:     ss[1],
+			}
+			return true
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateScanPackfileURIs:
+		switch p := pkt.(type) {
+		case DelimPacket:
+			r.state = protocolV2FetchResponseStateBeginPackfile
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndOfSection: true,
+			}
+			return true
+		case BytesPacket:
+			ss := strings.SplitN(strings.TrimSuffix(string(p), "\n"), " ", 2)
+			if len(ss) != 2 {
+				r.err = SyntaxError("cannot split into two: " + string(p))
+				return false
+			}
+			r.curr = &ProtocolV2FetchResponseChunk{
+				PackfileHash: ss[0],
+				PackfileURI:  ss[1],
+			}
+			return true
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateScanPackfile:
+		switch p := pkt.(type) {
+		case FlushPacket:
+			r.state = protocolV2FetchResponseStateEnd
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndResponse: true,
+			}
+			return true
+		case BytesPacket:
+			if len(p) == 0 {
+				break
+			}
+			switch sp := ParseSideBandPacket(p).(type) {
+			case SideBandMainPacket:
+				r.curr = &ProtocolV2FetchResponseChunk{
+					PackStream: sp,
+				}
+				return true
+			case SideBandReportPacket:
+				r.curr = &ProtocolV2FetchResponseChunk{
+					ProgressMessage: sp,
+				}
+				return true
+			case SideBandErrorPacket:
+				r.curr = &ProtocolV2FetchResponseChunk{
+					ErrorMessage: sp,
+				}
+				return true
+			}
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case protocolV2FetchResponseStateEnd:
+		if _, ok := pkt.(ResponseEndPacket); !ok {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+			return false
+		}
+		r.curr = &ProtocolV2FetchResponseChunk{
+			ResponseEnd: true,
+		}
+		return true
+	}
+	panic("impossible state")
+}
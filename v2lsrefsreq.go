@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type protocolV2LsRefsRequestState int
+
+const (
+	protocolV2LsRefsRequestStateBegin protocolV2LsRefsRequestState = iota
+	protocolV2LsRefsRequestStateScanCapabilities
+	protocolV2LsRefsRequestStateScanArguments
+	protocolV2LsRefsRequestStateEnd
+)
+
+// ProtocolV2LsRefsRequestChunk is a chunk of a protocol v2 ls-refs request.
+type ProtocolV2LsRefsRequestChunk struct {
+	Command       string
+	Capability    string
+	EndCapability bool
+	Symrefs       bool
+	Peel          bool
+	Unborn        bool
+	RefPrefix     string
+	EndArgument   bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV2LsRefsRequestChunk) EncodeToPktLine() []byte {
+	if c.Command != "" {
+		return BytesPacket([]byte(fmt.Sprintf("command=%s\n", c.Command))).EncodeToPktLine()
+	}
+	if c.Capability != "" {
+		// Unlike the other lines, git sends the capabilities without
+		// LF.
+		return BytesPacket([]byte(c.Capability)).EncodeToPktLine()
+	}
+	if c.EndCapability {
+		return DelimPacket{}.EncodeToPktLine()
+	}
+	if c.Symrefs {
+		return BytesPacket([]byte("symrefs\n")).EncodeToPktLine()
+	}
+	if c.Peel {
+		return BytesPacket([]byte("peel\n")).EncodeToPktLine()
+	}
+	if c.Unborn {
+		return BytesPacket([]byte("unborn\n")).EncodeToPktLine()
+	}
+	if c.RefPrefix != "" {
+		return BytesPacket([]byte(fmt.Sprintf("ref-prefix %s\n", c.RefPrefix))).EncodeToPktLine()
+	}
+	if c.EndArgument {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ProtocolV2LsRefsRequest provides an interface for reading a protocol v2
+// ls-refs request. It reads one ls-refs command. Unlike the other request
+// scanners, it has no validation mode, since the request has no object IDs and
+// the ref-prefix arguments are not ref names.
+type ProtocolV2LsRefsRequest struct {
+	scanner *ProtocolV2Request
+	state   protocolV2LsRefsRequestState
+	err     error
+	curr    *ProtocolV2LsRefsRequestChunk
+}
+
+// NewProtocolV2LsRefsRequest returns a new ProtocolV2LsRefsRequest to read
+// from rd.
+func NewProtocolV2LsRefsRequest(rd io.Reader) *ProtocolV2LsRefsRequest {
+	return &ProtocolV2LsRefsRequest{scanner: NewProtocolV2Request(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV2LsRefsRequest.
+func (r *ProtocolV2LsRefsRequest) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent request chunk generated by a call to Scan.
+func (r *ProtocolV2LsRefsRequest) Chunk() *ProtocolV2LsRefsRequestChunk {
+	return r.curr
+}
+
+// Capabilities returns the capabilities of the command that have been scanned
+// so far.
+func (r *ProtocolV2LsRefsRequest) Capabilities() Capabilities {
+	return r.scanner.Capabilities()
+}
+
+// Scan advances the scanner to the next chunk. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ProtocolV2LsRefsRequest) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2LsRefsRequest", int(r.state), r.scanner.scanner)
+		return false
+	}
+	return true
+}
+
+func (r *ProtocolV2LsRefsRequest) scan() bool {
+	if r.err != nil || r.state == protocolV2LsRefsRequestStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != protocolV2LsRefsRequestStateBegin {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	c := r.scanner.Chunk()
+
+	switch r.state {
+	case protocolV2LsRefsRequestStateBegin:
+		if c.Command != "ls-refs" {
+			r.err = SyntaxError(fmt.Sprintf("unexpected chunk: %#v", c))
+			return false
+		}
+		r.state = protocolV2LsRefsRequestStateScanCapabilities
+		r.curr = &ProtocolV2LsRefsRequestChunk{
+			Command: c.Command,
+		}
+		return true
+	case protocolV2LsRefsRequestStateScanCapabilities:
+		if c.EndCapability {
+			r.state = protocolV2LsRefsRequestStateScanArguments
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				EndCapability: true,
+			}
+			return true
+		}
+		r.curr = &ProtocolV2LsRefsRequestChunk{
+			Capability: c.Capability,
+		}
+		return true
+	case protocolV2LsRefsRequestStateScanArguments:
+		if c.EndArgument {
+			r.state = protocolV2LsRefsRequestStateEnd
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				EndArgument: true,
+			}
+			return true
+		}
+		s := strings.TrimSuffix(string(c.Argument), "\n")
+		switch {
+		case s == "symrefs":
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				Symrefs: true,
+			}
+		case s == "peel":
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				Peel: true,
+			}
+		case s == "unborn":
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				Unborn: true,
+			}
+		case strings.HasPrefix(s, "ref-prefix "):
+			prefix := strings.TrimPrefix(s, "ref-prefix ")
+			if prefix == "" {
+				r.err = SyntaxError("empty ref-prefix")
+				return false
+			}
+			r.curr = &ProtocolV2LsRefsRequestChunk{
+				RefPrefix: prefix,
+			}
+		default:
+			r.err = SyntaxError("unexpected ls-refs argument: " + s)
+			return false
+		}
+		return true
+	}
+	panic("impossible state")
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type protocolV2LsRefsResponseState int
+
+const (
+	protocolV2LsRefsResponseStateBegin protocolV2LsRefsResponseState = iota
+	protocolV2LsRefsResponseStateScanRefs
+	protocolV2LsRefsResponseStateEnd
+)
+
+// ProtocolV2LsRefsResponseChunk is a chunk of a protocol v2 ls-refs response.
+//
+// ObjectID is empty if the ref is unborn.
+type ProtocolV2LsRefsResponseChunk struct {
+	ObjectID       string
+	Unborn         bool
+	RefName        string
+	SymrefTarget   string
+	PeeledObjectID string
+	EndResponse    bool
+	ResponseEnd    bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV2LsRefsResponseChunk) EncodeToPktLine() []byte {
+	if (c.ObjectID != "" || c.Unborn) && c.RefName != "" {
+		oid := c.ObjectID
+		if c.Unborn {
+			oid = "unborn"
+		}
+		s := fmt.Sprintf("%s %s", oid, c.RefName)
+		if c.SymrefTarget != "" {
+			s += " symref-target:" + c.SymrefTarget
+		}
+		if c.PeeledObjectID != "" {
+			s += " peeled:" + c.PeeledObjectID
+		}
+		return BytesPacket([]byte(s + "\n")).EncodeToPktLine()
+	}
+	if c.EndResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	if c.ResponseEnd {
+		return ResponseEndPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ProtocolV2LsRefsResponse provides an interface for reading a protocol v2
+// ls-refs response.
+type ProtocolV2LsRefsResponse struct {
+	scanner *ProtocolV2Response
+	state   protocolV2LsRefsResponseState
+	err     error
+	curr    *ProtocolV2LsRefsResponseChunk
+
+	strict bool
+}
+
+// NewProtocolV2LsRefsResponse returns a new ProtocolV2LsRefsResponse to read
+// from rd.
+func NewProtocolV2LsRefsResponse(rd io.Reader) *ProtocolV2LsRefsResponse {
+	return &ProtocolV2LsRefsResponse{scanner: NewProtocolV2Response(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV2LsRefsResponse.
+func (r *ProtocolV2LsRefsResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent response chunk generated by a call to Scan.
+func (r *ProtocolV2LsRefsResponse) Chunk() *ProtocolV2LsRefsResponseChunk {
+	return r.curr
+}
+
+// EnableStrictValidation makes the scanner check that the object IDs are hex
+// and the ref names follow git-check-ref-format. A violation is reported as an
+// InvalidObjectIDError or an InvalidRefNameError. This must be called before
+// the first Scan.
+func (r *ProtocolV2LsRefsResponse) EnableStrictValidation() {
+	r.strict = true
+}
+
+// Scan advances the scanner to the next chunk. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ProtocolV2LsRefsResponse) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2LsRefsResponse", int(r.state), r.scanner.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV2LsRefsResponse", int(r.state), r.scanner.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the chunk that the scanner generated.
+func (r *ProtocolV2LsRefsResponse) validateChunk(c *ProtocolV2LsRefsResponseChunk) error {
+	if !r.strict {
+		return nil
+	}
+	if err := checkObjectIDs(c.ObjectID, c.PeeledObjectID); err != nil {
+		return err
+	}
+	return checkRefNames(c.RefName, c.SymrefTarget)
+}
+
+func (r *ProtocolV2LsRefsResponse) scan() bool {
+	if r.err != nil {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != protocolV2LsRefsResponseStateEnd {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	c := r.scanner.Chunk()
+
+	switch r.state {
+	case protocolV2LsRefsResponseStateBegin, protocolV2LsRefsResponseStateScanRefs:
+		if c.EndResponse {
+			r.state = protocolV2LsRefsResponseStateEnd
+			r.curr = &ProtocolV2LsRefsResponseChunk{
+				EndResponse: true,
+			}
+			return true
+		}
+		if len(c.Response) == 0 {
+			r.err = SyntaxError(fmt.Sprintf("unexpected chunk: %#v", c))
+			return false
+		}
+		ss := strings.Split(strings.TrimSuffix(string(c.Response), "\n"), " ")
+		if len(ss) < 2 {
+			r.err = SyntaxError("cannot split into two: " + string(c.Response))
+			return false
+		}
+		chunk := &ProtocolV2LsRefsResponseChunk{
+			RefName: ss[1],
+		}
+		if ss[0] == "unborn" {
+			chunk.Unborn = true
+		} else {
+			chunk.ObjectID = ss[0]
+		}
+		for _, attr := range ss[2:] {
+			switch {
+			case strings.HasPrefix(attr, "symref-target:"):
+				chunk.SymrefTarget = strings.TrimPrefix(attr, "symref-target:")
+			case strings.HasPrefix(attr, "peeled:"):
+				chunk.PeeledObjectID = strings.TrimPrefix(attr, "peeled:")
+			default:
+				r.err = SyntaxError("unknown ref attribute: " + attr)
+				return false
+			}
+		}
+		r.state = protocolV2LsRefsResponseStateScanRefs
+		r.curr = chunk
+		return true
+	case protocolV2LsRefsResponseStateEnd:
+		if !c.ResponseEnd {
+			r.err = SyntaxError(fmt.Sprintf("unexpected chunk: %#v", c))
+			return false
+		}
+		r.curr = &ProtocolV2LsRefsResponseChunk{
+			ResponseEnd: true,
+		}
+		return true
+	}
+	panic("impossible state")
+}
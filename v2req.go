@@ -66,6 +66,11 @@ type ProtocolV2Request struct {
 	state   protocolV2RequestState
 	err     error
 	curr    *ProtocolV2RequestChunk
+
+	capabilities Capabilities
+	command      string
+	objectFormat objectFormatValidator
+	strict       bool
 }
 
 // NewProtocolV2Request returns a new ProtocolV2Request to read from rd.
@@ -87,11 +92,70 @@ func (r *ProtocolV2Request) Chunk() *ProtocolV2RequestChunk {
 	return r.curr
 }
 
+// Capabilities returns the capabilities of the current command that have been
+// scanned so far. This is reset when the next command starts.
+func (r *ProtocolV2Request) Capabilities() Capabilities {
+	return r.capabilities
+}
+
+// EnableStrictValidation makes the scanner check the arguments of the fetch
+// commands like ProtocolV2FetchRequest.EnableStrictValidation. The other
+// commands have no object IDs or ref names to check. Note that the ref-prefix
+// arguments of ls-refs are not ref names. This must be called before the first
+// Scan.
+func (r *ProtocolV2Request) EnableStrictValidation() {
+	r.strict = true
+}
+
+// EnableObjectFormatValidation makes the scanner check the arguments of the
+// fetch commands like ProtocolV2FetchRequest.EnableObjectFormatValidation. The
+// object format is negotiated for each command. This must be called before the
+// first Scan.
+func (r *ProtocolV2Request) EnableObjectFormatValidation(objectFormat string) {
+	r.objectFormat.enabled = true
+	r.objectFormat.advertised = objectFormat
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV2Request) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2Request", int(r.state), r.scanner)
+		return false
+	}
+	if err := r.validateChunk(r.curr); err != nil {
+		r.err = newParseError(err, "ProtocolV2Request", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+// validateChunk validates the arguments of the fetch commands. A malformed
+// argument is not an error here, as ProtocolV2Request doesn't parse the
+// arguments.
+func (r *ProtocolV2Request) validateChunk(c *ProtocolV2RequestChunk) error {
+	if c.Command != "" {
+		r.command = c.Command
+		r.objectFormat.format = ""
+		r.objectFormat.pending = nil
+		return nil
+	}
+	if r.command != "fetch" {
+		return nil
+	}
+	fc := &ProtocolV2FetchRequestChunk{EndCapability: c.EndCapability}
+	if len(c.Argument) != 0 {
+		var err error
+		if fc, _, err = parseProtocolV2FetchArgument(strings.TrimSuffix(string(c.Argument), "\n")); err != nil {
+			return nil
+		}
+	}
+	return validateProtocolV2FetchChunk(fc, r.strict, &r.objectFormat, r.capabilities)
+}
+
+func (r *ProtocolV2Request) scan() bool {
 	if r.err != nil || r.state == protocolV2RequestStateEnd {
 		return false
 	}
@@ -119,6 +183,7 @@ func (r *ProtocolV2Request) Scan() bool {
 				return false
 			}
 			r.state = protocolV2RequestStateScanCapabilities
+			r.capabilities = Capabilities{}
 			r.curr = &ProtocolV2RequestChunk{
 				Command: strings.TrimSuffix(strings.TrimPrefix(string(p), "command="), "\n"),
 			}
@@ -136,8 +201,10 @@ func (r *ProtocolV2Request) Scan() bool {
 			}
 			return true
 		case BytesPacket:
+			capability := strings.TrimSuffix(string(p), "\n")
+			r.capabilities = append(r.capabilities, capability)
 			r.curr = &ProtocolV2RequestChunk{
-				Capability: strings.TrimSuffix(string(p), "\n"),
+				Capability: capability,
 			}
 			return true
 		default:
@@ -24,6 +24,7 @@ type protocolV2ResponseState int
 const (
 	protocolV2ResponseStateBegin protocolV2ResponseState = iota
 	protocolV2ResponseStateScanResponse
+	protocolV2ResponseStateEndResponse
 	protocolV2ResponseStateEnd
 )
 
@@ -32,6 +33,7 @@ type ProtocolV2ResponseChunk struct {
 	Response    []byte
 	Delimiter   bool
 	EndResponse bool
+	ResponseEnd bool
 }
 
 // EncodeToPktLine serializes the chunk.
@@ -45,6 +47,9 @@ func (c *ProtocolV2ResponseChunk) EncodeToPktLine() []byte {
 	if c.EndResponse {
 		return FlushPacket{}.EncodeToPktLine()
 	}
+	if c.ResponseEnd {
+		return ResponseEndPacket{}.EncodeToPktLine()
+	}
 	panic("impossible chunk")
 }
 
@@ -58,7 +63,14 @@ type ProtocolV2Response struct {
 
 // NewProtocolV2Response returns a new ProtocolV2Response to read from rd.
 func NewProtocolV2Response(rd io.Reader) *ProtocolV2Response {
-	return &ProtocolV2Response{scanner: NewPacketScanner(rd)}
+	return NewProtocolV2ResponseFromScanner(NewPacketScanner(rd))
+}
+
+// NewProtocolV2ResponseFromScanner returns a new ProtocolV2Response to read the
+// packets from scanner. This is used to continue reading after the ref
+// advertisement.
+func NewProtocolV2ResponseFromScanner(scanner *PacketScanner) *ProtocolV2Response {
+	return &ProtocolV2Response{scanner: scanner}
 }
 
 // Err returns the first non-EOF error that was encountered by the
@@ -80,12 +92,20 @@ func (r *ProtocolV2Response) Chunk() *ProtocolV2ResponseChunk {
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV2Response) Scan() bool {
+	if !r.scan() {
+		r.err = newParseError(r.err, "ProtocolV2Response", int(r.state), r.scanner)
+		return false
+	}
+	return true
+}
+
+func (r *ProtocolV2Response) scan() bool {
 	if r.err != nil || r.state == protocolV2ResponseStateEnd {
 		return false
 	}
 	if !r.scanner.Scan() {
 		r.err = r.scanner.Err()
-		if r.err == nil && r.state != protocolV2ResponseStateBegin {
+		if r.err == nil && r.state != protocolV2ResponseStateBegin && r.state != protocolV2ResponseStateEndResponse {
 			r.err = SyntaxError("early EOF")
 		}
 		return false
@@ -93,11 +113,23 @@ func (r *ProtocolV2Response) Scan() bool {
 
 	switch p := r.scanner.Packet().(type) {
 	case FlushPacket:
-		r.state = protocolV2ResponseStateBegin
+		r.state = protocolV2ResponseStateEndResponse
 		r.curr = &ProtocolV2ResponseChunk{
 			EndResponse: true,
 		}
 		return true
+	case ResponseEndPacket:
+		if r.state != protocolV2ResponseStateEndResponse {
+			// The response-end packet can appear only after the
+			// response is terminated by a flush packet.
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+			return false
+		}
+		r.state = protocolV2ResponseStateBegin
+		r.curr = &ProtocolV2ResponseChunk{
+			ResponseEnd: true,
+		}
+		return true
 	case DelimPacket:
 		r.state = protocolV2ResponseStateScanResponse
 		r.curr = &ProtocolV2ResponseChunk{